@@ -2,6 +2,7 @@ package dependency
 
 import (
 	"bytes"
+	"context"
 	"encoding/xml"
 	"fmt"
 	"io/ioutil"
@@ -33,7 +34,7 @@ func NewSystemMavenDownloader(wd string) *SystemMavenDownloader {
 	}
 }
 
-func (m *SystemMavenDownloader) Get() error {
+func (m *SystemMavenDownloader) Get(ctx context.Context) error {
 	in := filepath.Join(m.workingDirectory, pomName)
 	f, err := os.Open(in)
 	if os.IsNotExist(err) {
@@ -63,7 +64,7 @@ func (m *SystemMavenDownloader) Get() error {
 		return err
 	}
 
-	err = m.download()
+	err = m.download(ctx)
 	if err != nil {
 		return err
 	}
@@ -82,7 +83,7 @@ func (m *SystemMavenDownloader) save(pom *Project) error {
 	return nil
 }
 
-func (m *SystemMavenDownloader) download() error {
+func (m *SystemMavenDownloader) download(ctx context.Context) error {
 	destDir := filepath.Join(m.workingDirectory, dependencyDir)
 	// prepare directory
 	err := os.MkdirAll(destDir, 0777)
@@ -93,19 +94,22 @@ func (m *SystemMavenDownloader) download() error {
 	if runtime.GOOS == "windows" {
 		cmd = "mvn.cmd"
 	}
-	err = run(m.workingDirectory, cmd, "dependency:copy-dependencies", fmt.Sprintf("-DoutputDirectory=%s", destDir), "-f", filepath.Join(m.workingDirectory, outFileName))
+	err = run(ctx, m.workingDirectory, cmd, "dependency:copy-dependencies", fmt.Sprintf("-DoutputDirectory=%s", destDir), "-f", filepath.Join(m.workingDirectory, outFileName))
 	if err != nil {
 		return errors.Wrapf(err, "failed to download deps to %s", destDir)
 	}
 	return nil
 }
 
-func run(wd, command string, args ...string) error {
-	cmd := exec.Command(command, args...)
+func run(ctx context.Context, wd, command string, args ...string) error {
+	cmd := exec.CommandContext(ctx, command, args...)
 	cmd.Dir = wd
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
 	err := cmd.Run()
+	if ctx.Err() != nil {
+		return errors.Wrapf(ctx.Err(), "%q interrupted", command+" "+strings.Join(args, " "))
+	}
 	if err != nil {
 		log.Errorf("Error occured when running %q: %s", command+" "+strings.Join(args, " "), stderr.String())
 		return err
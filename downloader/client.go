@@ -0,0 +1,221 @@
+// Package downloader downloads the sources at their commits, along with their dependencies, into a directory tree.
+package downloader
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/arekziobrowski/sourcerer/model"
+	"github.com/arekziobrowski/sourcerer/source"
+	"github.com/pkg/errors"
+)
+
+// Options are the options of the downloads. The zero values of the limits take the defaults.
+type Options struct {
+	// Dir is the directory the sources are downloaded into.
+	Dir string
+	// Downloader is the downloader of the sources without their own, GitSystem by default.
+	Downloader SourceDownloaderType
+	// WithDependencies downloads the Maven dependencies of the sources without their own setting.
+	WithDependencies bool
+	// Strict stops the downloads on the first failure, which is returned as the error.
+	Strict bool
+	// DedupWindow is the number of the most recent sources remembered to skip the duplicates, 1000000 by default,
+	// so that the memory stays bounded. A warning is logged when the sources start to be forgotten.
+	DedupWindow int
+	// Submodules checks out the submodules of the sources without their own setting.
+	Submodules bool
+	// History is the history fetched for the sources without their own, the last commit by default.
+	History model.History
+	// LFS are the options of the Git LFS objects of the sources without their own.
+	LFS model.LFSOptions
+	// SharedStore checks out the sources of the same origin from a single shared repository.
+	SharedStore bool
+	// Cache is the cache of the mirrors of the origins, no cache if nil.
+	Cache *source.Cache
+	// Verification is the verification of the sources after the download.
+	Verification VerificationType
+	// Jobs is the maximum number of the sources downloaded at once, 16 by default.
+	Jobs int
+	// DependencyJobs is the maximum number of the sources whose dependencies are downloaded at once, 2 by default.
+	DependencyJobs int
+	// HostJobs is the maximum number of the sources downloaded at once from a single host, unlimited if zero.
+	HostJobs int
+	// HostLimits override HostJobs for the hosts.
+	HostLimits map[string]int
+	// Attempts is the maximum number of the attempts to download a source, 1 by default.
+	// Only the network and remote failures are retried.
+	Attempts int
+	// RetryDelay is the backoff after the first failed attempt, doubled after each next one.
+	RetryDelay time.Duration
+	// RetryMaxDelay caps the backoff, unlimited if zero.
+	RetryMaxDelay time.Duration
+	// SourceTimeout limits the download of a single source including the retries, and separately of its dependencies,
+	// unlimited if zero.
+	SourceTimeout time.Duration
+	// KeepFailed keeps the staging directories of the failed sources for debugging.
+	KeepFailed bool
+	// MeasureSize measures the size of the source directories.
+	MeasureSize bool
+	// Progress tracks the progress of the downloads, if not nil.
+	Progress *Progress
+	// Metrics collects the metrics of the downloads, if not nil.
+	Metrics *Metrics
+	// Events receives the events of the downloads, if not nil.
+	Events EventHandler
+	// Results receives the result of every source once it is finished, if not nil.
+	Results ResultHandler
+	// SourceHook is the shell command run in the directory of every downloaded source, none if empty.
+	SourceHook string
+	// DependenciesHook is the shell command run in the directory of every source after its dependencies are downloaded,
+	// none if empty.
+	DependenciesHook string
+	// HookTimeout limits a single run of a hook, unlimited if zero.
+	HookTimeout time.Duration
+}
+
+// defaultDedupWindow is the number of the sources remembered to skip the duplicates unless set.
+const defaultDedupWindow = 1000000
+
+// Result is the outcome of the download of a source.
+type Result struct {
+	// Source is the source along with its commit and the details of its download.
+	Source *model.Source
+	// Index is the position of the source in the input, starting from 1.
+	Index int
+	// Directory is the directory of the source.
+	Directory string
+	// Status is the status of the source.
+	Status model.Status
+	// Err is the failure of the source, nil unless the source failed.
+	Err error
+}
+
+// ResultHandler receives the results of the sources as they are finished, concurrently for different sources.
+type ResultHandler interface {
+	HandleResult(r Result)
+}
+
+// ResultHandlerFunc is a function receiving the results.
+type ResultHandlerFunc func(r Result)
+
+func (f ResultHandlerFunc) HandleResult(r Result) {
+	f(r)
+}
+
+// Client downloads the sources. The downloads may run concurrently, within the same limits.
+type Client struct {
+	options   Options
+	scheduler *scheduler
+	retry     retryPolicy
+}
+
+// New creates the client downloading the sources with the options.
+func New(options Options) (*Client, error) {
+	if options.Dir == "" {
+		return nil, errors.New("the destination directory is missing")
+	}
+	if options.Downloader == 0 {
+		options.Downloader = GitSystem
+	}
+	if options.History.IsZero() {
+		options.History.Depth = 1
+	}
+	if err := options.History.Validate(); err != nil {
+		return nil, err
+	}
+	if options.Jobs == 0 {
+		options.Jobs = 16
+	}
+	if options.DependencyJobs == 0 {
+		options.DependencyJobs = 2
+	}
+	if options.Attempts == 0 {
+		options.Attempts = 1
+	}
+	if options.DedupWindow == 0 {
+		options.DedupWindow = defaultDedupWindow
+	}
+	if options.Jobs < 0 {
+		return nil, errors.Errorf("invalid number of jobs: %d", options.Jobs)
+	}
+	if options.DependencyJobs < 0 {
+		return nil, errors.Errorf("invalid number of dependency jobs: %d", options.DependencyJobs)
+	}
+	if options.HostJobs < 0 {
+		return nil, errors.Errorf("invalid number of host jobs: %d", options.HostJobs)
+	}
+	for host, limit := range options.HostLimits {
+		if limit < 0 {
+			return nil, errors.Errorf("invalid host limit %s=%d", host, limit)
+		}
+	}
+	if options.Attempts < 0 {
+		return nil, errors.Errorf("invalid number of attempts: %d", options.Attempts)
+	}
+	if options.RetryDelay < 0 || options.RetryMaxDelay < 0 {
+		return nil, errors.New("invalid retry delay")
+	}
+	if options.DedupWindow < 0 {
+		return nil, errors.Errorf("invalid deduplication window: %d", options.DedupWindow)
+	}
+	if options.HookTimeout < 0 {
+		return nil, errors.Errorf("invalid hook timeout: %s", options.HookTimeout)
+	}
+	return &Client{
+		options:   options,
+		scheduler: newScheduler(options.Jobs, options.DependencyJobs, options.HostJobs, options.HostLimits),
+		retry:     retryPolicy{attempts: options.Attempts, delay: options.RetryDelay, maxDelay: options.RetryMaxDelay},
+	}, nil
+}
+
+// Download downloads the sources until they are done or the context is done. The results are in the order
+// of the sources; the duplicates of the earlier sources and the sources not started before the context is done
+// have none. The results are also passed to Options.Results, if any. The error is the first failure in the strict
+// mode, or the error of the context.
+func (c *Client) Download(ctx context.Context, srcs []model.Source) ([]Result, error) {
+	list := make([]*model.Source, 0, len(srcs))
+	for i := range srcs {
+		src := srcs[i]
+		list = append(list, &src)
+	}
+	var mutex sync.Mutex
+	results := make([]Result, 0, len(srcs))
+	s := c.newService(&sourceList{sources: list}, ResultHandlerFunc(func(r Result) {
+		mutex.Lock()
+		results = append(results, r)
+		mutex.Unlock()
+		if c.options.Results != nil {
+			c.options.Results.HandleResult(r)
+		}
+	}))
+	err := s.GetSources(ctx)
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Index < results[j].Index
+	})
+	return results, err
+}
+
+// DownloadSources downloads the sources read from the stream, the same way as Download. The results are only passed
+// to Options.Results as the sources are finished, so that the memory stays bounded for arbitrarily long streams.
+// An invalid entry of a manifest fails the download in the strict mode, and is skipped otherwise.
+func (c *Client) DownloadSources(ctx context.Context, srcs Sources) error {
+	return c.newService(srcs, c.options.Results).GetSources(ctx)
+}
+
+// sourceList is the stream of the sources of a slice.
+type sourceList struct {
+	sources []*model.Source
+}
+
+func (l *sourceList) Next() (*model.Source, error) {
+	if len(l.sources) == 0 {
+		return nil, io.EOF
+	}
+	src := l.sources[0]
+	l.sources = l.sources[1:]
+	return src, nil
+}
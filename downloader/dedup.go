@@ -0,0 +1,43 @@
+package downloader
+
+import log "github.com/sirupsen/logrus"
+
+// seenSet remembers the keys added so far along with the indexes of their first occurrences. With a capacity,
+// only the most recent keys are kept, so that the memory stays bounded for arbitrarily long inputs, and a warning
+// is logged when the first key is forgotten, as the duplicates further apart are not detected from then on.
+type seenSet struct {
+	what     string
+	capacity int
+	keys     map[string]int
+	order    []string
+	next     int
+	warned   bool
+}
+
+// newSeenSet creates the set of the keys described by what, unbounded if the capacity is 0.
+func newSeenSet(what string, capacity int) *seenSet {
+	return &seenSet{what: what, capacity: capacity, keys: make(map[string]int)}
+}
+
+// add returns false along with the index of the first occurrence if the key has already been added.
+func (r *seenSet) add(key string, index int) (int, bool) {
+	if first, ok := r.keys[key]; ok {
+		return first, false
+	}
+	switch {
+	case r.capacity == 0:
+	case len(r.order) < r.capacity:
+		r.order = append(r.order, key)
+	default:
+		if !r.warned {
+			log.Warnf("Forgetting the %s of the sources before #%d, the duplicates more than %d sources apart are not skipped",
+				r.what, index, r.capacity)
+			r.warned = true
+		}
+		delete(r.keys, r.order[r.next])
+		r.order[r.next] = key
+		r.next = (r.next + 1) % r.capacity
+	}
+	r.keys[key] = index
+	return index, true
+}
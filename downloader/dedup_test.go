@@ -0,0 +1,41 @@
+package downloader
+
+import "testing"
+
+func TestSeenSet(t *testing.T) {
+	type add struct {
+		key   string
+		first int
+		added bool
+	}
+	tests := []struct {
+		name     string
+		capacity int
+		adds     []add
+	}{
+		{
+			name: "unbounded",
+			adds: []add{{"a", 1, true}, {"b", 2, true}, {"a", 1, false}, {"c", 4, true}, {"b", 2, false}},
+		},
+		{
+			name: "similar keys",
+			adds: []add{{"host/org/repo@1", 1, true}, {"host/org/Repo@1", 2, true}, {"host/org/repo@1 dst", 3, true}},
+		},
+		{
+			name:     "bounded",
+			capacity: 2,
+			adds:     []add{{"a", 1, true}, {"b", 2, true}, {"a", 1, false}, {"c", 4, true}, {"a", 5, true}, {"c", 4, false}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			set := newSeenSet("keys", tt.capacity)
+			for i, a := range tt.adds {
+				first, added := set.add(a.key, i+1)
+				if first != a.first || added != a.added {
+					t.Errorf("add(%q, %d) = %d, %v, want %d, %v", a.key, i+1, first, added, a.first, a.added)
+				}
+			}
+		})
+	}
+}
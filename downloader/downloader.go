@@ -0,0 +1,849 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/arekziobrowski/sourcerer/dependency"
+	"github.com/arekziobrowski/sourcerer/manifest"
+	"github.com/arekziobrowski/sourcerer/model"
+	"github.com/arekziobrowski/sourcerer/source"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+)
+
+// Sources is a stream of sources to download. Next returns io.EOF when there are no more sources.
+type Sources interface {
+	Next() (*model.Source, error)
+}
+
+// sourceDownloader downloads the source into its directory.
+type sourceDownloader interface {
+	Get(ctx context.Context, src *model.Source) error
+}
+
+// sourceInspector inspects the directory of the source left by an earlier run, and verifies it after the download.
+type sourceInspector interface {
+	Inspect(ctx context.Context, src *model.Source) (source.State, error)
+	Verify(ctx context.Context, src *model.Source, objects bool) error
+}
+
+// revisionResolver resolves the revision of the source to a commit.
+type revisionResolver interface {
+	Resolve(ctx context.Context, src *model.Source) (string, error)
+}
+
+// dependencyDownloader downloads the dependencies of the source in its directory.
+type dependencyDownloader interface {
+	Get(ctx context.Context) error
+}
+
+// storeDir is the directory of the stores shared by the sources of the same origin, relative to the destination directory.
+const storeDir = ".sourcerer-store"
+
+// resolveWindow is the number of sources whose revisions are resolved ahead of the downloads.
+const resolveWindow = 64
+
+type SourceDownloaderType int
+
+const (
+	GitDirect SourceDownloaderType = 1 << iota
+	GitSystem
+)
+
+// SourceDownloaderTypeOf returns the downloader of the name used in the manifests, GitSystem if unknown.
+func SourceDownloaderTypeOf(name string) SourceDownloaderType {
+	switch name {
+	case model.DownloaderGit:
+		return GitDirect
+	case model.DownloaderGitSystem:
+		return GitSystem
+	default:
+		return GitSystem
+	}
+}
+
+// VerificationType is the verification of the sources after the download.
+type VerificationType int
+
+const (
+	// VerifyNone skips the verification.
+	VerifyNone VerificationType = iota
+	// VerifyCheckout checks that the source is checked out at the commit without changes.
+	VerifyCheckout
+	// VerifyObjects checks the checkout and the integrity of the fetched objects.
+	VerifyObjects
+)
+
+type DependencyDownloaderType int
+
+const (
+	MavenSystem DependencyDownloaderType = 1 << iota
+)
+
+type service struct {
+	sources                  Sources
+	sourceDownloaderType     SourceDownloaderType
+	dependencyDownloaderType DependencyDownloaderType
+	rootDir                  string
+	withDependencies         bool
+	strict                   bool
+	dedupWindow              int
+	submodules               bool
+	history                  model.History
+	lfs                      model.LFSOptions
+	sharedStore              bool
+	storesMutex              sync.Mutex
+	stores                   map[string]*source.Store
+	cache                    *source.Cache
+	verification             VerificationType
+	scheduler                *scheduler
+	retry                    retryPolicy
+	sourceTimeout            time.Duration
+	keepFailed               bool
+	measureSize              bool
+	progress                 *Progress
+	metrics                  *Metrics
+	events                   EventHandler
+	sourceHook               string
+	dependenciesHook         string
+	hookTimeout              time.Duration
+	unhandled                pendingSources
+	results                  ResultHandler
+	summaryMutex             sync.Mutex
+	summary                  runSummary
+}
+
+// runSummary counts the finished sources for the summary of the run. Only the failed sources are kept.
+type runSummary struct {
+	statuses map[model.Status]int
+	retried  int
+	failed   []*model.Source
+}
+
+// newService creates the service downloading the sources of a single call of the client, passing their results
+// to the handler.
+func (c *Client) newService(srcs Sources, results ResultHandler) *service {
+	return &service{
+		sources:                  srcs,
+		sourceDownloaderType:     c.options.Downloader,
+		dependencyDownloaderType: MavenSystem,
+		rootDir:                  c.options.Dir,
+		withDependencies:         c.options.WithDependencies,
+		strict:                   c.options.Strict,
+		dedupWindow:              c.options.DedupWindow,
+		submodules:               c.options.Submodules,
+		history:                  c.options.History,
+		lfs:                      c.options.LFS,
+		sharedStore:              c.options.SharedStore,
+		stores:                   make(map[string]*source.Store),
+		cache:                    c.options.Cache,
+		verification:             c.options.Verification,
+		scheduler:                c.scheduler,
+		retry:                    c.retry,
+		sourceTimeout:            c.options.SourceTimeout,
+		keepFailed:               c.options.KeepFailed,
+		measureSize:              c.options.MeasureSize,
+		progress:                 c.options.Progress,
+		metrics:                  c.options.Metrics,
+		events:                   c.options.Events,
+		sourceHook:               c.options.SourceHook,
+		dependenciesHook:         c.options.DependenciesHook,
+		hookTimeout:              c.options.HookTimeout,
+		results:                  results,
+		summary:                  runSummary{statuses: make(map[model.Status]int)},
+	}
+}
+
+// pendingSource is a source read from the input whose revision is being resolved.
+type pendingSource struct {
+	src      *model.Source
+	index    int
+	err      error
+	resolved chan struct{}
+}
+
+// pendingSources are the sources read from the input and not handled yet.
+type pendingSources struct {
+	mutex   sync.Mutex
+	sources map[*pendingSource]struct{}
+	closed  bool
+}
+
+// add adds the source, unless the set is closed.
+func (q *pendingSources) add(p *pendingSource) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed {
+		return false
+	}
+	if q.sources == nil {
+		q.sources = make(map[*pendingSource]struct{})
+	}
+	q.sources[p] = struct{}{}
+	return true
+}
+
+func (q *pendingSources) remove(p *pendingSource) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	delete(q.sources, p)
+}
+
+// close returns the sources left in the input order. No sources are added afterwards.
+func (q *pendingSources) close() []*pendingSource {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.closed = true
+	left := make([]*pendingSource, 0, len(q.sources))
+	for p := range q.sources {
+		left = append(left, p)
+	}
+	sort.Slice(left, func(i, j int) bool { return left[i].index < left[j].index })
+	return left
+}
+
+// GetSources downloads the sources until the input ends or the context is done. When the context is done, the sources
+// being downloaded are stopped and the run ends with the summary of the sources finished so far.
+func (s *service) GetSources(parent context.Context) error {
+	var mutex sync.Mutex
+	eg, ctx := errgroup.WithContext(parent)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Revisions are resolved concurrently, but the sources are handled in the input order,
+	// so that the first occurrence of a duplicated source is always the one downloaded.
+	pending := make(chan *pendingSource, resolveWindow)
+	read := make(chan error, 1)
+	go func() {
+		err := s.readSources(ctx, pending)
+		read <- err
+		close(pending)
+	}()
+
+	var err error
+	duplicates := 0
+	seen := newSeenSet("commits", s.dedupWindow)
+	seenDirs := newSeenSet("directories", s.dedupWindow)
+	for p := range s.resolved(ctx, pending) {
+		s.unhandled.remove(p)
+		src := p.src
+		if p.err != nil {
+			resolveErr := errors.Wrapf(p.err, "error while resolving: %s", fmt.Sprintf("%s@%s", model.Redact(src.Origin), src.Revision))
+			src.Error = model.Redact(resolveErr.Error())
+			src.ErrorCategory = model.ErrorResolve
+			s.finish(src, p.index, model.StatusFailed, resolveErr)
+			if s.strict {
+				err = resolveErr
+				cancel()
+				continue
+			}
+			log.Errorf("Error occured: %v", resolveErr)
+			continue
+		}
+		if first, ok := seen.add(src.Key()+" "+src.Options.Destination, p.index); !ok {
+			log.Warnf("Skipping source #%d %s@%s (%s), it is a duplicate of source #%d", p.index, model.Redact(src.Origin), src.Revision, src.Hash, first)
+			duplicates++
+			s.finish(src, p.index, model.StatusDuplicate, nil)
+			continue
+		}
+		// Different origins may still share the directory, e.g. the local mirrors in different parent directories.
+		// The commit is the same then, so is the content.
+		if first, ok := seenDirs.add(s.directory(src), p.index); !ok {
+			log.Warnf("Skipping source #%d %s@%s (%s), it is downloaded into the same directory as source #%d", p.index, model.Redact(src.Origin), src.Revision, src.Hash, first)
+			duplicates++
+			s.finish(src, p.index, model.StatusDuplicate, nil)
+			continue
+		}
+
+		// The reading of the input waits for room in the queue, so that the sources are not read too far ahead.
+		release, qerr := s.scheduler.queue(ctx, src.Host)
+		if qerr != nil {
+			// The run is stopped, the source is not started.
+			s.finish(src, p.index, model.StatusInterrupted, nil)
+			continue
+		}
+		index := p.index
+		s.emit(src, index, Event{Type: EventQueued})
+		eg.Go(func() error {
+			defer release()
+			return s.getSource(ctx, src, index, &mutex)
+		})
+	}
+
+	werr := eg.Wait()
+	// The sources read but not handled when the run was stopped are recorded as interrupted, once their resolution
+	// is stopped too.
+	for _, p := range s.unhandled.close() {
+		<-p.resolved
+		s.finish(p.src, p.index, model.StatusInterrupted, nil)
+	}
+	// The input may be blocked on a read when the run is stopped, its error is not waited for then.
+	var readErr error
+	select {
+	case readErr = <-read:
+	default:
+	}
+	if s.cache != nil {
+		if err := s.cache.Evict(); err != nil {
+			log.Errorf("Error occured while evicting the cache: %v", err)
+		}
+	}
+	// The staging directory is left only if it is used by another run or keeps a failed source.
+	os.Remove(filepath.Join(s.rootDir, stagingDir))
+	s.logSummary()
+	if werr != nil {
+		return werr
+	}
+	if parent.Err() != nil {
+		return errors.Wrap(parent.Err(), "the download was interrupted")
+	}
+	if duplicates > 0 {
+		log.Infof("Skipped %d duplicate sources", duplicates)
+	}
+	if err != nil {
+		return err
+	}
+	return readErr
+}
+
+// resolved returns the sources in the input order, as their revisions are resolved, until the context is done.
+func (s *service) resolved(ctx context.Context, pending <-chan *pendingSource) <-chan *pendingSource {
+	out := make(chan *pendingSource)
+	go func() {
+		defer close(out)
+		for p := range pending {
+			select {
+			case <-p.resolved:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case out <- p:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// readSources reads the sources from the input and starts resolving their revisions. At most resolveWindow
+// sources are read ahead of the ones being handled.
+func (s *service) readSources(ctx context.Context, pending chan<- *pendingSource) error {
+	for index := 1; ; index++ {
+		src, err := s.sources.Next()
+		if err == io.EOF {
+			s.progress.readAll()
+			return nil
+		}
+		if entryErr, ok := err.(*manifest.EntryError); ok && !s.strict {
+			log.Errorf("Skipping invalid entry: %s", model.Redact(err.Error()))
+			s.progress.add()
+			s.finish(&model.Source{
+				Origin:        entryErr.Origin,
+				Revision:      entryErr.Revision,
+				Error:         model.Redact(entryErr.Error()),
+				ErrorCategory: model.ErrorManifest,
+			}, index, model.StatusInvalid, entryErr)
+			continue
+		}
+		if err != nil {
+			return errors.Wrap(err, "error while reading sources")
+		}
+		s.applyDefaults(src)
+
+		p := &pendingSource{src: src, index: index, resolved: make(chan struct{})}
+		if !s.unhandled.add(p) {
+			return nil
+		}
+		s.progress.add()
+		select {
+		case pending <- p:
+		case <-ctx.Done():
+			close(p.resolved)
+			return nil
+		}
+		go func() {
+			p.err = s.resolve(ctx, p.src)
+			if p.err == nil && s.usesStore(p.src) {
+				// The commits of the sources read ahead are fetched along with the first source of the origin.
+				s.store(p.src).Want(p.src.Hash, p.src.FetchHistory())
+			}
+			close(p.resolved)
+		}()
+	}
+}
+
+func (s *service) getSource(ctx context.Context, src *model.Source, index int, mutex *sync.Mutex) error {
+	wd := s.directory(src)
+
+	release, err := s.scheduler.source(ctx, src.Host)
+	if err != nil {
+		// The run is stopped, the source is not started.
+		s.finish(src, index, model.StatusInterrupted, nil)
+		return nil
+	}
+	start := time.Now()
+	s.progress.start()
+	defer s.progress.stop()
+	s.metrics.start()
+	defer s.metrics.stop()
+	var receivers progressReceivers
+	if s.progress != nil {
+		receivers = append(receivers, s.progress)
+	}
+	if s.metrics != nil {
+		receivers = append(receivers, s.metrics)
+	}
+	if len(receivers) > 0 {
+		ctx = source.WithProgress(ctx, receivers)
+	}
+	staged, status, err := s.downloadSource(ctx, src, index, wd, mutex)
+	release()
+
+	if err == nil && staged != "" {
+		err = s.runHook(ctx, src, index, HookSource, staged, status)
+	}
+	if s.shouldDownloadDependencies(src) {
+		src.Dependencies = model.StatusSkipped
+		if err == nil && staged != "" {
+			src.Dependencies = model.StatusDownloaded
+			if err = s.downloadDependencies(ctx, src, index, staged); err != nil {
+				src.Dependencies = model.StatusFailed
+			} else {
+				err = s.runHook(ctx, src, index, HookDependencies, staged, status)
+			}
+		}
+	}
+	if err == nil && staged != "" {
+		if err = s.publish(src, staged, wd); err != nil {
+			err = &stepError{model.ErrorFilesystem, err}
+		}
+	}
+	if err == nil && s.measureSize {
+		if src.Size, err = diskUsage(wd); err != nil {
+			log.Warnf("Cannot measure the size of %s: %v", wd, err)
+			err = nil
+		}
+	}
+	if err != nil && ctx.Err() != nil {
+		log.Warnf("Stopped downloading %s-%s: %v", model.Redact(src.Origin), src.Hash, err)
+		s.discard(src, staged, wd, status, false)
+		src.Duration = time.Since(start)
+		s.finish(src, index, model.StatusInterrupted, nil)
+		return nil
+	}
+	if err != nil {
+		s.discard(src, staged, wd, status, true)
+		src.Duration = time.Since(start)
+		return s.fail(src, index, err)
+	}
+	src.Duration = time.Since(start)
+	s.finish(src, index, status, nil)
+	return nil
+}
+
+// downloadDependencies downloads the dependencies of the source in the directory.
+func (s *service) downloadDependencies(ctx context.Context, src *model.Source, index int, wd string) error {
+	release, err := s.scheduler.dependency(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	ctx, cancel := s.withSourceTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	s.emit(src, index, Event{Type: EventDependenciesStarted})
+	err = s.createDependencyDownloader(wd).Get(ctx)
+	s.metrics.dependenciesDownloaded(time.Since(start))
+	if err != nil {
+		category := model.ErrorDependencies
+		if ctx.Err() == context.DeadlineExceeded {
+			category = model.ErrorTimeout
+		}
+		err = &stepError{category, errors.Wrap(err, "failed to download the dependencies")}
+	}
+	s.emit(src, index, Event{Type: EventDependenciesFinished, Duration: time.Since(start), Err: err})
+	return err
+}
+
+// withSourceTimeout returns the context of the download of a single source, done after the source timeout.
+func (s *service) withSourceTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.sourceTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, s.sourceTimeout)
+}
+
+// downloadSource downloads the source into a staging directory and verifies it, unless the source directory is already
+// checked out at the commit. It returns the staging directory, empty if the source is skipped. The status is returned
+// on failures too, StatusUpdated if the staging directory holds the existing directory of the source.
+func (s *service) downloadSource(ctx context.Context, src *model.Source, index int, wd string, mutex *sync.Mutex) (staged string, status model.Status, err error) {
+	ctx, cancel := s.withSourceTimeout(ctx)
+	defer cancel()
+	defer func() {
+		if err != nil && ctx.Err() == context.DeadlineExceeded {
+			err = &stepError{model.ErrorTimeout, err}
+		}
+	}()
+
+	state, err := s.createSourceInspector(src, wd).Inspect(ctx, src)
+	if err != nil {
+		return "", model.StatusFailed, &stepError{model.ErrorFilesystem, errors.Wrapf(err, "cannot inspect %s", wd)}
+	}
+	if state == source.StateCurrent {
+		log.Infof("Skipping %s-%s, %s is already checked out at the commit", model.Redact(src.Origin), src.Hash, wd)
+		return "", model.StatusSkipped, nil
+	}
+
+	// We need to sync the preparation of directory tree, because the directory tree is nested
+	// and two goroutines may try to create the same parent dir.
+	mutex.Lock()
+	staged, err = s.stage(wd)
+	mutex.Unlock()
+	if err != nil {
+		return "", model.StatusFailed, &stepError{model.ErrorFilesystem, err}
+	}
+
+	status = model.StatusDownloaded
+	switch state {
+	case source.StatePartial:
+		log.Warnf("Repairing %s, its download was not finished", wd)
+		if err := os.RemoveAll(wd); err != nil {
+			return staged, model.StatusFailed, &stepError{model.ErrorFilesystem, errors.Wrapf(err, "cannot remove %s", wd)}
+		}
+		status = model.StatusRepaired
+	case source.StateOutdated:
+		// The source is updated in the staging directory, so that it is not seen half-updated.
+		log.Infof("Updating %s to %s-%s", wd, model.Redact(src.Origin), src.Hash)
+		status = model.StatusUpdated
+		if err := s.move(src, wd, staged); err != nil {
+			return staged, status, &stepError{model.ErrorFilesystem, errors.Wrapf(err, "cannot move %s to the staging directory", wd)}
+		}
+	}
+	if state != source.StateOutdated {
+		if err := prepareDirectoryTree(staged); err != nil {
+			return staged, model.StatusFailed, &stepError{model.ErrorFilesystem, err}
+		}
+	}
+
+	err = s.get(ctx, src, index, staged, state == source.StateOutdated)
+	if err != nil && ctx.Err() == nil && state == source.StateOutdated {
+		log.Warnf("Cannot update %s in place, downloading %s-%s again: %v", wd, model.Redact(src.Origin), src.Hash, err)
+		src.Submodules, src.UnresolvedLFSPointers = nil, nil
+		if err = clearDirectory(staged); err == nil {
+			err = s.get(ctx, src, index, staged, false)
+		}
+	}
+	if err != nil {
+		category := model.ErrorDownload
+		if source.IsTransient(err) {
+			category = model.ErrorNetwork
+		}
+		return staged, status, &stepError{category, errors.Wrapf(err, "error while parsing: %s", fmt.Sprintf("%s@%s", model.Redact(src.Origin), src.Hash))}
+	}
+	if s.verification != VerifyNone {
+		log.Infof("Verifying %s-%s", model.Redact(src.Origin), src.Hash)
+		start := time.Now()
+		err := s.createSourceInspector(src, staged).Verify(ctx, src, s.verification == VerifyObjects)
+		s.emit(src, index, Event{Type: EventVerified, Duration: time.Since(start), Err: err})
+		if err != nil {
+			return staged, status, &stepError{model.ErrorVerification, errors.Wrapf(err, "verification failed: %s", fmt.Sprintf("%s@%s in %s", model.Redact(src.Origin), src.Hash, staged))}
+		}
+	}
+	for _, sub := range src.Submodules {
+		log.Infof("Checked out submodule %s of %s-%s: %s@%s", sub.Path, model.Redact(src.Origin), src.Hash, model.Redact(sub.Origin), sub.Hash)
+	}
+	for _, pointer := range src.UnresolvedLFSPointers {
+		log.Warnf("Unresolved LFS pointer %s of %s-%s (sha256:%s, %d bytes): %s", pointer.Path, model.Redact(src.Origin), src.Hash, pointer.OID, pointer.Size, pointer.Reason)
+	}
+	return staged, status, nil
+}
+
+// acquireMirror makes sure the commit of the source is in its mirror in the cache, if any, and returns the context
+// of a download from the mirror. The mirror is acquired for every attempt, as the download releases it once its
+// commits are fetched; the returned function releases it otherwise. The source is downloaded from the origin if
+// the cache cannot be used.
+func (s *service) acquireMirror(ctx context.Context, src *model.Source) (context.Context, func()) {
+	src.Mirror = ""
+	if s.cache == nil {
+		return ctx, func() {}
+	}
+	release, err := s.cache.Acquire(ctx, src, s.mirrorFetchFuncFor(src))
+	if err != nil {
+		log.Warnf("Cannot use the cache for %s-%s, downloading from the origin: %v", model.Redact(src.Origin), src.Hash, err)
+		return ctx, func() {}
+	}
+	return source.WithMirrorRelease(ctx, release), release
+}
+
+// get downloads the source, retrying the transient failures with a backoff. Every attempt is recorded in the source.
+// The directory is cleared before a retry, unless the source is updated in place.
+func (s *service) get(ctx context.Context, src *model.Source, index int, wd string, inPlace bool) error {
+	for attempt := 1; ; attempt++ {
+		mirrorCtx, release := s.acquireMirror(ctx, src)
+		start := time.Now()
+		s.emit(src, index, Event{Type: EventFetchStarted, Attempt: attempt})
+		err := s.createSourceDownloader(src, wd).Get(mirrorCtx, src)
+		release()
+		s.metrics.fetched(time.Since(start))
+		s.emit(src, index, Event{Type: EventFetchFinished, Attempt: attempt, Duration: time.Since(start), Err: err})
+		if err == nil {
+			src.Attempts = append(src.Attempts, model.Attempt{Start: start, Duration: time.Since(start)})
+			return nil
+		}
+		transient := source.IsTransient(err)
+		src.Attempts = append(src.Attempts, model.Attempt{Start: start, Duration: time.Since(start), Error: model.Redact(err.Error()), Transient: transient})
+		if !transient || attempt >= s.retry.attempts || ctx.Err() != nil {
+			return err
+		}
+		delay := s.retry.backoff(attempt)
+		log.Warnf("Attempt %d of %d to download %s-%s failed, retrying in %s: %v", attempt, s.retry.attempts, model.Redact(src.Origin), src.Hash, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		s.metrics.retried()
+		s.emit(src, index, Event{Type: EventRetried, Attempt: attempt, Delay: delay, Err: err})
+		src.Submodules, src.UnresolvedLFSPointers = nil, nil
+		if !inPlace {
+			if err := clearDirectory(wd); err != nil {
+				return errors.Wrapf(err, "cannot clear %s", wd)
+			}
+		}
+	}
+}
+
+// stepError is the failure of a step of the download of a source.
+type stepError struct {
+	category model.ErrorCategory
+	err      error
+}
+
+func (e *stepError) Error() string {
+	return e.err.Error()
+}
+
+func (e *stepError) Cause() error {
+	return e.err
+}
+
+// finish records the outcome of the source, the error if it failed.
+func (s *service) finish(src *model.Source, index int, status model.Status, err error) {
+	src.Status = status
+	s.progress.finish(status)
+	s.metrics.finish(status)
+	event := EventFinished
+	if status == model.StatusFailed {
+		event = EventFailed
+	}
+	s.emit(src, index, Event{Type: event, Duration: src.Duration, Status: status, Err: err})
+	s.summaryMutex.Lock()
+	s.summary.statuses[status]++
+	if len(src.Attempts) > 1 {
+		s.summary.retried++
+	}
+	if status == model.StatusFailed {
+		s.summary.failed = append(s.summary.failed, src)
+	}
+	s.summaryMutex.Unlock()
+	if s.results != nil {
+		s.results.HandleResult(Result{Source: src, Index: index, Directory: s.directory(src), Status: status, Err: err})
+	}
+}
+
+// fail records the source as failed. The error is returned in the strict mode and logged otherwise.
+func (s *service) fail(src *model.Source, index int, err error) error {
+	src.Error = model.Redact(err.Error())
+	src.ErrorCategory = model.ErrorDownload
+	if e, ok := err.(*stepError); ok {
+		src.ErrorCategory = e.category
+	}
+	s.finish(src, index, model.StatusFailed, err)
+	if s.strict {
+		return err
+	}
+	log.Errorf("Error occured: %v", err)
+	return nil
+}
+
+// logSummary logs the number of the sources by their status.
+func (s *service) logSummary() {
+	s.summaryMutex.Lock()
+	defer s.summaryMutex.Unlock()
+	counts := s.summary.statuses
+	log.Infof("Sources: %d downloaded, %d updated, %d repaired, %d skipped, %d duplicate, %d invalid, %d failed",
+		counts[model.StatusDownloaded], counts[model.StatusUpdated], counts[model.StatusRepaired], counts[model.StatusSkipped],
+		counts[model.StatusDuplicate], counts[model.StatusInvalid], counts[model.StatusFailed])
+	if counts[model.StatusInterrupted] > 0 {
+		log.Warnf("Interrupted sources, not finished: %d", counts[model.StatusInterrupted])
+	}
+	if s.summary.retried > 0 {
+		log.Infof("Retried sources: %d", s.summary.retried)
+	}
+	for _, src := range s.summary.failed {
+		if len(src.Attempts) > 1 {
+			log.Errorf("Failed: %s@%s after %d attempts: %s", model.Redact(src.Origin), src.Revision, len(src.Attempts), src.Error)
+		} else {
+			log.Errorf("Failed: %s@%s: %s", model.Redact(src.Origin), src.Revision, src.Error)
+		}
+	}
+}
+
+func (s *service) resolve(ctx context.Context, src *model.Source) error {
+	if src.Resolved() {
+		return nil
+	}
+	hash, err := s.createRevisionResolver(src).Resolve(ctx, src)
+	if err != nil {
+		return err
+	}
+	src.Hash = hash
+	return nil
+}
+
+// applyDefaults sets the options that are not set for the source to the global settings.
+func (s *service) applyDefaults(src *model.Source) {
+	if src.Options.Submodules == nil {
+		submodules := s.submodules
+		src.Options.Submodules = &submodules
+	}
+	if src.Options.History == nil {
+		history := s.history
+		src.Options.History = &history
+	}
+	if src.Options.LFS == nil {
+		lfs := s.lfs
+		src.Options.LFS = &lfs
+	} else if lfs := src.Options.LFS; len(lfs.Include) == 0 && len(lfs.Exclude) == 0 && lfs.MaxSize == 0 {
+		src.Options.LFS = &model.LFSOptions{Enabled: lfs.Enabled, Include: s.lfs.Include, Exclude: s.lfs.Exclude, MaxSize: s.lfs.MaxSize}
+	}
+}
+
+// usesStore returns true if the source is checked out from the store shared by the sources of its origin.
+// Sparse checkouts are always independent.
+func (s *service) usesStore(src *model.Source) bool {
+	return s.sharedStore && len(src.Options.SparsePaths) == 0
+}
+
+// store returns the store shared by the sources of the origin of the source.
+func (s *service) store(src *model.Source) *source.Store {
+	key := src.Origin
+	if o, err := model.ParseOrigin(src.Origin); err == nil {
+		key = o.Canonical()
+	}
+	s.storesMutex.Lock()
+	defer s.storesMutex.Unlock()
+	store, ok := s.stores[key]
+	if !ok {
+		store = source.NewStore(filepath.Join(s.rootDir, storeDir, filepath.FromSlash(key)+".git"), src.Origin)
+		s.stores[key] = store
+	}
+	return store
+}
+
+func (s *service) directory(src *model.Source) string {
+	if src.Status == model.StatusInvalid {
+		// An invalid entry has no directory.
+		return ""
+	}
+	if src.Options.Destination == "" {
+		return filepath.Join(s.rootDir, src.Directory())
+	}
+	if filepath.IsAbs(src.Options.Destination) {
+		return src.Options.Destination
+	}
+	return filepath.Join(s.rootDir, src.Options.Destination)
+}
+
+func (s *service) shouldDownloadDependencies(src *model.Source) bool {
+	if src.Options.WithDependencies != nil {
+		return *src.Options.WithDependencies
+	}
+	return s.withDependencies
+}
+
+func (s *service) sourceDownloaderTypeFor(src *model.Source) SourceDownloaderType {
+	if src.Options.Downloader != "" {
+		return SourceDownloaderTypeOf(src.Options.Downloader)
+	}
+	return s.sourceDownloaderType
+}
+
+func (s *service) createSourceInspector(src *model.Source, wd string) sourceInspector {
+	switch s.sourceDownloaderTypeFor(src) {
+	case GitDirect:
+		return source.NewGitInspector(wd)
+	default:
+		return source.NewSystemGitInspector(wd)
+	}
+}
+
+func (s *service) createRevisionResolver(src *model.Source) revisionResolver {
+	switch s.sourceDownloaderTypeFor(src) {
+	case GitDirect:
+		return source.NewGitResolver()
+	default:
+		return source.NewSystemGitResolver()
+	}
+}
+
+func (s *service) mirrorFetchFuncFor(src *model.Source) source.MirrorFetchFunc {
+	switch s.sourceDownloaderTypeFor(src) {
+	case GitDirect:
+		return source.FetchGitMirror
+	default:
+		return source.FetchSystemGitMirror
+	}
+}
+
+func (s *service) createSourceDownloader(src *model.Source, wd string) sourceDownloader {
+	if s.usesStore(src) {
+		switch s.sourceDownloaderTypeFor(src) {
+		case GitDirect:
+			return source.NewGitAlternatesDownloader(wd, s.store(src))
+		default:
+			return source.NewSystemGitWorktreeDownloader(wd, s.store(src))
+		}
+	}
+	switch s.sourceDownloaderTypeFor(src) {
+	case GitDirect:
+		return source.NewGitDownloader(wd)
+	case GitSystem:
+		return source.NewSystemGitDownloader(wd)
+	default:
+		return source.NewSystemGitDownloader(wd)
+	}
+}
+
+func (s *service) createDependencyDownloader(wd string) dependencyDownloader {
+	switch s.dependencyDownloaderType {
+	case MavenSystem:
+		return dependency.NewSystemMavenDownloader(wd)
+	default:
+		return dependency.NewSystemMavenDownloader(wd)
+	}
+}
+
+func prepareDirectoryTree(path string) error {
+	log.Infof("Creating directory: %s", path)
+	return os.MkdirAll(path, 0777)
+}
+
+// clearDirectory removes the contents of the directory left by an earlier run.
+func clearDirectory(path string) error {
+	log.Infof("Clearing directory: %s", path)
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+	return os.MkdirAll(path, 0777)
+}
@@ -0,0 +1,262 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arekziobrowski/sourcerer/model"
+	"github.com/arekziobrowski/sourcerer/source"
+	"github.com/pkg/errors"
+)
+
+func TestCreateSourceDownloader(t *testing.T) {
+	tests := []struct {
+		name        string
+		typ         SourceDownloaderType
+		sharedStore bool
+		downloader  string
+		sparsePaths []string
+		want        sourceDownloader
+		wantInspect sourceInspector
+		wantResolve revisionResolver
+	}{
+		{
+			name:        "git-system",
+			typ:         GitSystem,
+			want:        &source.SystemGitDownloader{},
+			wantInspect: &source.SystemGitInspector{},
+			wantResolve: &source.SystemGitResolver{},
+		},
+		{
+			name:        "git",
+			typ:         GitDirect,
+			want:        &source.GitDownloader{},
+			wantInspect: &source.GitInspector{},
+			wantResolve: &source.GitResolver{},
+		},
+		{
+			name:        "source option",
+			typ:         GitSystem,
+			downloader:  model.DownloaderGit,
+			want:        &source.GitDownloader{},
+			wantInspect: &source.GitInspector{},
+			wantResolve: &source.GitResolver{},
+		},
+		{
+			name:        "shared store",
+			typ:         GitSystem,
+			sharedStore: true,
+			want:        &source.SystemGitWorktreeDownloader{},
+			wantInspect: &source.SystemGitInspector{},
+			wantResolve: &source.SystemGitResolver{},
+		},
+		{
+			name:        "shared store git",
+			typ:         GitDirect,
+			sharedStore: true,
+			want:        &source.GitAlternatesDownloader{},
+			wantInspect: &source.GitInspector{},
+			wantResolve: &source.GitResolver{},
+		},
+		{
+			name:        "sparse shared store",
+			typ:         GitSystem,
+			sharedStore: true,
+			sparsePaths: []string{"/docs/"},
+			want:        &source.SystemGitDownloader{},
+			wantInspect: &source.SystemGitInspector{},
+			wantResolve: &source.SystemGitResolver{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &service{
+				rootDir:              t.TempDir(),
+				sourceDownloaderType: tt.typ,
+				sharedStore:          tt.sharedStore,
+				stores:               make(map[string]*source.Store),
+			}
+			src := &model.Source{Origin: "https://github.com/org/repo", Options: model.Options{Downloader: tt.downloader, SparsePaths: tt.sparsePaths}}
+			if got, want := fmt.Sprintf("%T", s.createSourceDownloader(src, s.rootDir)), fmt.Sprintf("%T", tt.want); got != want {
+				t.Errorf("createSourceDownloader = %s, want %s", got, want)
+			}
+			if got, want := fmt.Sprintf("%T", s.createSourceInspector(src, s.rootDir)), fmt.Sprintf("%T", tt.wantInspect); got != want {
+				t.Errorf("createSourceInspector = %s, want %s", got, want)
+			}
+			if got, want := fmt.Sprintf("%T", s.createRevisionResolver(src)), fmt.Sprintf("%T", tt.wantResolve); got != want {
+				t.Errorf("createRevisionResolver = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestNewDedupWindow(t *testing.T) {
+	tests := []struct {
+		window  int
+		want    int
+		wantErr bool
+	}{
+		{window: 0, want: defaultDedupWindow},
+		{window: 10, want: 10},
+		{window: -1, wantErr: true},
+	}
+	for _, tt := range tests {
+		c, err := New(Options{Dir: t.TempDir(), DedupWindow: tt.window})
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("New with the window %d succeeded", tt.window)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.options.DedupWindow != tt.want {
+			t.Errorf("window %d = %d, want %d", tt.window, c.options.DedupWindow, tt.want)
+		}
+	}
+}
+
+// newTestOrigin creates a repository with a single commit in the directory, skipping the test without git.
+// It returns the origin of the repository and the commit.
+func newTestOrigin(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	git := func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %s failed: %v\n%s", strings.Join(args, " "), err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	git("init", "-q", ".")
+	if err := ioutil.WriteFile(filepath.Join(dir, "README.md"), []byte("readme\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	git("add", "README.md")
+	git("-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "first")
+	return "file://" + filepath.ToSlash(dir), git("rev-parse", "HEAD")
+}
+
+// newHangingOrigin returns the origin of a Git server accepting the connections but never answering them.
+func newHangingOrigin(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		var conns []net.Conn
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				break
+			}
+			conns = append(conns, conn)
+		}
+		for _, conn := range conns {
+			conn.Close()
+		}
+		close(done)
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		<-done
+	})
+	return "git://" + l.Addr().String() + "/org/repo"
+}
+
+// newTimeoutTestSources returns a source of a new origin and a source of a hanging origin, at a commit so that
+// it is not resolved.
+func newTimeoutTestSources(t *testing.T, dir string) []model.Source {
+	t.Helper()
+	origin, hash := newTestOrigin(t, dir)
+	var srcs []model.Source
+	for _, o := range []string{origin, newHangingOrigin(t)} {
+		src, err := model.NewSource(o, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srcs = append(srcs, *src)
+	}
+	return srcs
+}
+
+func TestDownloadSourceTimeout(t *testing.T) {
+	root := t.TempDir()
+	srcs := newTimeoutTestSources(t, t.TempDir())
+	c, err := New(Options{Dir: root, SourceTimeout: 500 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	results, err := c.Download(context.Background(), srcs)
+	if err != nil {
+		t.Fatalf("the download failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("the download of the hanging source stopped after %s", elapsed)
+	}
+	if len(results) != 2 {
+		t.Fatalf("%d results, want 2", len(results))
+	}
+	if got := results[0].Status; got != model.StatusDownloaded {
+		t.Errorf("the source finished with %s, want %s", got, model.StatusDownloaded)
+	}
+	hanging := results[1]
+	if hanging.Status != model.StatusFailed || hanging.Source.ErrorCategory != model.ErrorTimeout || hanging.Err == nil {
+		t.Errorf("the hanging source finished with %s (%s): %v, want %s (%s)", hanging.Status, hanging.Source.ErrorCategory, hanging.Err, model.StatusFailed, model.ErrorTimeout)
+	}
+}
+
+func TestDownloadCancelled(t *testing.T) {
+	root := t.TempDir()
+	srcs := newTimeoutTestSources(t, t.TempDir())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// The run is stopped once the other source is finished and the hanging source is fetched.
+	finished := make(chan struct{})
+	events := EventHandlerFunc(func(e Event) {
+		switch {
+		case (e.Type == EventFinished || e.Type == EventFailed) && e.Index == 1:
+			close(finished)
+		case e.Type == EventFetchStarted && e.Index == 2:
+			go func() {
+				<-finished
+				cancel()
+			}()
+		}
+	})
+	c, err := New(Options{Dir: root, Events: events})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := c.Download(ctx, srcs)
+	if errors.Cause(err) != context.Canceled {
+		t.Errorf("the download returned %v, want %v", err, context.Canceled)
+	}
+	if len(results) != 2 {
+		t.Fatalf("%d results, want 2", len(results))
+	}
+	if got := results[0].Status; got != model.StatusDownloaded {
+		t.Errorf("the source finished with %s, want %s", got, model.StatusDownloaded)
+	}
+	if got := results[1].Status; got != model.StatusInterrupted {
+		t.Errorf("the hanging source finished with %s, want %s", got, model.StatusInterrupted)
+	}
+	if entries, _ := ioutil.ReadDir(filepath.Join(root, stagingDir)); len(entries) > 0 {
+		t.Errorf("the staging directory of the interrupted source is left")
+	}
+}
@@ -0,0 +1,166 @@
+package downloader
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/arekziobrowski/sourcerer/model"
+	"github.com/arekziobrowski/sourcerer/source"
+)
+
+// EventType is the step of the download of a source an event reports.
+type EventType string
+
+const (
+	// EventQueued is a source resolved to its commit and queued for the download.
+	EventQueued EventType = "queued"
+	// EventFetchStarted is the start of an attempt to download a source.
+	EventFetchStarted EventType = "fetch_started"
+	// EventFetchFinished is the end of an attempt to download a source, failed if the event has an error.
+	EventFetchFinished EventType = "fetch_finished"
+	// EventRetried is a failed attempt to download a source retried after the delay.
+	EventRetried EventType = "retried"
+	// EventVerified is the end of the verification of a source, failed if the event has an error.
+	EventVerified EventType = "verified"
+	// EventDependenciesStarted is the start of the download of the dependencies of a source.
+	EventDependenciesStarted EventType = "dependencies_started"
+	// EventDependenciesFinished is the end of the download of the dependencies of a source, failed if the event
+	// has an error.
+	EventDependenciesFinished EventType = "dependencies_finished"
+	// EventHookFinished is the end of a run of a hook on a source, failed if the event has an error.
+	EventHookFinished EventType = "hook_finished"
+	// EventFailed is a source that failed, the last event of the source.
+	EventFailed EventType = "failed"
+	// EventFinished is a source that did not fail, with its status, the last event of the source.
+	EventFinished EventType = "finished"
+)
+
+// Event is an event of the download of a source.
+type Event struct {
+	Type EventType
+	Time time.Time
+	// Index is the position of the source in the input, starting from 1.
+	Index int
+	// Directory is the directory of the source.
+	Directory string
+	// Source is the state of the source at the time of the event.
+	Source model.Source
+	// Attempt is the number of the attempt to download the source, starting from 1, for the fetch and retry events.
+	Attempt int
+	// Duration is the duration of the step that finished, or of the whole download of the source for the last event.
+	Duration time.Duration
+	// Delay is the backoff before the next attempt of a retried source.
+	Delay time.Duration
+	// Hook is the hook of the hook event, HookSource or HookDependencies.
+	Hook string
+	// Status is the status of the source for the last event.
+	Status model.Status
+	// Err is the failure of the step, nil if it succeeded.
+	Err error
+}
+
+// EventHandler receives the events of the downloads. The events of a single source are received in order,
+// but the events of different sources are received concurrently.
+type EventHandler interface {
+	HandleEvent(e Event)
+}
+
+// EventHandlerFunc is a function receiving the events.
+type EventHandlerFunc func(e Event)
+
+func (f EventHandlerFunc) HandleEvent(e Event) {
+	f(e)
+}
+
+// emit sends the event of the source to the event handler, if any.
+func (s *service) emit(src *model.Source, index int, e Event) {
+	if s.events == nil {
+		return
+	}
+	e.Time = time.Now()
+	e.Index = index
+	e.Directory = s.directory(src)
+	e.Source = *src
+	s.events.HandleEvent(e)
+}
+
+// JSONEventWriter writes the events as JSON lines.
+type JSONEventWriter struct {
+	mutex   sync.Mutex
+	encoder *json.Encoder
+	err     error
+}
+
+func NewJSONEventWriter(w io.Writer) *JSONEventWriter {
+	return &JSONEventWriter{encoder: json.NewEncoder(w)}
+}
+
+type jsonEvent struct {
+	Type          EventType           `json:"type"`
+	Time          time.Time           `json:"time"`
+	Index         int                 `json:"index"`
+	Origin        string              `json:"origin"`
+	Revision      string              `json:"revision"`
+	Commit        string              `json:"commit,omitempty"`
+	Host          string              `json:"host,omitempty"`
+	Namespace     string              `json:"namespace,omitempty"`
+	Repository    string              `json:"repository,omitempty"`
+	Mirror        string              `json:"mirror,omitempty"`
+	Directory     string              `json:"directory"`
+	Attempt       int                 `json:"attempt,omitempty"`
+	Duration      float64             `json:"duration_seconds,omitempty"`
+	Delay         float64             `json:"delay_seconds,omitempty"`
+	Hook          string              `json:"hook,omitempty"`
+	Status        model.Status        `json:"status,omitempty"`
+	Error         string              `json:"error,omitempty"`
+	ErrorCategory model.ErrorCategory `json:"error_category,omitempty"`
+	Transient     bool                `json:"transient,omitempty"`
+	Size          int64               `json:"size_bytes,omitempty"`
+	Dependencies  model.Status        `json:"dependencies,omitempty"`
+}
+
+// HandleEvent writes the event. The writing stops on the first error.
+func (w *JSONEventWriter) HandleEvent(e Event) {
+	src := e.Source
+	je := jsonEvent{
+		Type:       e.Type,
+		Time:       e.Time,
+		Index:      e.Index,
+		Origin:     model.Redact(src.Origin),
+		Revision:   src.Revision,
+		Commit:     src.Hash,
+		Host:       src.Host,
+		Namespace:  src.Namespace,
+		Repository: src.Repository,
+		Mirror:     src.Mirror,
+		Directory:  e.Directory,
+		Attempt:    e.Attempt,
+		Duration:   e.Duration.Seconds(),
+		Delay:      e.Delay.Seconds(),
+		Hook:       e.Hook,
+		Status:     e.Status,
+	}
+	if e.Err != nil {
+		je.Error = model.Redact(e.Err.Error())
+		je.Transient = source.IsTransient(e.Err)
+	}
+	if e.Type == EventFailed || e.Type == EventFinished {
+		je.ErrorCategory = src.ErrorCategory
+		je.Size = src.Size
+		je.Dependencies = src.Dependencies
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.err == nil {
+		w.err = w.encoder.Encode(&je)
+	}
+}
+
+// Err returns the error of writing the events, if any.
+func (w *JSONEventWriter) Err() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.err
+}
@@ -0,0 +1,108 @@
+package downloader
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/arekziobrowski/sourcerer/model"
+)
+
+func TestJSONEventWriter(t *testing.T) {
+	root := t.TempDir()
+	originDir := filepath.Join(root, "org", "repo")
+	if err := os.MkdirAll(originDir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	origin, hash := newTestOrigin(t, originDir)
+	missing := "file://" + filepath.ToSlash(filepath.Join(root, "org", "missing"))
+	var srcs []model.Source
+	for _, entry := range [][2]string{{origin, "HEAD"}, {missing, hash}, {missing, "HEAD"}, {origin, hash}} {
+		src, err := model.NewSource(entry[0], entry[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		srcs = append(srcs, *src)
+	}
+
+	var out bytes.Buffer
+	events := NewJSONEventWriter(&out)
+	c, err := New(Options{Dir: filepath.Join(root, "dst"), Events: events})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Download(context.Background(), srcs); err != nil {
+		t.Fatal(err)
+	}
+	if err := events.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The events of different sources are interleaved, those of a single source are in order.
+	got := make(map[int][]jsonEvent)
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		var e jsonEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("invalid event %s: %v", scanner.Text(), err)
+		}
+		if e.Time.IsZero() {
+			t.Errorf("event without a time: %s", scanner.Text())
+		}
+		got[e.Index] = append(got[e.Index], e)
+	}
+
+	tests := []struct {
+		index    int
+		types    []EventType
+		status   model.Status
+		category model.ErrorCategory
+	}{
+		{1, []EventType{EventQueued, EventFetchStarted, EventFetchFinished, EventFinished}, model.StatusDownloaded, ""},
+		{2, []EventType{EventQueued, EventFetchStarted, EventFetchFinished, EventFailed}, model.StatusFailed, model.ErrorDownload},
+		{3, []EventType{EventFailed}, model.StatusFailed, model.ErrorResolve},
+		{4, []EventType{EventFinished}, model.StatusDuplicate, ""},
+	}
+	for _, tt := range tests {
+		events := got[tt.index]
+		var types []EventType
+		for _, e := range events {
+			types = append(types, e.Type)
+		}
+		if !reflect.DeepEqual(types, tt.types) {
+			t.Errorf("events of source #%d = %v, want %v", tt.index, types, tt.types)
+			continue
+		}
+		last := events[len(events)-1]
+		if last.Status != tt.status || last.ErrorCategory != tt.category {
+			t.Errorf("source #%d finished with %s (%s), want %s (%s)", tt.index, last.Status, last.ErrorCategory, tt.status, tt.category)
+		}
+		if (tt.status == model.StatusFailed) != (last.Error != "") {
+			t.Errorf("source #%d finished with the error %q", tt.index, last.Error)
+		}
+		for _, e := range events {
+			if e.Origin != srcs[tt.index-1].Origin || e.Revision != srcs[tt.index-1].Revision {
+				t.Errorf("event %s of source #%d is of %s@%s", e.Type, tt.index, e.Origin, e.Revision)
+			}
+			if e.Type == EventFetchStarted || e.Type == EventFetchFinished {
+				if e.Attempt != 1 || e.Commit != hash {
+					t.Errorf("event %s of source #%d: attempt %d of %s", e.Type, tt.index, e.Attempt, e.Commit)
+				}
+			}
+		}
+	}
+	if fetched := got[1][2]; fetched.Error != "" || fetched.Duration <= 0 {
+		t.Errorf("the fetch of source #1 finished with the error %q after %fs", fetched.Error, fetched.Duration)
+	}
+	if fetched := got[2][2]; fetched.Error == "" {
+		t.Error("the fetch of source #2 finished without an error")
+	}
+	if finished := got[1][3]; finished.Directory == "" || finished.Commit != hash {
+		t.Errorf("source #1 finished in %q at %s", finished.Directory, finished.Commit)
+	}
+}
@@ -0,0 +1,143 @@
+package downloader
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/arekziobrowski/sourcerer/model"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// HookSource is the hook run after the source is downloaded and verified.
+	HookSource = "source"
+	// HookDependencies is the hook run after the dependencies of the source are downloaded.
+	HookDependencies = "dependencies"
+)
+
+// hookOutputLimit is the size of the end of the output of a hook kept in the source.
+const hookOutputLimit = 64 << 10
+
+// runHook runs the hook command of the step on the source downloaded into the staging directory, if there is one.
+// The failure of the hook is returned in the strict mode or when the run is stopped, and logged otherwise.
+func (s *service) runHook(ctx context.Context, src *model.Source, index int, hook, staged string, status model.Status) error {
+	command := s.sourceHook
+	if hook == HookDependencies {
+		command = s.dependenciesHook
+	}
+	if command == "" {
+		return nil
+	}
+	log.Infof("Running the %s hook on %s-%s", hook, model.Redact(src.Origin), src.Hash)
+	start := time.Now()
+	output, err := s.execHook(ctx, command, staged, hookEnv(src, hook, staged, s.directory(src), status))
+	run := model.HookRun{Hook: hook, Start: start, Duration: time.Since(start), Output: model.Redact(output)}
+	if err != nil {
+		err = errors.Wrapf(err, "the %s hook failed on %s", hook, model.Redact(src.Origin)+"@"+src.Hash)
+		run.Error = model.Redact(err.Error())
+	}
+	src.Hooks = append(src.Hooks, run)
+	s.emit(src, index, Event{Type: EventHookFinished, Hook: hook, Duration: run.Duration, Err: err})
+	if err == nil {
+		log.Debugf("Output of the %s hook on %s-%s:\n%s", hook, model.Redact(src.Origin), src.Hash, output)
+		return nil
+	}
+	if s.strict || ctx.Err() != nil {
+		return &stepError{model.ErrorHook, err}
+	}
+	log.Warnf("The %s hook failed on %s-%s: %v, output:\n%s", hook, model.Redact(src.Origin), src.Hash, errors.Cause(err), output)
+	return nil
+}
+
+// execHook runs the command with the shell in the directory and returns its combined output. When the hook times out
+// or the run is stopped, the hook is killed along with the processes it started. The output goes through a temporary
+// file, so that the processes left by the command cannot hold the hook.
+func (s *service) execHook(ctx context.Context, command, dir string, env []string) (string, error) {
+	if s.hookTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.hookTimeout)
+		defer cancel()
+	}
+	out, err := ioutil.TempFile("", "sourcerer-hook-")
+	if err != nil {
+		return "", errors.Wrap(err, "cannot create the output file of the hook")
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	cmd := hookCommand(command)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if err := cmd.Start(); err != nil {
+		return "", errors.Wrap(err, "cannot start the hook")
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		if kerr := killHook(cmd); kerr != nil {
+			log.Warnf("Cannot kill the hook %q: %v", command, kerr)
+		}
+		err = <-done
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		err = errors.Errorf("timed out after %s", s.hookTimeout)
+	}
+	output, rerr := tail(out, hookOutputLimit)
+	if err == nil && rerr != nil {
+		err = errors.Wrap(rerr, "cannot read the output of the hook")
+	}
+	return output, err
+}
+
+// hookEnv returns the environment variables describing the source to the hook.
+func hookEnv(src *model.Source, hook, staged, wd string, status model.Status) []string {
+	return []string{
+		"SOURCERER_HOOK=" + hook,
+		"SOURCERER_DIR=" + staged,
+		"SOURCERER_DESTINATION=" + wd,
+		"SOURCERER_ORIGIN=" + src.Origin,
+		"SOURCERER_REVISION=" + src.Revision,
+		"SOURCERER_COMMIT=" + src.Hash,
+		"SOURCERER_HOST=" + src.Host,
+		"SOURCERER_NAMESPACE=" + src.Namespace,
+		"SOURCERER_ORGANIZATION=" + src.Organization,
+		"SOURCERER_REPOSITORY=" + src.Repository,
+		"SOURCERER_STATUS=" + string(status),
+		"SOURCERER_DEPENDENCIES=" + string(src.Dependencies),
+	}
+}
+
+// tail returns at most the last limit bytes of the file.
+func tail(f *os.File, limit int64) (string, error) {
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return "", err
+	}
+	offset := size - limit
+	if offset < 0 {
+		offset = 0
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return "", err
+	}
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return "", err
+	}
+	output := string(b)
+	if offset > 0 {
+		output = "..." + output
+	}
+	return strings.TrimRight(output, "\n"), nil
+}
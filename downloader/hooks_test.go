@@ -0,0 +1,93 @@
+//go:build !windows
+// +build !windows
+
+package downloader
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arekziobrowski/sourcerer/model"
+)
+
+func TestHookEnv(t *testing.T) {
+	src := &model.Source{Origin: "https://github.com/org/repo", Revision: "main", Hash: "edb545b434a8cfd46b8651d7041aa87e85503004",
+		Host: "github.com", Namespace: "org", Organization: "org", Repository: "repo", Dependencies: model.StatusDownloaded}
+	env := hookEnv(src, HookSource, "/staged", "/dst", model.StatusUpdated)
+	want := map[string]string{
+		"SOURCERER_HOOK":         HookSource,
+		"SOURCERER_DIR":          "/staged",
+		"SOURCERER_DESTINATION":  "/dst",
+		"SOURCERER_ORIGIN":       src.Origin,
+		"SOURCERER_REVISION":     "main",
+		"SOURCERER_COMMIT":       src.Hash,
+		"SOURCERER_HOST":         "github.com",
+		"SOURCERER_NAMESPACE":    "org",
+		"SOURCERER_ORGANIZATION": "org",
+		"SOURCERER_REPOSITORY":   "repo",
+		"SOURCERER_STATUS":       "updated",
+		"SOURCERER_DEPENDENCIES": "downloaded",
+	}
+	if len(env) != len(want) {
+		t.Errorf("hookEnv = %v, want %d variables", env, len(want))
+	}
+	for _, e := range env {
+		name := e[:strings.IndexByte(e, '=')]
+		if value, ok := want[name]; !ok || e != name+"="+value {
+			t.Errorf("unexpected variable %s, want %s=%s", e, name, value)
+		}
+	}
+}
+
+func TestExecHook(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		timeout time.Duration
+		want    string
+		wantErr string
+	}{
+		{name: "output", command: `echo "$SOURCERER_HOOK in $(basename "$PWD")"; echo error >&2`, want: "source in dir\nerror"},
+		{name: "failure", command: "echo failing; exit 3", want: "failing", wantErr: "exit status 3"},
+		{name: "timeout", command: "echo started; sleep 10", timeout: 100 * time.Millisecond, want: "started", wantErr: "timed out after 100ms"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "dir")
+			if err := os.Mkdir(dir, 0777); err != nil {
+				t.Fatal(err)
+			}
+			s := &service{hookTimeout: tt.timeout}
+			output, err := s.execHook(context.Background(), tt.command, dir, []string{"SOURCERER_HOOK=" + HookSource})
+			if output != tt.want {
+				t.Errorf("output = %q, want %q", output, tt.want)
+			}
+			if (err == nil) != (tt.wantErr == "") || err != nil && !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("execHook = %v, want the error %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestExecHookKillsProcessGroup(t *testing.T) {
+	dir := t.TempDir()
+	marker := filepath.Join(dir, "marker")
+	// The hook leaves a process behind, which would write the marker after the timeout unless killed with the hook.
+	s := &service{hookTimeout: 200 * time.Millisecond}
+	start := time.Now()
+	_, err := s.execHook(context.Background(), "(sleep 1; touch marker) & sleep 10", dir, nil)
+	if err == nil {
+		t.Fatal("the hook did not time out")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("the hook returned after %s", d)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if _, err := os.Stat(marker); err == nil {
+		t.Error("the process started by the hook was not killed")
+	}
+}
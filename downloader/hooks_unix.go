@@ -0,0 +1,22 @@
+//go:build !windows
+// +build !windows
+
+package downloader
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// hookCommand returns the command running the hook with sh, in its own process group, so that the processes started
+// by the hook can be killed along with it.
+func hookCommand(command string) *exec.Cmd {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return cmd
+}
+
+// killHook kills the process group of the hook.
+func killHook(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
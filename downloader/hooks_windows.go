@@ -0,0 +1,26 @@
+//go:build windows
+// +build windows
+
+package downloader
+
+import (
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// hookCommand returns the command running the hook with cmd. The command line is passed as is, as cmd does not
+// follow the quoting rules of the other programs.
+func hookCommand(command string) *exec.Cmd {
+	cmd := exec.Command("cmd")
+	cmd.SysProcAttr = &syscall.SysProcAttr{CmdLine: "cmd /C " + command}
+	return cmd
+}
+
+// killHook kills the hook along with the processes it started.
+func killHook(cmd *exec.Cmd) error {
+	if err := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid)).Run(); err != nil {
+		return cmd.Process.Kill()
+	}
+	return nil
+}
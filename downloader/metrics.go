@@ -0,0 +1,270 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/arekziobrowski/sourcerer/model"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// fetchBuckets are the upper bounds in seconds of the buckets of the fetch durations.
+var fetchBuckets = []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600, 1800}
+
+// dependencyBuckets are the upper bounds in seconds of the buckets of the durations of the Maven step.
+var dependencyBuckets = []float64{1, 5, 10, 30, 60, 120, 300, 600, 1800}
+
+// Metrics are the Prometheus metrics of the run. The methods do nothing on nil metrics.
+type Metrics struct {
+	received           int64
+	mutex              sync.Mutex
+	sources            map[model.Status]int
+	inFlight           int
+	retries            int
+	fetchDuration      *histogram
+	dependencyDuration *histogram
+}
+
+func NewMetrics() *Metrics {
+	sources := make(map[model.Status]int)
+	// All the statuses are exported from the start, so that their rates can be computed.
+	for _, status := range []model.Status{model.StatusDownloaded, model.StatusUpdated, model.StatusRepaired,
+		model.StatusSkipped, model.StatusDuplicate, model.StatusInvalid, model.StatusFailed, model.StatusInterrupted} {
+		sources[status] = 0
+	}
+	return &Metrics{
+		sources:            sources,
+		fetchDuration:      newHistogram(fetchBuckets),
+		dependencyDuration: newHistogram(dependencyBuckets),
+	}
+}
+
+// Received adds the bytes received by a download.
+func (m *Metrics) Received(n int64) {
+	if m != nil {
+		atomic.AddInt64(&m.received, n)
+	}
+}
+
+// start counts a source whose download is started.
+func (m *Metrics) start() {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.inFlight++
+}
+
+// stop counts a source whose download is stopped.
+func (m *Metrics) stop() {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.inFlight--
+}
+
+// finish counts a source finished with the status.
+func (m *Metrics) finish(status model.Status) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.sources[status]++
+}
+
+// fetched observes the duration of an attempt to download a source.
+func (m *Metrics) fetched(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.fetchDuration.observe(d.Seconds())
+}
+
+// retried counts a retry of the download of a source.
+func (m *Metrics) retried() {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.retries++
+}
+
+// dependenciesDownloaded observes the duration of the download of the dependencies of a source.
+func (m *Metrics) dependenciesDownloaded(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.dependencyDuration.observe(d.Seconds())
+}
+
+// ServeHTTP serves the metrics in the Prometheus text format, so that they can be served along with the metrics
+// of the application embedding the client.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := m.write(w); err != nil {
+		log.Debugf("Cannot write the metrics: %v", err)
+	}
+}
+
+// write writes the metrics in the Prometheus text format.
+func (m *Metrics) write(w io.Writer) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	b := &metricsWriter{w: w}
+	b.header("sourcerer_sources_total", "counter", "Sources finished, by status.")
+	statuses := make([]string, 0, len(m.sources))
+	for status := range m.sources {
+		statuses = append(statuses, string(status))
+	}
+	sort.Strings(statuses)
+	for _, status := range statuses {
+		b.sample("sourcerer_sources_total", `status="`+status+`"`, float64(m.sources[model.Status(status)]))
+	}
+	b.header("sourcerer_sources_in_flight", "gauge", "Sources being downloaded.")
+	b.sample("sourcerer_sources_in_flight", "", float64(m.inFlight))
+	b.header("sourcerer_received_bytes_total", "counter", "Bytes received from the remotes.")
+	b.sample("sourcerer_received_bytes_total", "", float64(atomic.LoadInt64(&m.received)))
+	b.header("sourcerer_retries_total", "counter", "Retries of the downloads failed transiently.")
+	b.sample("sourcerer_retries_total", "", float64(m.retries))
+	b.header("sourcerer_fetch_duration_seconds", "histogram", "Duration of the attempts to download a source.")
+	b.histogram("sourcerer_fetch_duration_seconds", m.fetchDuration)
+	b.header("sourcerer_dependencies_duration_seconds", "histogram", "Duration of the downloads of the Maven dependencies of a source.")
+	b.histogram("sourcerer_dependencies_duration_seconds", m.dependencyDuration)
+	return b.err
+}
+
+// histogram counts the observations in cumulative buckets.
+type histogram struct {
+	bounds []float64
+	counts []int
+	count  int
+	sum    float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]int, len(bounds))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// metricsWriter writes the samples in the Prometheus text format, keeping the first error.
+type metricsWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (b *metricsWriter) header(name, kind, help string) {
+	b.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (b *metricsWriter) sample(name, labels string, value float64) {
+	if labels != "" {
+		name += "{" + labels + "}"
+	}
+	b.printf("%s %s\n", name, strconv.FormatFloat(value, 'f', -1, 64))
+}
+
+func (b *metricsWriter) histogram(name string, h *histogram) {
+	for i, bound := range h.bounds {
+		b.sample(name+"_bucket", `le="`+strconv.FormatFloat(bound, 'f', -1, 64)+`"`, float64(h.counts[i]))
+	}
+	b.sample(name+"_bucket", `le="+Inf"`, float64(h.count))
+	b.sample(name+"_sum", "", h.sum)
+	b.sample(name+"_count", "", float64(h.count))
+}
+
+func (b *metricsWriter) printf(format string, args ...interface{}) {
+	if b.err == nil {
+		_, b.err = fmt.Fprintf(b.w, format, args...)
+	}
+}
+
+// ExportMetrics serves the metrics on the address and writes them to the file, each unless empty, until stopped.
+func ExportMetrics(m *Metrics, addr, filename string, interval time.Duration) (func(), error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if addr != "" {
+		if err := serveMetrics(ctx, addr, m); err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if filename != "" {
+			writeMetricsFile(ctx, filename, interval, m)
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}, nil
+}
+
+// serveMetrics serves the metrics on the /metrics endpoint of the address until the context is done.
+func serveMetrics(ctx context.Context, addr string, m *Metrics) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrap(err, "cannot serve the metrics")
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	server := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	log.Infof("Serving the metrics on http://%s/metrics", listener.Addr())
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Error while serving the metrics: %v", err)
+		}
+	}()
+	return nil
+}
+
+// writeMetricsFile writes the metrics to the file every interval until the context is done, and once more at the end,
+// for the textfile collector of the node exporter.
+func writeMetricsFile(ctx context.Context, filename string, interval time.Duration, m *Metrics) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := writeFile(filename, m.write); err != nil {
+			log.Errorf("Error while writing the metrics: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if err := writeFile(filename, m.write); err != nil {
+				log.Errorf("Error while writing the metrics: %v", err)
+			}
+			return
+		}
+	}
+}
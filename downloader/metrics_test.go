@@ -0,0 +1,102 @@
+package downloader
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arekziobrowski/sourcerer/model"
+)
+
+func TestMetrics(t *testing.T) {
+	tests := []struct {
+		name   string
+		record func(m *Metrics)
+		// want are the samples expected in the metrics.
+		want []string
+	}{
+		{
+			name:   "new",
+			record: func(m *Metrics) {},
+			want: []string{
+				`sourcerer_sources_total{status="downloaded"} 0`,
+				`sourcerer_sources_total{status="updated"} 0`,
+				`sourcerer_sources_total{status="repaired"} 0`,
+				`sourcerer_sources_total{status="skipped"} 0`,
+				`sourcerer_sources_total{status="duplicate"} 0`,
+				`sourcerer_sources_total{status="invalid"} 0`,
+				`sourcerer_sources_total{status="failed"} 0`,
+				`sourcerer_sources_total{status="interrupted"} 0`,
+				`sourcerer_sources_in_flight 0`,
+				`sourcerer_received_bytes_total 0`,
+				`sourcerer_fetch_duration_seconds_count 0`,
+			},
+		},
+		{
+			name: "finished",
+			record: func(m *Metrics) {
+				m.finish(model.StatusDownloaded)
+				m.finish(model.StatusDuplicate)
+				m.finish(model.StatusDuplicate)
+				m.finish(model.StatusInvalid)
+				m.finish(model.StatusFailed)
+			},
+			want: []string{
+				`sourcerer_sources_total{status="downloaded"} 1`,
+				`sourcerer_sources_total{status="duplicate"} 2`,
+				`sourcerer_sources_total{status="invalid"} 1`,
+				`sourcerer_sources_total{status="failed"} 1`,
+				`sourcerer_sources_total{status="skipped"} 0`,
+			},
+		},
+		{
+			name: "downloads",
+			record: func(m *Metrics) {
+				m.start()
+				m.start()
+				m.stop()
+				m.Received(1024)
+				m.retried()
+				m.fetched(3 * time.Second)
+				m.dependenciesDownloaded(20 * time.Second)
+			},
+			want: []string{
+				`sourcerer_sources_in_flight 1`,
+				`sourcerer_received_bytes_total 1024`,
+				`sourcerer_retries_total 1`,
+				`sourcerer_fetch_duration_seconds_bucket{le="2.5"} 0`,
+				`sourcerer_fetch_duration_seconds_bucket{le="5"} 1`,
+				`sourcerer_fetch_duration_seconds_bucket{le="+Inf"} 1`,
+				`sourcerer_fetch_duration_seconds_sum 3`,
+				`sourcerer_dependencies_duration_seconds_bucket{le="10"} 0`,
+				`sourcerer_dependencies_duration_seconds_bucket{le="30"} 1`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMetrics()
+			tt.record(m)
+			var b bytes.Buffer
+			if err := m.write(&b); err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(b.String(), "\n")
+			for _, want := range tt.want {
+				if !containsString(lines, want) {
+					t.Errorf("missing %s in:\n%s", want, b.String())
+				}
+			}
+		})
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,304 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/arekziobrowski/sourcerer/model"
+	"github.com/arekziobrowski/sourcerer/source"
+	log "github.com/sirupsen/logrus"
+)
+
+// progressRefresh is the interval of redrawing the progress on a terminal.
+const progressRefresh = 200 * time.Millisecond
+
+// Progress tracks the sources and the bytes received in the run. The methods do nothing on a nil progress.
+type Progress struct {
+	received int64
+	mutex    sync.Mutex
+	started  time.Time
+	read     int
+	total    int
+	complete bool
+	inFlight int
+	done     int
+	failed   int
+}
+
+func NewProgress() *Progress {
+	return &Progress{started: time.Now()}
+}
+
+// Received adds the bytes received by a download.
+func (p *Progress) Received(n int64) {
+	if p != nil {
+		atomic.AddInt64(&p.received, n)
+	}
+}
+
+// add counts a source read from the input.
+func (p *Progress) add() {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.read++
+}
+
+// SetTotal sets the number of the sources of the input, counted before they are read, so that the estimated time
+// left is known from the start.
+func (p *Progress) SetTotal(n int) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.total = n
+}
+
+// readAll marks the input as read, so that the number of the sources is known.
+func (p *Progress) readAll() {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.complete = true
+}
+
+// start counts a source whose download is started.
+func (p *Progress) start() {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.inFlight++
+}
+
+// stop counts a source whose download is stopped.
+func (p *Progress) stop() {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.inFlight--
+}
+
+// finish counts a source finished with the status.
+func (p *Progress) finish(status model.Status) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.done++
+	if status == model.StatusFailed {
+		p.failed++
+	}
+}
+
+// progressSnapshot is the state of the progress at a moment.
+type progressSnapshot struct {
+	elapsed  time.Duration
+	received int64
+	read     int
+	total    int
+	complete bool
+	inFlight int
+	done     int
+	failed   int
+}
+
+func (p *Progress) snapshot() progressSnapshot {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return progressSnapshot{
+		elapsed:  time.Since(p.started),
+		received: atomic.LoadInt64(&p.received),
+		read:     p.read,
+		total:    p.total,
+		complete: p.complete,
+		inFlight: p.inFlight,
+		done:     p.done,
+		failed:   p.failed,
+	}
+}
+
+// sources returns the number of the sources of the input, unknown until the input is read unless counted before.
+func (s progressSnapshot) sources() (int, bool) {
+	switch {
+	case s.complete:
+		return s.read, true
+	case s.total > 0:
+		// The input could have grown since it was counted.
+		if s.read > s.total {
+			return s.read, true
+		}
+		return s.total, true
+	}
+	return 0, false
+}
+
+// eta returns the estimated time until all the sources are finished, at the pace of the sources finished so far.
+// The time is unknown until the number of the sources is known and a source is finished.
+func (s progressSnapshot) eta() (time.Duration, bool) {
+	sources, ok := s.sources()
+	if !ok || s.done == 0 {
+		return 0, false
+	}
+	return time.Duration(float64(s.elapsed) / float64(s.done) * float64(sources-s.done)), true
+}
+
+// String returns the progress in a single line, with the rate of receiving the bytes.
+func (s progressSnapshot) String(rate float64) string {
+	total := "?"
+	if sources, ok := s.sources(); ok {
+		total = fmt.Sprint(sources)
+	}
+	line := fmt.Sprintf("Sources: %d/%s done, %d in flight, %d failed | %s received, %s/s",
+		s.done, total, s.inFlight, s.failed, formatBytes(float64(s.received)), formatBytes(rate))
+	if eta, ok := s.eta(); ok {
+		line += " | ETA " + eta.Round(time.Second).String()
+	}
+	return line
+}
+
+// formatBytes returns the size in the binary units.
+func formatBytes(n float64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return fmt.Sprintf("%.0f B", n)
+	}
+	i := -1
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %ciB", n, units[i])
+}
+
+// Display shows the progress until the context is done: redrawn in the status line of the terminal, or logged
+// every interval otherwise. The bytes received in the run are logged at the end.
+func (p *Progress) Display(ctx context.Context, out *os.File, interval time.Duration) {
+	if isTerminal(out) {
+		p.displayTerminal(ctx, out)
+	} else {
+		p.displayLines(ctx, interval)
+	}
+	s := p.snapshot()
+	log.Infof("Received %s in %s", formatBytes(float64(s.received)), s.elapsed.Round(time.Millisecond))
+}
+
+func (p *Progress) displayLines(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := p.snapshot()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		s := p.snapshot()
+		log.Info(s.String(rate(last, s)))
+		last = s
+	}
+}
+
+func (p *Progress) displayTerminal(ctx context.Context, out *os.File) {
+	status := &statusLine{out: out}
+	// The log is written above the status line.
+	logOut := log.StandardLogger().Out
+	log.SetOutput(&statusLineWriter{status: status, out: logOut})
+	defer log.SetOutput(logOut)
+
+	ticker := time.NewTicker(progressRefresh)
+	defer ticker.Stop()
+	// The rate is averaged over the last seconds, so that it does not jump with every redraw.
+	samples := []progressSnapshot{p.snapshot()}
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			status.clear()
+			return
+		}
+		s := p.snapshot()
+		samples = append(samples, s)
+		for len(samples) > 1 && s.elapsed-samples[0].elapsed > 5*time.Second {
+			samples = samples[1:]
+		}
+		status.draw(s.String(rate(samples[0], s)))
+	}
+}
+
+// rate returns the bytes received per second between the snapshots.
+func rate(from, to progressSnapshot) float64 {
+	elapsed := (to.elapsed - from.elapsed).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(to.received-from.received) / elapsed
+}
+
+// statusLine is the last line of the terminal, redrawn in place.
+type statusLine struct {
+	mutex sync.Mutex
+	out   io.Writer
+	text  string
+}
+
+func (l *statusLine) draw(text string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.text = text
+	fmt.Fprint(l.out, "\r\x1b[K"+text)
+}
+
+func (l *statusLine) clear() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.text = ""
+	fmt.Fprint(l.out, "\r\x1b[K")
+}
+
+// statusLineWriter writes above the status line: the status line is cleared, and drawn again after the output.
+type statusLineWriter struct {
+	status *statusLine
+	out    io.Writer
+}
+
+func (w *statusLineWriter) Write(p []byte) (int, error) {
+	w.status.mutex.Lock()
+	defer w.status.mutex.Unlock()
+	fmt.Fprint(w.status.out, "\r\x1b[K")
+	n, err := w.out.Write(p)
+	if w.status.text != "" && strings.HasSuffix(string(p), "\n") {
+		fmt.Fprint(w.status.out, w.status.text)
+	}
+	return n, err
+}
+
+// progressReceivers reports the received bytes to all the receivers.
+type progressReceivers []source.Progress
+
+func (r progressReceivers) Received(n int64) {
+	for _, p := range r {
+		p.Received(n)
+	}
+}
+
+// isTerminal returns true if the file is a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
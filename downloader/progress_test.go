@@ -0,0 +1,74 @@
+package downloader
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgressSnapshot(t *testing.T) {
+	tests := []struct {
+		name     string
+		snapshot progressSnapshot
+		// wantSources is the number of the sources shown, "?" if unknown.
+		wantSources string
+		wantETA     time.Duration
+		wantNoETA   bool
+	}{
+		{
+			name:        "reading",
+			snapshot:    progressSnapshot{elapsed: 10 * time.Second, read: 10, done: 5},
+			wantSources: "?",
+			wantNoETA:   true,
+		},
+		{
+			name:        "read",
+			snapshot:    progressSnapshot{elapsed: 10 * time.Second, read: 10, complete: true, done: 5},
+			wantSources: "10",
+			wantETA:     10 * time.Second,
+		},
+		{
+			name:        "counted",
+			snapshot:    progressSnapshot{elapsed: 10 * time.Second, read: 8, total: 20, done: 5},
+			wantSources: "20",
+			wantETA:     30 * time.Second,
+		},
+		{
+			name:        "grown",
+			snapshot:    progressSnapshot{elapsed: 10 * time.Second, read: 25, total: 20, done: 5},
+			wantSources: "25",
+			wantETA:     40 * time.Second,
+		},
+		{
+			name:        "read after counted",
+			snapshot:    progressSnapshot{elapsed: 10 * time.Second, read: 15, total: 20, complete: true, done: 5},
+			wantSources: "15",
+			wantETA:     20 * time.Second,
+		},
+		{
+			name:        "none done",
+			snapshot:    progressSnapshot{elapsed: 10 * time.Second, read: 8, total: 20},
+			wantSources: "20",
+			wantNoETA:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			line := tt.snapshot.String(0)
+			if want := "Sources: " + strconv.Itoa(tt.snapshot.done) + "/" + tt.wantSources + " done"; !strings.HasPrefix(line, want) {
+				t.Errorf("String = %q, want the prefix %q", line, want)
+			}
+			eta, ok := tt.snapshot.eta()
+			if ok == tt.wantNoETA {
+				t.Fatalf("eta known: %v, want %v", ok, !tt.wantNoETA)
+			}
+			if eta != tt.wantETA {
+				t.Errorf("eta = %s, want %s", eta, tt.wantETA)
+			}
+			if strings.Contains(line, "ETA") == tt.wantNoETA {
+				t.Errorf("String = %q, want the ETA shown: %v", line, !tt.wantNoETA)
+			}
+		})
+	}
+}
@@ -0,0 +1,478 @@
+package downloader
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arekziobrowski/sourcerer/model"
+	"github.com/pkg/errors"
+)
+
+// jsonReport is the report of a run in the JSON format. The sources are listed in the order they were finished.
+type jsonReport struct {
+	Started  time.Time            `json:"started"`
+	Sources  []jsonReportSource   `json:"sources"`
+	Duration float64              `json:"duration_seconds"`
+	Summary  map[model.Status]int `json:"summary"`
+}
+
+type jsonReportSource struct {
+	Index         int                    `json:"index"`
+	Origin        string                 `json:"origin"`
+	Revision      string                 `json:"revision"`
+	Commit        string                 `json:"commit,omitempty"`
+	Status        model.Status           `json:"status"`
+	Error         string                 `json:"error,omitempty"`
+	ErrorCategory model.ErrorCategory    `json:"error_category,omitempty"`
+	Duration      float64                `json:"duration_seconds"`
+	Size          int64                  `json:"size_bytes"`
+	Attempts      []jsonReportAttempt    `json:"attempts"`
+	Dependencies  model.Status           `json:"dependencies,omitempty"`
+	Hooks         []jsonReportHook       `json:"hooks,omitempty"`
+	Submodules    []jsonReportSubmodule  `json:"submodules,omitempty"`
+	LFSPointers   []jsonReportLFSPointer `json:"unresolved_lfs_pointers,omitempty"`
+}
+
+type jsonReportSubmodule struct {
+	Path   string `json:"path"`
+	Origin string `json:"origin"`
+	Commit string `json:"commit"`
+}
+
+type jsonReportLFSPointer struct {
+	Path   string `json:"path"`
+	OID    string `json:"oid"`
+	Size   int64  `json:"size_bytes"`
+	Reason string `json:"reason"`
+}
+
+type jsonReportAttempt struct {
+	Started   time.Time `json:"started"`
+	Duration  float64   `json:"duration_seconds"`
+	Error     string    `json:"error,omitempty"`
+	Transient bool      `json:"transient,omitempty"`
+}
+
+type jsonReportHook struct {
+	Hook     string    `json:"hook"`
+	Started  time.Time `json:"started"`
+	Duration float64   `json:"duration_seconds"`
+	Output   string    `json:"output,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// JSONReportWriter writes the report of a run in the JSON format. The sources are written as they are finished,
+// so that they are not kept in memory, to a temporary file renamed to the file once the writer is closed.
+type JSONReportWriter struct {
+	mutex    sync.Mutex
+	filename string
+	started  time.Time
+	file     *os.File
+	w        *bufio.Writer
+	sources  int
+	summary  map[model.Status]int
+	err      error
+}
+
+// NewJSONReportWriter creates the writer of the report of the run started at the time.
+func NewJSONReportWriter(filename string, started time.Time) (*JSONReportWriter, error) {
+	f, err := createTemp(filename)
+	if err != nil {
+		return nil, err
+	}
+	w := &JSONReportWriter{
+		filename: filename,
+		started:  started,
+		file:     f,
+		w:        bufio.NewWriter(f),
+		summary:  make(map[model.Status]int),
+	}
+	startedJSON, err := json.Marshal(started)
+	if err != nil {
+		w.abort()
+		return nil, err
+	}
+	fmt.Fprintf(w.w, "{\n  \"started\": %s,\n  \"sources\": [", startedJSON)
+	return w, nil
+}
+
+// HandleResult writes the source of the result.
+func (w *JSONReportWriter) HandleResult(r Result) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.summary[r.Status]++
+	if w.err != nil {
+		return
+	}
+	content, err := json.MarshalIndent(jsonReportSourceOf(r), "    ", "  ")
+	if err != nil {
+		w.err = err
+		return
+	}
+	if w.sources > 0 {
+		w.w.WriteString(",")
+	}
+	w.w.WriteString("\n    ")
+	_, w.err = w.w.Write(content)
+	w.sources++
+}
+
+// Close writes the summary of the run and renames the report to its file.
+func (w *JSONReportWriter) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	summary, err := json.MarshalIndent(w.summary, "  ", "  ")
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	if w.err != nil {
+		w.abort()
+		return errors.Wrapf(w.err, "cannot write %s", w.filename)
+	}
+	if w.sources > 0 {
+		w.w.WriteString("\n  ")
+	}
+	fmt.Fprintf(w.w, "],\n  \"duration_seconds\": %s,\n  \"summary\": %s\n}\n", strconv.FormatFloat(time.Since(w.started).Seconds(), 'f', -1, 64), summary)
+	return closeTemp(w.filename, w.file, w.w)
+}
+
+func (w *JSONReportWriter) abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+// jsonReportSourceOf returns the source of the result in the JSON report.
+func jsonReportSourceOf(r Result) jsonReportSource {
+	src := r.Source
+	attempts := make([]jsonReportAttempt, 0, len(src.Attempts))
+	for _, a := range src.Attempts {
+		attempts = append(attempts, jsonReportAttempt{
+			Started:   a.Start,
+			Duration:  a.Duration.Seconds(),
+			Error:     a.Error,
+			Transient: a.Transient,
+		})
+	}
+	var hooks []jsonReportHook
+	for _, h := range src.Hooks {
+		hooks = append(hooks, jsonReportHook{
+			Hook:     h.Hook,
+			Started:  h.Start,
+			Duration: h.Duration.Seconds(),
+			Output:   h.Output,
+			Error:    h.Error,
+		})
+	}
+	var submodules []jsonReportSubmodule
+	for _, sub := range src.Submodules {
+		submodules = append(submodules, jsonReportSubmodule{Path: sub.Path, Origin: model.Redact(sub.Origin), Commit: sub.Hash})
+	}
+	var pointers []jsonReportLFSPointer
+	for _, p := range src.UnresolvedLFSPointers {
+		pointers = append(pointers, jsonReportLFSPointer{Path: p.Path, OID: p.OID, Size: p.Size, Reason: p.Reason})
+	}
+	return jsonReportSource{
+		Index:         r.Index,
+		Origin:        model.Redact(src.Origin),
+		Revision:      src.Revision,
+		Commit:        src.Hash,
+		Status:        src.Status,
+		Error:         src.Error,
+		ErrorCategory: src.ErrorCategory,
+		Duration:      src.Duration.Seconds(),
+		Size:          src.Size,
+		Attempts:      attempts,
+		Dependencies:  src.Dependencies,
+		Hooks:         hooks,
+		Submodules:    submodules,
+		LFSPointers:   pointers,
+	}
+}
+
+// WriteJSONReport writes the report of the results of the run started at the time in the JSON format.
+func WriteJSONReport(filename string, started time.Time, results []Result) error {
+	w, err := NewJSONReportWriter(filename, started)
+	if err != nil {
+		return err
+	}
+	for _, r := range results {
+		w.HandleResult(r)
+	}
+	return w.Close()
+}
+
+// junitTestSuites is the report of a run in the JUnit XML format. Every source is a test case, failed if the source
+// failed or is invalid, and skipped if it is a duplicate or the run was stopped before the source was finished.
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	Cases     []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	XMLName   xml.Name      `xml:"testcase"`
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemOut *junitOutput  `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr,omitempty"`
+	Text    string `xml:",cdata"`
+}
+
+type junitOutput struct {
+	Text string `xml:",cdata"`
+}
+
+// JUnitReportWriter writes the report of a run in the JUnit XML format. The test cases are written as the sources
+// are finished, so that they are not kept in memory, to a temporary file. The counts of the test suite precede
+// the test cases, so the report is only written to its file once the writer is closed.
+type JUnitReportWriter struct {
+	mutex    sync.Mutex
+	filename string
+	started  time.Time
+	cases    *os.File
+	w        *bufio.Writer
+	suite    junitTestSuite
+	err      error
+}
+
+// NewJUnitReportWriter creates the writer of the report of the run started at the time.
+func NewJUnitReportWriter(filename string, started time.Time) (*JUnitReportWriter, error) {
+	f, err := createTemp(filename + ".cases")
+	if err != nil {
+		return nil, err
+	}
+	return &JUnitReportWriter{
+		filename: filename,
+		started:  started,
+		cases:    f,
+		w:        bufio.NewWriter(f),
+		suite: junitTestSuite{
+			Name:      "sourcerer",
+			Timestamp: started.Format("2006-01-02T15:04:05"),
+		},
+	}, nil
+}
+
+// HandleResult writes the test case of the source of the result.
+func (w *JUnitReportWriter) HandleResult(r Result) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	src := r.Source
+	c := junitTestCase{
+		Name:      model.Redact(src.Origin) + "@" + src.Revision,
+		ClassName: junitClassName(src),
+		Time:      seconds(src.Duration),
+		SystemOut: &junitOutput{junitSystemOut(src)},
+	}
+	w.suite.Tests++
+	switch src.Status {
+	case model.StatusFailed:
+		w.suite.Failures++
+		c.Failure = &junitMessage{Message: src.Error, Type: string(src.ErrorCategory), Text: src.Error}
+	case model.StatusInvalid:
+		w.suite.Failures++
+		c.Failure = &junitMessage{Message: "invalid entry", Type: string(src.ErrorCategory), Text: src.Error}
+	case model.StatusInterrupted:
+		w.suite.Skipped++
+		c.Skipped = &junitMessage{Message: "the run was stopped before the source was finished"}
+	case model.StatusDuplicate:
+		w.suite.Skipped++
+		c.Skipped = &junitMessage{Message: "the source is a duplicate of an earlier source"}
+	}
+	if w.err != nil {
+		return
+	}
+	content, err := xml.MarshalIndent(&c, "    ", "  ")
+	if err != nil {
+		w.err = err
+		return
+	}
+	w.w.WriteString("\n")
+	_, w.err = w.w.Write(content)
+}
+
+// Close writes the report to its file, the test suite along with the test cases written so far.
+func (w *JUnitReportWriter) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	defer os.Remove(w.cases.Name())
+	defer w.cases.Close()
+	if w.err == nil {
+		w.err = w.w.Flush()
+	}
+	if w.err != nil {
+		return errors.Wrapf(w.err, "cannot write %s", w.filename)
+	}
+	w.suite.Time = seconds(time.Since(w.started))
+	// The test suite is encoded without the test cases, which are inserted before its end.
+	suite, err := xml.MarshalIndent(&junitTestSuites{Suites: []junitTestSuite{w.suite}}, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "cannot write %s", w.filename)
+	}
+	const suiteEnd = "</testsuite>"
+	end := bytes.LastIndex(suite, []byte(suiteEnd))
+	// An empty element is encoded with its end on the same line.
+	head := bytes.TrimRight(suite[:end], " \n")
+	if _, err := w.cases.Seek(0, io.SeekStart); err != nil {
+		return errors.Wrapf(err, "cannot write %s", w.filename)
+	}
+	return writeFile(w.filename, func(out io.Writer) error {
+		if _, err := io.WriteString(out, xml.Header); err != nil {
+			return err
+		}
+		if _, err := out.Write(head); err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, w.cases); err != nil {
+			return err
+		}
+		_, err := io.WriteString(out, "\n  "+string(suite[end:])+"\n")
+		return err
+	})
+}
+
+// WriteJUnitReport writes the report of the results of the run started at the time in the JUnit XML format.
+func WriteJUnitReport(filename string, started time.Time, results []Result) error {
+	w, err := NewJUnitReportWriter(filename, started)
+	if err != nil {
+		return err
+	}
+	for _, r := range results {
+		w.HandleResult(r)
+	}
+	return w.Close()
+}
+
+// junitClassName groups the sources by the host and the namespace, the way the tests are grouped by their classes.
+func junitClassName(src *model.Source) string {
+	name := strings.Trim(src.Host+"/"+src.Namespace, "/")
+	if name == "" {
+		return "sourcerer"
+	}
+	return name
+}
+
+// junitSystemOut returns the details of the source that have no place in the JUnit format.
+func junitSystemOut(src *model.Source) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "status: %s\n", src.Status)
+	if src.Hash != "" {
+		fmt.Fprintf(&b, "commit: %s\n", src.Hash)
+	}
+	fmt.Fprintf(&b, "size: %d bytes\n", src.Size)
+	if src.Dependencies != "" {
+		fmt.Fprintf(&b, "dependencies: %s\n", src.Dependencies)
+	}
+	for _, sub := range src.Submodules {
+		fmt.Fprintf(&b, "submodule %s: %s@%s\n", sub.Path, model.Redact(sub.Origin), sub.Hash)
+	}
+	for _, p := range src.UnresolvedLFSPointers {
+		fmt.Fprintf(&b, "unresolved LFS pointer %s: sha256:%s, %d bytes: %s\n", p.Path, p.OID, p.Size, p.Reason)
+	}
+	for i, a := range src.Attempts {
+		fmt.Fprintf(&b, "attempt %d: %ss", i+1, seconds(a.Duration))
+		if a.Error != "" {
+			fmt.Fprintf(&b, ", failed: %s", a.Error)
+		}
+		b.WriteString("\n")
+	}
+	for _, h := range src.Hooks {
+		fmt.Fprintf(&b, "%s hook: %ss", h.Hook, seconds(h.Duration))
+		if h.Error != "" {
+			fmt.Fprintf(&b, ", failed: %s", h.Error)
+		}
+		b.WriteString("\n")
+		if h.Output != "" {
+			fmt.Fprintf(&b, "%s\n", h.Output)
+		}
+	}
+	return b.String()
+}
+
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// writeFile writes the file through a temporary file renamed to the file once complete, so that the file
+// is never read half-written.
+func writeFile(filename string, write func(w io.Writer) error) error {
+	f, err := createTemp(filename)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if err := write(w); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return errors.Wrapf(err, "cannot write %s", filename)
+	}
+	return closeTemp(filename, f, w)
+}
+
+// createTemp creates the temporary file the file is written to, along with its directory.
+func createTemp(filename string) (*os.File, error) {
+	if dir := filepath.Dir(filename); dir != "" {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			return nil, errors.Wrapf(err, "cannot create the directory of %s", filename)
+		}
+	}
+	f, err := os.Create(filename + ".tmp")
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot create %s", filename)
+	}
+	return f, nil
+}
+
+// closeTemp flushes and closes the temporary file of the file and renames it to the file.
+func closeTemp(filename string, f *os.File, w *bufio.Writer) error {
+	err := w.Flush()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return errors.Wrapf(err, "cannot write %s", filename)
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// diskUsage returns the size in bytes of the files in the directory.
+func diskUsage(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
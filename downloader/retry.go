@@ -0,0 +1,33 @@
+package downloader
+
+import (
+	"math/rand"
+	"time"
+)
+
+// retryPolicy is the number of the attempts to download a source and the backoff between them.
+// Only the transient failures are retried.
+type retryPolicy struct {
+	// attempts is the maximum number of the attempts, at least 1.
+	attempts int
+	// delay is the backoff after the first attempt, doubled after each next one.
+	delay time.Duration
+	// maxDelay caps the backoff, there is no cap if zero.
+	maxDelay time.Duration
+}
+
+// backoff returns the time to wait after the attempt, numbered from 1. The backoff grows exponentially
+// and is randomized between its half and its full length, so that the sources failed at once are not retried at once.
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	delay := p.delay
+	for i := 1; i < attempt && (p.maxDelay <= 0 || delay < p.maxDelay); i++ {
+		delay *= 2
+	}
+	if p.maxDelay > 0 && delay > p.maxDelay {
+		delay = p.maxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
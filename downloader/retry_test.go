@@ -0,0 +1,35 @@
+package downloader
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  retryPolicy
+		attempt int
+		// The backoff is randomized between the half of the delay and the full delay.
+		want time.Duration
+	}{
+		{name: "no delay", policy: retryPolicy{attempts: 3}, attempt: 1},
+		{name: "first", policy: retryPolicy{attempts: 3, delay: time.Second}, attempt: 1, want: time.Second},
+		{name: "second", policy: retryPolicy{attempts: 3, delay: time.Second}, attempt: 2, want: 2 * time.Second},
+		{name: "fifth", policy: retryPolicy{attempts: 6, delay: time.Second}, attempt: 5, want: 16 * time.Second},
+		{name: "capped", policy: retryPolicy{attempts: 6, delay: time.Second, maxDelay: 5 * time.Second}, attempt: 4, want: 5 * time.Second},
+		{name: "below cap", policy: retryPolicy{attempts: 6, delay: time.Second, maxDelay: 5 * time.Second}, attempt: 3, want: 4 * time.Second},
+		{name: "delay above cap", policy: retryPolicy{attempts: 3, delay: 10 * time.Second, maxDelay: 5 * time.Second}, attempt: 1, want: 5 * time.Second},
+		{name: "many attempts", policy: retryPolicy{attempts: 1000, delay: time.Second, maxDelay: time.Minute}, attempt: 1000, want: time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				got := tt.policy.backoff(tt.attempt)
+				if got < tt.want/2 || got > tt.want {
+					t.Fatalf("backoff(%d) = %s, want between %s and %s", tt.attempt, got, tt.want/2, tt.want)
+				}
+			}
+		})
+	}
+}
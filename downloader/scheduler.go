@@ -0,0 +1,131 @@
+package downloader
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// scheduler bounds the number of the sources downloaded at once, in total and from a single host. The dependencies
+// are downloaded within a separate limit, so that they do not hold up the downloads of the sources.
+type scheduler struct {
+	// queued bounds the number of the sources waiting or being downloaded. When it is reached, the reading
+	// of the input stops until a source is done.
+	queued       chan struct{}
+	jobs         chan struct{}
+	dependencies chan struct{}
+	hostJobs     int
+	hostLimits   map[string]int
+	hostsMutex   sync.Mutex
+	hosts        map[string]*hostSlots
+}
+
+// hostSlots are the semaphores of a limited host.
+type hostSlots struct {
+	// queued bounds the number of the sources of the host in the queue, so that the sources waiting for the host
+	// do not fill the queue and hold up the sources of the other hosts.
+	queued chan struct{}
+	jobs   chan struct{}
+}
+
+// newScheduler creates the scheduler downloading at most jobs sources and the dependencies of at most dependencyJobs
+// sources at once. At most hostJobs sources are downloaded from a single host, unless overridden for the host
+// in hostLimits; there is no limit per host if zero.
+func newScheduler(jobs, dependencyJobs, hostJobs int, hostLimits map[string]int) *scheduler {
+	limits := make(map[string]int, len(hostLimits))
+	for host, limit := range hostLimits {
+		limits[strings.ToLower(host)] = limit
+	}
+	return &scheduler{
+		queued:       make(chan struct{}, 2*(jobs+dependencyJobs)),
+		jobs:         make(chan struct{}, jobs),
+		dependencies: make(chan struct{}, dependencyJobs),
+		hostJobs:     hostJobs,
+		hostLimits:   limits,
+		hosts:        make(map[string]*hostSlots),
+	}
+}
+
+// queue blocks until there is room for another source of the host. A limited host takes at most twice its limit
+// of the queue, the sources waiting beyond it would only wait for the host. The returned function removes the source
+// from the queue.
+func (s *scheduler) queue(ctx context.Context, host string) (func(), error) {
+	var hostQueued chan struct{}
+	if h := s.host(host); h != nil {
+		hostQueued = h.queued
+	}
+	releaseHost, err := acquire(ctx, hostQueued)
+	if err != nil {
+		return nil, err
+	}
+	release, err := acquire(ctx, s.queued)
+	if err != nil {
+		releaseHost()
+		return nil, err
+	}
+	return func() {
+		release()
+		releaseHost()
+	}, nil
+}
+
+// source blocks until the source can be downloaded from the host. The returned function releases its slots.
+func (s *scheduler) source(ctx context.Context, host string) (func(), error) {
+	var hostJobs chan struct{}
+	if h := s.host(host); h != nil {
+		hostJobs = h.jobs
+	}
+	releaseHost, err := acquire(ctx, hostJobs)
+	if err != nil {
+		return nil, err
+	}
+	release, err := acquire(ctx, s.jobs)
+	if err != nil {
+		releaseHost()
+		return nil, err
+	}
+	return func() {
+		release()
+		releaseHost()
+	}, nil
+}
+
+// dependency blocks until the dependencies of a source can be downloaded. The returned function releases its slot.
+func (s *scheduler) dependency(ctx context.Context) (func(), error) {
+	return acquire(ctx, s.dependencies)
+}
+
+// host returns the semaphores of the host, or nil if the host is not limited.
+func (s *scheduler) host(host string) *hostSlots {
+	limit, ok := s.hostLimits[host]
+	if !ok {
+		limit = s.hostJobs
+	}
+	if limit <= 0 {
+		return nil
+	}
+	s.hostsMutex.Lock()
+	defer s.hostsMutex.Unlock()
+	h, ok := s.hosts[host]
+	if !ok {
+		h = &hostSlots{
+			queued: make(chan struct{}, 2*limit),
+			jobs:   make(chan struct{}, limit),
+		}
+		s.hosts[host] = h
+	}
+	return h
+}
+
+// acquire takes a slot of the semaphore, waiting until one is free or the context is done. A nil semaphore is unlimited.
+func acquire(ctx context.Context, sem chan struct{}) (func(), error) {
+	if sem == nil {
+		return func() {}, nil
+	}
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
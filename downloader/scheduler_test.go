@@ -0,0 +1,103 @@
+package downloader
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSchedulerHostLimits(t *testing.T) {
+	const jobs = 4
+	tests := []struct {
+		name       string
+		hostJobs   int
+		hostLimits map[string]int
+		host       string
+		// want is the number of the sources of the host downloaded at once.
+		want int
+	}{
+		{name: "unlimited", host: "github.com", want: jobs},
+		{name: "host jobs", hostJobs: 2, host: "github.com", want: 2},
+		{name: "host limit", hostJobs: 2, hostLimits: map[string]int{"github.com": 1}, host: "github.com", want: 1},
+		{name: "other host", hostJobs: 2, hostLimits: map[string]int{"github.com": 1}, host: "gitlab.com", want: 2},
+		{name: "host limit case", hostLimits: map[string]int{"GitHub.com": 3}, host: "github.com", want: 3},
+		{name: "unlimited host", hostJobs: 2, hostLimits: map[string]int{"github.com": 0}, host: "github.com", want: jobs},
+		{name: "limit above jobs", hostLimits: map[string]int{"github.com": 8}, host: "github.com", want: jobs},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newScheduler(jobs, 1, tt.hostJobs, tt.hostLimits)
+			var releases []func()
+			for i := 0; i < tt.want; i++ {
+				release, err := s.source(context.Background(), tt.host)
+				if err != nil {
+					t.Fatal(err)
+				}
+				releases = append(releases, release)
+			}
+			// The context is done, so the source is not downloaded unless a slot is free.
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			if _, err := s.source(ctx, tt.host); err == nil {
+				t.Fatalf("more than %d sources downloaded at once", tt.want)
+			}
+			releases[0]()
+			release, err := s.source(context.Background(), tt.host)
+			if err != nil {
+				t.Fatalf("the source is not downloaded after a slot was released: %v", err)
+			}
+			release()
+		})
+	}
+}
+
+func TestSchedulerHostsIndependent(t *testing.T) {
+	s := newScheduler(4, 1, 1, nil)
+	release, err := s.source(context.Background(), "github.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.source(ctx, "github.com"); err == nil {
+		t.Error("more than 1 source downloaded at once from github.com")
+	}
+	if _, err := s.source(context.Background(), "gitlab.com"); err != nil {
+		t.Errorf("the source of gitlab.com is not downloaded: %v", err)
+	}
+}
+
+func TestSchedulerQueue(t *testing.T) {
+	s := newScheduler(2, 1, 0, map[string]int{"github.com": 1})
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// A limited host takes at most twice its limit of the queue.
+	for i := 0; i < 2; i++ {
+		if _, err := s.queue(context.Background(), "github.com"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.queue(cancelled, "github.com"); err == nil {
+		t.Fatal("more than 2 sources of github.com queued")
+	}
+	// The rest of the queue is left to the other hosts.
+	var releases []func()
+	for i := 0; i < 4; i++ {
+		release, err := s.queue(context.Background(), "gitlab.com")
+		if err != nil {
+			t.Fatalf("the source of gitlab.com is not queued: %v", err)
+		}
+		releases = append(releases, release)
+	}
+	if _, err := s.queue(cancelled, "gitlab.com"); err == nil {
+		t.Fatal("more than 6 sources queued")
+	}
+	releases[0]()
+	if _, err := s.queue(cancelled, "github.com"); err == nil {
+		t.Fatal("more than 2 sources of github.com queued")
+	}
+	if _, err := s.queue(context.Background(), "gitlab.com"); err != nil {
+		t.Errorf("the source of gitlab.com is not queued after a source was removed: %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package downloader
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/arekziobrowski/sourcerer/model"
+	"github.com/arekziobrowski/sourcerer/source"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// stagingDir is the directory the sources are downloaded into, relative to the destination directory. A source is moved
+// to its own directory only once it is complete, so that a failed download never leaves a partial directory behind.
+const stagingDir = ".sourcerer-staging"
+
+// stage creates the staging directory of the source directory. The staging directory is on the same file system
+// as the source directory, so that it can be renamed into place.
+func (s *service) stage(wd string) (string, error) {
+	root := filepath.Join(s.rootDir, stagingDir)
+	if rel, err := filepath.Rel(s.rootDir, wd); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		// The destination of the source is outside of the destination directory.
+		root = filepath.Join(filepath.Dir(wd), stagingDir)
+	}
+	if err := os.MkdirAll(root, 0777); err != nil {
+		return "", errors.Wrap(err, "cannot create the staging directory")
+	}
+	dir, err := ioutil.TempDir(root, filepath.Base(wd)+"-")
+	if err != nil {
+		return "", errors.Wrap(err, "cannot create the staging directory")
+	}
+	// The source is staged in a subdirectory, so that the existing source directory can be moved there.
+	return filepath.Join(dir, filepath.Base(wd)), nil
+}
+
+// move renames the directory of a source, and points the store at the directory if it is a worktree.
+// The directories of the sources checked out from a store are moved holding its lock.
+func (s *service) move(src *model.Source, from, to string) error {
+	if s.usesStore(src) {
+		return s.store(src).MoveDirectory(from, to)
+	}
+	return source.MoveDirectory(from, to)
+}
+
+// publish moves the staged source into its directory.
+func (s *service) publish(src *model.Source, staged, wd string) error {
+	log.Infof("Moving %s to %s", staged, wd)
+	if err := os.MkdirAll(filepath.Dir(wd), 0777); err != nil {
+		return err
+	}
+	if err := s.move(src, staged, wd); err != nil {
+		return errors.Wrapf(err, "cannot move the source to %s", wd)
+	}
+	return os.Remove(filepath.Dir(staged))
+}
+
+// discard removes the staging directory of a source that was not finished. The existing directory of a source being
+// updated is moved back instead, as it is still a checkout of another commit; if it was changed before the failure,
+// the next run updates or repairs it. The staging directories of the failed sources are kept if requested, for debugging.
+func (s *service) discard(src *model.Source, staged, wd string, status model.Status, failed bool) {
+	if staged == "" {
+		return
+	}
+	if _, err := os.Lstat(staged); status == model.StatusUpdated && err == nil {
+		log.Warnf("Moving %s back to %s, it could not be updated", staged, wd)
+		if err := s.move(src, staged, wd); err != nil {
+			log.Errorf("Cannot move %s back to %s: %v", staged, wd, err)
+			return
+		}
+	}
+	if failed && s.keepFailed {
+		log.Warnf("Keeping the staging directory of the failed source: %s", staged)
+		return
+	}
+	if err := os.RemoveAll(filepath.Dir(staged)); err != nil {
+		log.Errorf("Cannot remove the staging directory %s: %v", staged, err)
+	}
+}
@@ -0,0 +1,148 @@
+package downloader
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/arekziobrowski/sourcerer/model"
+)
+
+func TestStage(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	tests := []struct {
+		name string
+		wd   string
+		// want is the staging directory holding the staged source.
+		want string
+	}{
+		{name: "inside", wd: filepath.Join(root, "host", "org", "repo"), want: filepath.Join(root, stagingDir)},
+		{name: "root", wd: filepath.Join(root, "repo"), want: filepath.Join(root, stagingDir)},
+		{name: "outside", wd: filepath.Join(outside, "org", "repo"), want: filepath.Join(outside, "org", stagingDir)},
+		{name: "sibling", wd: root + "-repo", want: filepath.Join(filepath.Dir(root), stagingDir)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &service{rootDir: root}
+			staged, err := s.stage(tt.wd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(filepath.Dir(staged))
+			if got := filepath.Dir(filepath.Dir(staged)); got != tt.want {
+				t.Errorf("staging directory = %s, want %s", got, tt.want)
+			}
+			if got, want := filepath.Base(staged), filepath.Base(tt.wd); got != want {
+				t.Errorf("staged source = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestPublish(t *testing.T) {
+	tests := []struct {
+		name string
+		// existing is true if the directory of the source already exists.
+		existing bool
+		wantErr  bool
+	}{
+		{name: "new"},
+		{name: "existing", existing: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			s := &service{rootDir: root}
+			wd := filepath.Join(root, "host", "org", "repo")
+			if tt.existing {
+				if err := os.MkdirAll(wd, 0777); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(filepath.Join(wd, "existing"), []byte("e"), 0666); err != nil {
+					t.Fatal(err)
+				}
+			}
+			staged, err := s.stage(wd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Mkdir(staged, 0777); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(staged, "f"), []byte("f"), 0666); err != nil {
+				t.Fatal(err)
+			}
+
+			err = s.publish(&model.Source{}, staged, wd)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("publish = %v, want an error: %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				// The staged source is left to discard.
+				if _, err := os.Stat(filepath.Join(staged, "f")); err != nil {
+					t.Errorf("staged source is missing: %v", err)
+				}
+				if _, err := os.Stat(filepath.Join(wd, "existing")); err != nil {
+					t.Errorf("existing source is missing: %v", err)
+				}
+				return
+			}
+			if _, err := os.Stat(filepath.Join(wd, "f")); err != nil {
+				t.Errorf("published source is missing: %v", err)
+			}
+			if _, err := os.Stat(filepath.Dir(staged)); !os.IsNotExist(err) {
+				t.Errorf("staging directory is not removed: %v", err)
+			}
+		})
+	}
+}
+
+func TestDiscard(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     model.Status
+		failed     bool
+		keepFailed bool
+		// wantSource is true if the directory of the source holds the staged file afterwards.
+		wantSource bool
+		// wantStaged is true if the staging directory of the source is kept.
+		wantStaged bool
+	}{
+		{name: "updated", status: model.StatusUpdated, failed: true, wantSource: true},
+		{name: "updated kept", status: model.StatusUpdated, failed: true, keepFailed: true, wantSource: true, wantStaged: true},
+		{name: "downloaded", status: model.StatusDownloaded, failed: true},
+		{name: "downloaded kept", status: model.StatusDownloaded, failed: true, keepFailed: true, wantStaged: true},
+		{name: "not failed", status: model.StatusDownloaded, keepFailed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			s := &service{rootDir: root, keepFailed: tt.keepFailed}
+			wd := filepath.Join(root, "host", "org", "repo")
+			if err := os.MkdirAll(filepath.Dir(wd), 0777); err != nil {
+				t.Fatal(err)
+			}
+			staged, err := s.stage(wd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Mkdir(staged, 0777); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(staged, "f"), []byte("f"), 0666); err != nil {
+				t.Fatal(err)
+			}
+
+			s.discard(&model.Source{}, staged, wd, tt.status, tt.failed)
+
+			if _, err := os.Stat(filepath.Join(wd, "f")); (err == nil) != tt.wantSource {
+				t.Errorf("source directory exists: %v, want %v", err == nil, tt.wantSource)
+			}
+			if _, err := os.Stat(filepath.Dir(staged)); (err == nil) != tt.wantStaged {
+				t.Errorf("staging directory exists: %v, want %v", err == nil, tt.wantStaged)
+			}
+		})
+	}
+}
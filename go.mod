@@ -3,9 +3,11 @@ module github.com/arekziobrowski/sourcerer
 go 1.16
 
 require (
-	github.com/go-git/go-billy/v5 v5.0.0 // indirect
-	github.com/go-git/go-git/v5 v5.2.0
-	github.com/pkg/errors v0.8.1
-	github.com/sirupsen/logrus v1.8.1 // indirect
-	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
+	github.com/go-git/go-billy/v5 v5.4.0
+	github.com/go-git/go-git/v5 v5.5.2
+	github.com/pkg/errors v0.9.1
+	github.com/sirupsen/logrus v1.8.1
+	golang.org/x/sync v0.0.0-20220722155255-886fb9371eb4
+	golang.org/x/sys v0.3.0
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -1,59 +1,462 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"math/rand"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/arekziobrowski/sourcerer/downloader"
+	"github.com/arekziobrowski/sourcerer/manifest"
+	"github.com/arekziobrowski/sourcerer/model"
+	"github.com/arekziobrowski/sourcerer/source"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
-const (
-	git       = "git"
-	gitSystem = "git-system"
-)
-
-var input = flag.String("input", "", "input file name")
+var input = flag.String("input", "", "input file name, - reads from the standard input")
+var inputFormat = flag.String("input_format", "", "input format [lines, json, yaml], detected from the input if empty")
 var withDependencies = flag.Bool("with_dependencies", false, "download dependencies from Maven along with the sources")
 var destination = flag.String("dst", "", "directory to which the sources will be downloaded")
 var strict = flag.Bool("strict", false, "use strict mode")
-var sourceDownloader = flag.String("source_downloader", gitSystem, "source downloader mode to use [git, git-system]")
+var sourceDownloader = flag.String("source_downloader", model.DownloaderGitSystem, "source downloader mode to use [git, git-system]")
+var submodules = flag.Bool("submodules", false, "check out the submodules recursively at the commits recorded in the sources")
+var depth = flag.Int("depth", 1, "number of commits to fetch")
+var shallowSince = flag.String("shallow_since", "", "fetch the commits since the date (YYYY-MM-DD or RFC 3339) instead of --depth")
+var shallowExclude = flag.String("shallow_exclude", "", "fetch the commits not reachable from the reference instead of --depth")
+var fullHistory = flag.Bool("full_history", false, "fetch the complete history instead of --depth")
+var lfs = flag.Bool("lfs", false, "download the Git LFS objects of the sources")
+var lfsInclude = flag.String("lfs_include", "", "comma-separated .gitignore-style patterns of the paths to download the LFS objects for, all if empty")
+var lfsExclude = flag.String("lfs_exclude", "", "comma-separated .gitignore-style patterns of the paths not to download the LFS objects for")
+var lfsMaxSize = flag.Int64("lfs_max_size", 0, "size in bytes of the largest LFS object to download, unlimited if 0")
+var sharedStore = flag.Bool("shared_store", false, "check out the sources of the same origin from a single shared repository")
+var cacheDir = flag.String("cache_dir", "", "directory of the mirrors of the origins reused across the runs, no cache if empty")
+var cacheMaxSize = flag.Int64("cache_max_size", 0, "size in bytes above which the least recently used mirrors are evicted from the cache, unlimited if 0")
+var cacheMaxAge = flag.Duration("cache_max_age", 0, "time after which the unused mirrors are evicted from the cache, e.g. 720h, unlimited if 0")
+var verify = flag.String("verify", "checkout", "verification of the downloaded sources [none, checkout, objects]: checkout checks that HEAD is at the commit and there are no changes, objects additionally checks the fetched objects")
+var jobs = flag.Int("jobs", 16, "maximum number of sources downloaded at once")
+var hostJobs = flag.Int("host_jobs", 8, "maximum number of sources downloaded at once from a single host, unlimited if 0")
+var hostLimits = flag.String("host_limits", "", "comma-separated host=N overrides of --host_jobs, e.g. github.com=4,git.example.com=16")
+var dependencyJobs = flag.Int("dependency_jobs", 2, "maximum number of sources whose dependencies are downloaded at once")
+var attempts = flag.Int("attempts", 3, "maximum number of attempts to download a source, only the network and remote failures are retried")
+var retryDelay = flag.Duration("retry_delay", 2*time.Second, "backoff after the first failed attempt, doubled after each next one")
+var retryMaxDelay = flag.Duration("retry_max_delay", time.Minute, "maximum backoff between the attempts, unlimited if 0")
+var timeout = flag.Duration("timeout", 0, "maximum duration of the run, after which the downloads are stopped, unlimited if 0")
+var sourceTimeout = flag.Duration("source_timeout", 0, "maximum duration of the download of a single source including the retries, and separately of its dependencies, unlimited if 0")
+var keepFailed = flag.Bool("keep_failed", false, "keep the staging directories of the failed sources in <dst>/.sourcerer-staging for debugging")
+var reportJSON = flag.String("report_json", "", "file to write the report of the run to in the JSON format")
+var reportJUnit = flag.String("report_junit", "", "file to write the report of the run to in the JUnit XML format")
+var showProgress = flag.Bool("progress", true, "show the progress of the run, in a status line on a terminal and logged every --progress_interval otherwise")
+var progressInterval = flag.Duration("progress_interval", 30*time.Second, "interval of logging the progress when the output is not a terminal")
+var metricsAddr = flag.String("metrics_addr", "", "address to serve the Prometheus metrics on at /metrics during the run, e.g. :9090, not served if empty")
+var metricsTextfile = flag.String("metrics_textfile", "", "file to write the Prometheus metrics to every --metrics_interval, e.g. for the textfile collector of the node exporter")
+var metricsInterval = flag.Duration("metrics_interval", 15*time.Second, "interval of writing the metrics to --metrics_textfile")
+var events = flag.String("events", "", "file to write the events of the downloads to as JSON lines, - writes to the standard output, not written if empty")
+var sourceHook = flag.String("source_hook", "", "shell command run in the directory of every downloaded source, with the source described in the SOURCERER_* environment variables")
+var dependenciesHook = flag.String("dependencies_hook", "", "shell command run in the directory of every source after its dependencies are downloaded")
+var hookTimeout = flag.Duration("hook_timeout", 10*time.Minute, "maximum duration of a single run of a hook, unlimited if 0")
+var dedupWindow = flag.Int("dedup_window", 1000000, "number of most recent sources remembered to skip duplicates")
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == validateCommand {
+		os.Exit(validate(os.Args[2:]))
+	}
+	os.Exit(run())
+}
+
+// run downloads the sources set by the flags and returns the exit code, so that the deferred functions, e.g. closing
+// the events file, run before the exit.
+func run() int {
 	flag.Parse()
+	rand.Seed(time.Now().UnixNano())
 
 	if *input == "" {
 		log.Errorf("Input is missing, please use --input flag to provide the input")
 		flag.Usage()
-		os.Exit(1)
+		return 1
 	}
 
+	format, err := getInputFormat(*inputFormat)
+	if err != nil {
+		log.Errorf("%v", err)
+		flag.Usage()
+		return 1
+	}
 	log.Infof("Reading sources from: %s", *input)
-	sources := ReadList(*input)
+	sources, err := manifest.Open(*input, format)
+	if err != nil {
+		log.Errorf("Error while reading input: %v", err)
+		return 1
+	}
+	defer sources.Close()
 
 	if *destination == "" {
 		usr, _ := os.UserHomeDir()
 		*destination = filepath.Join(usr, "downloaded-sources")
 	}
 
-	sourceDownloaderType := getSourceDownloaderType(*sourceDownloader)
+	history, err := getHistory()
+	if err != nil {
+		log.Errorf("%v", err)
+		flag.Usage()
+		return 1
+	}
+
+	verification, err := getVerificationType(*verify)
+	if err != nil {
+		log.Errorf("%v", err)
+		flag.Usage()
+		return 1
+	}
+
+	// The zero values of the numbers of the jobs and the attempts would take the defaults of the client.
+	if *jobs < 1 {
+		log.Errorf("invalid number of jobs: %d", *jobs)
+		flag.Usage()
+		return 1
+	}
+	if *dependencyJobs < 1 {
+		log.Errorf("invalid number of dependency jobs: %d", *dependencyJobs)
+		flag.Usage()
+		return 1
+	}
+	if *attempts < 1 {
+		log.Errorf("invalid number of attempts: %d", *attempts)
+		flag.Usage()
+		return 1
+	}
+	limits, err := getHostLimits()
+	if err != nil {
+		log.Errorf("%v", err)
+		flag.Usage()
+		return 1
+	}
+
+	lfsOptions := model.LFSOptions{
+		Enabled: *lfs,
+		Include: splitList(*lfsInclude),
+		Exclude: splitList(*lfsExclude),
+		MaxSize: *lfsMaxSize,
+	}
+
+	var cache *source.Cache
+	if *cacheDir != "" {
+		cache = source.NewCache(*cacheDir, *cacheMaxSize, *cacheMaxAge)
+	}
+
+	if *progressInterval <= 0 {
+		log.Errorf("invalid progress interval: %s", *progressInterval)
+		flag.Usage()
+		return 1
+	}
+	var progress *downloader.Progress
+	if *showProgress {
+		progress = downloader.NewProgress()
+		// The entries of a regular file are counted in the background, not to delay the first downloads on a large
+		// input, so that the estimated time left is shown once they are. The errors are reported when the entries are
+		// read.
+		if info, err := os.Stat(*input); *input != manifest.Stdin && err == nil && info.Mode().IsRegular() {
+			go func() {
+				if n, err := manifest.Count(*input, format); err == nil {
+					progress.SetTotal(n)
+				}
+			}()
+		}
+	}
+
+	if *metricsInterval <= 0 {
+		log.Errorf("invalid metrics interval: %s", *metricsInterval)
+		flag.Usage()
+		return 1
+	}
+	var metrics *downloader.Metrics
+	if *metricsAddr != "" || *metricsTextfile != "" {
+		metrics = downloader.NewMetrics()
+	}
+
+	eventWriter, closeEvents, err := openEvents(*events)
+	if err != nil {
+		log.Errorf("%v", err)
+		return 1
+	}
+	defer closeEvents()
+	var eventHandler downloader.EventHandler
+	if eventWriter != nil {
+		eventHandler = eventWriter
+	}
+
+	started := time.Now()
+	reports, err := openReports(started)
+	if err != nil {
+		log.Errorf("%v", err)
+		return 1
+	}
+	var resultHandler downloader.ResultHandler
+	if len(reports) > 0 {
+		resultHandler = downloader.ResultHandlerFunc(func(r downloader.Result) {
+			for _, report := range reports {
+				report.HandleResult(r)
+			}
+		})
+	}
 
-	downloader := New(sources, *destination, sourceDownloaderType, *withDependencies, *strict)
+	client, err := downloader.New(downloader.Options{
+		Dir:              *destination,
+		Downloader:       downloader.SourceDownloaderTypeOf(*sourceDownloader),
+		WithDependencies: *withDependencies,
+		Strict:           *strict,
+		DedupWindow:      *dedupWindow,
+		Submodules:       *submodules,
+		History:          history,
+		LFS:              lfsOptions,
+		SharedStore:      *sharedStore,
+		Cache:            cache,
+		Verification:     verification,
+		Jobs:             *jobs,
+		DependencyJobs:   *dependencyJobs,
+		HostJobs:         *hostJobs,
+		HostLimits:       limits,
+		Attempts:         *attempts,
+		RetryDelay:       *retryDelay,
+		RetryMaxDelay:    *retryMaxDelay,
+		SourceTimeout:    *sourceTimeout,
+		KeepFailed:       *keepFailed,
+		MeasureSize:      *reportJSON != "" || *reportJUnit != "",
+		Progress:         progress,
+		Metrics:          metrics,
+		Events:           eventHandler,
+		Results:          resultHandler,
+		SourceHook:       *sourceHook,
+		DependenciesHook: *dependenciesHook,
+		HookTimeout:      *hookTimeout,
+	})
+	if err != nil {
+		closeReports(reports)
+		log.Errorf("%v", err)
+		flag.Usage()
+		return 1
+	}
+	stopMetrics, err := downloader.ExportMetrics(metrics, *metricsAddr, *metricsTextfile, *metricsInterval)
+	if err != nil {
+		closeReports(reports)
+		log.Errorf("%v", err)
+		return 1
+	}
 
-	err := downloader.GetSources()
+	ctx, stop := interruptible(context.Background())
+	defer stop()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	err = withProgress(ctx, progress, func() error {
+		return client.DownloadSources(ctx, sources)
+	})
+	stopMetrics()
+	if eventWriter != nil {
+		if eerr := eventWriter.Err(); eerr != nil {
+			log.Errorf("Error while writing the events: %v", eerr)
+		}
+	}
+	// The report is written even if the run is aborted.
+	if rerr := closeReports(reports); rerr != nil {
+		log.Errorf("Error while writing the report: %v", rerr)
+		if err == nil {
+			err = rerr
+		}
+	}
 	if err != nil {
 		log.Errorf("Error while downloading sources: %v", err)
-		os.Exit(1)
+		return 1
+	}
+	return 0
+}
+
+// withProgress runs the function while displaying the progress, if any.
+func withProgress(ctx context.Context, p *downloader.Progress, run func() error) error {
+	if p == nil {
+		return run()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		out := os.Stdout
+		if *events == "-" {
+			// The standard output is taken by the events.
+			out = os.Stderr
+		}
+		p.Display(ctx, out, *progressInterval)
+	}()
+	err := run()
+	cancel()
+	<-done
+	return err
+}
+
+// openEvents opens the file to write the events to, the standard output if the name is -.
+// The writer is nil if the name is empty.
+func openEvents(name string) (*downloader.JSONEventWriter, func(), error) {
+	switch name {
+	case "":
+		return nil, func() {}, nil
+	case "-":
+		return downloader.NewJSONEventWriter(os.Stdout), func() {}, nil
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "cannot create the events file")
+	}
+	return downloader.NewJSONEventWriter(f), func() {
+		if err := f.Close(); err != nil {
+			log.Errorf("Error while closing the events file: %v", err)
+		}
+	}, nil
+}
+
+// reportWriter writes a report of the run as the sources are finished.
+type reportWriter interface {
+	downloader.ResultHandler
+	Close() error
+}
+
+// openReports creates the writers of the reports of the run requested by the flags.
+func openReports(started time.Time) ([]reportWriter, error) {
+	var reports []reportWriter
+	if *reportJSON != "" {
+		w, err := downloader.NewJSONReportWriter(*reportJSON, started)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, w)
+	}
+	if *reportJUnit != "" {
+		w, err := downloader.NewJUnitReportWriter(*reportJUnit, started)
+		if err != nil {
+			closeReports(reports)
+			return nil, err
+		}
+		reports = append(reports, w)
 	}
+	return reports, nil
 }
 
-func getSourceDownloaderType(s string) SourceDownloaderType {
+// closeReports writes the reports to their files, returning the first error.
+func closeReports(reports []reportWriter) error {
+	var err error
+	for _, report := range reports {
+		if cerr := report.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// interruptible returns the context done on the first SIGINT or SIGTERM, so that the downloads are stopped cleanly.
+// The next signal terminates the process.
+func interruptible(parent context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(parent)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Warnf("Received %s, stopping the downloads, repeat to exit immediately", sig)
+			signal.Stop(signals)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(signals)
+		cancel()
+	}
+}
+
+func getInputFormat(s string) (*manifest.Format, error) {
+	var format manifest.Format
 	switch s {
-	case git:
-		return GitDirect
-	case gitSystem:
-		return GitSystem
+	case "":
+		return nil, nil
+	case "lines":
+		format = manifest.Lines
+	case "json":
+		format = manifest.JSON
+	case "yaml":
+		format = manifest.YAML
 	default:
-		return GitSystem
+		return nil, errors.Errorf("unsupported input format: %s", s)
+	}
+	return &format, nil
+}
+
+func getVerificationType(s string) (downloader.VerificationType, error) {
+	switch s {
+	case "none":
+		return downloader.VerifyNone, nil
+	case "checkout":
+		return downloader.VerifyCheckout, nil
+	case "objects":
+		return downloader.VerifyObjects, nil
+	default:
+		return downloader.VerifyNone, errors.Errorf("unsupported verification: %s", s)
+	}
+}
+
+// getHostLimits returns the limits of the hosts set by the flags.
+func getHostLimits() (map[string]int, error) {
+	limits := make(map[string]int)
+	for _, e := range splitList(*hostLimits) {
+		sep := strings.LastIndexByte(e, '=')
+		if sep < 0 {
+			return nil, errors.Errorf("invalid host limit %q, expected host=N", e)
+		}
+		limit, err := strconv.Atoi(e[sep+1:])
+		if err != nil || limit < 0 {
+			return nil, errors.Errorf("invalid host limit %q, expected host=N", e)
+		}
+		limits[e[:sep]] = limit
+	}
+	return limits, nil
+}
+
+// getHistory returns the part of the history to fetch set by the flags. The shallow-since, shallow-exclude
+// and full history flags take precedence over the depth.
+func getHistory() (model.History, error) {
+	history := model.History{Exclude: *shallowExclude, Full: *fullHistory}
+	if *shallowSince != "" {
+		since, err := model.ParseDate(*shallowSince)
+		if err != nil {
+			return history, err
+		}
+		history.Since = since
+	}
+	if history.IsZero() {
+		history.Depth = *depth
+	}
+	if err := history.Validate(); err != nil {
+		return history, err
+	}
+	if history.IsZero() {
+		return history, errors.Errorf("invalid depth: %d", *depth)
+	}
+	return history, nil
+}
+
+// splitList splits the comma-separated list, skipping empty elements.
+func splitList(s string) []string {
+	var list []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			list = append(list, e)
+		}
 	}
+	return list
 }
@@ -0,0 +1,471 @@
+package manifest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	fieldOrigin         = "origin"
+	fieldRevision       = "revision"
+	fieldDownloader     = "downloader"
+	fieldDepth          = "depth"
+	fieldShallowSince   = "shallow_since"
+	fieldShallowExclude = "shallow_exclude"
+	fieldDestination    = "destination"
+	fieldPaths          = "paths"
+	sourcesKey          = "sources"
+
+	maxLineLength = 1024 * 1024
+)
+
+// Position is a 1-based line and column in the manifest.
+type Position struct {
+	Line   int
+	Column int
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
+
+// SyntaxError is a problem in the manifest that stops the decoding.
+type SyntaxError struct {
+	Position Position
+	Message  string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Position, e.Message)
+}
+
+// entryDecoder decodes the manifest entry by entry. The problems of an entry are returned as diagnostics,
+// along with the entry if it could be decoded; an error is returned when the decoding cannot continue, io.EOF at the end of the input.
+type entryDecoder interface {
+	next() (*Entry, []Diagnostic, error)
+}
+
+func newEntryDecoder(r io.Reader, format Format) entryDecoder {
+	switch format {
+	case JSON:
+		return newJSONDecoder(r)
+	case YAML:
+		return &yamlDecoder{r: r}
+	default:
+		return newLineDecoder(r)
+	}
+}
+
+type lineDecoder struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func newLineDecoder(r io.Reader) *lineDecoder {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineLength)
+	return &lineDecoder{scanner: scanner}
+}
+
+func (d *lineDecoder) next() (*Entry, []Diagnostic, error) {
+	for d.scanner.Scan() {
+		d.line++
+		e, diag := decodeLine(d.scanner.Text(), d.line)
+		if diag != nil {
+			return nil, []Diagnostic{*diag}, nil
+		}
+		if e != nil {
+			return e, nil, nil
+		}
+	}
+	if err := d.scanner.Err(); err != nil {
+		return nil, nil, errors.Wrapf(err, "cannot read line %d", d.line+1)
+	}
+	return nil, nil, io.EOF
+}
+
+// decodeLine decodes a single "<origin> <revision>" line. Both the entry and the diagnostic are nil for blank lines and comments.
+func decodeLine(line string, lineNo int) (*Entry, *Diagnostic) {
+	fields, columns := splitLine(line)
+	switch len(fields) {
+	case 0:
+		return nil, nil
+	case 1:
+		diag := errorf(Position{Line: lineNo, Column: columns[0] + len(fields[0])}, "missing revision for %s", fields[0])
+		return nil, &diag
+	case 2:
+	default:
+		diag := errorf(Position{Line: lineNo, Column: columns[2]}, "unexpected %q, expected '<origin> <revision>'", fields[2])
+		return nil, &diag
+	}
+	pos := Position{Line: lineNo, Column: columns[0]}
+	return &Entry{
+		Origin:   fields[0],
+		Revision: fields[1],
+		pos:      pos,
+		fieldPos: map[string]Position{
+			fieldOrigin:   pos,
+			fieldRevision: {Line: lineNo, Column: columns[1]},
+		},
+	}, nil
+}
+
+// splitLine returns the whitespace-separated fields of the line along with their 1-based columns.
+// Everything after a '#' that starts a field is a comment.
+func splitLine(line string) ([]string, []int) {
+	var fields []string
+	var columns []int
+	start := -1
+	for i := 0; i <= len(line); i++ {
+		if i < len(line) && !isSpace(line[i]) {
+			if start < 0 {
+				if line[i] == '#' {
+					break
+				}
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			fields = append(fields, line[start:i])
+			columns = append(columns, start+1)
+			start = -1
+		}
+	}
+	if start >= 0 {
+		fields = append(fields, line[start:])
+		columns = append(columns, start+1)
+	}
+	return fields, columns
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r'
+}
+
+type jsonState int
+
+const (
+	jsonStart jsonState = iota
+	jsonObject
+	jsonSources
+	jsonDone
+)
+
+// jsonDecoder decodes the entries of the "sources" list one by one, without reading the whole manifest.
+type jsonDecoder struct {
+	dec   *json.Decoder
+	lines *lineTracker
+	state jsonState
+}
+
+func newJSONDecoder(r io.Reader) *jsonDecoder {
+	lines := &lineTracker{r: r}
+	return &jsonDecoder{dec: json.NewDecoder(lines), lines: lines}
+}
+
+func (d *jsonDecoder) next() (*Entry, []Diagnostic, error) {
+	for {
+		switch d.state {
+		case jsonStart:
+			if err := d.expectDelim('{'); err != nil {
+				return nil, nil, err
+			}
+			d.state = jsonObject
+		case jsonObject:
+			if !d.dec.More() {
+				if _, err := d.dec.Token(); err != nil {
+					return nil, nil, d.syntaxError(err)
+				}
+				d.state = jsonDone
+				continue
+			}
+			tok, err := d.dec.Token()
+			if err != nil {
+				return nil, nil, d.syntaxError(err)
+			}
+			if key, _ := tok.(string); key == sourcesKey {
+				if err := d.expectDelim('['); err != nil {
+					return nil, nil, err
+				}
+				d.state = jsonSources
+				continue
+			}
+			var skip json.RawMessage
+			if err := d.dec.Decode(&skip); err != nil {
+				return nil, nil, d.syntaxError(err)
+			}
+			pos := d.lines.position(d.dec.InputOffset() - int64(len(skip)))
+			return nil, []Diagnostic{errorf(pos, "unknown field %q", tok)}, nil
+		case jsonSources:
+			if !d.dec.More() {
+				if _, err := d.dec.Token(); err != nil {
+					return nil, nil, d.syntaxError(err)
+				}
+				d.state = jsonObject
+				continue
+			}
+			var raw json.RawMessage
+			if err := d.dec.Decode(&raw); err != nil {
+				return nil, nil, d.syntaxError(err)
+			}
+			e, diags := d.decodeEntry(raw, d.dec.InputOffset()-int64(len(raw)))
+			return e, diags, nil
+		default:
+			return nil, nil, io.EOF
+		}
+	}
+}
+
+// decodeEntry decodes the entry found at the offset of the manifest, recording the positions of its fields.
+func (d *jsonDecoder) decodeEntry(raw json.RawMessage, offset int64) (*Entry, []Diagnostic) {
+	pos := d.lines.position(offset)
+	if len(raw) == 0 || raw[0] != '{' {
+		return nil, []Diagnostic{errorf(pos, "invalid entry: expected an object")}
+	}
+	var diags []Diagnostic
+	fieldPos := make(map[string]Position)
+	for _, f := range jsonFields(raw) {
+		// The positions are queried in the order of the offsets, as the line tracker requires.
+		keyPos := d.lines.position(offset + f.key)
+		if !knownFields[f.name] {
+			diags = append(diags, errorf(keyPos, "unknown field %q", f.name))
+		}
+		fieldPos[f.name] = d.lines.position(offset + f.value)
+	}
+	e := &Entry{}
+	if err := json.Unmarshal(raw, e); err != nil {
+		errPos := pos
+		if terr, ok := err.(*json.UnmarshalTypeError); ok {
+			if p, ok := fieldPos[terr.Field]; ok {
+				errPos = p
+			}
+		}
+		return nil, append(diags, errorf(errPos, "invalid entry: %v", err))
+	}
+	e.pos = pos
+	e.fieldPos = fieldPos
+	return e, diags
+}
+
+// jsonField is a field of a JSON object with the offsets of its key and its value in the object.
+type jsonField struct {
+	name  string
+	key   int64
+	value int64
+}
+
+// jsonFields returns the fields of the valid JSON object in their order.
+func jsonFields(object json.RawMessage) []jsonField {
+	dec := json.NewDecoder(bytes.NewReader(object))
+	if _, err := dec.Token(); err != nil {
+		return nil
+	}
+	var fields []jsonField
+	for dec.More() {
+		end := dec.InputOffset()
+		tok, err := dec.Token()
+		if err != nil {
+			return fields
+		}
+		name, _ := tok.(string)
+		key := end + int64(bytes.IndexByte(object[end:], '"'))
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return fields
+		}
+		fields = append(fields, jsonField{name: name, key: key, value: dec.InputOffset() - int64(len(value))})
+	}
+	return fields
+}
+
+func (d *jsonDecoder) expectDelim(delim json.Delim) error {
+	tok, err := d.dec.Token()
+	if err != nil {
+		return d.syntaxError(err)
+	}
+	if dl, ok := tok.(json.Delim); !ok || dl != delim {
+		return d.syntaxError(errors.Errorf("expected %q, found %v", delim, tok))
+	}
+	return nil
+}
+
+func (d *jsonDecoder) syntaxError(err error) error {
+	offset := d.dec.InputOffset()
+	if serr, ok := err.(*json.SyntaxError); ok {
+		offset = serr.Offset
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return &SyntaxError{Position: d.lines.position(offset), Message: fmt.Sprintf("invalid JSON manifest: %v", err)}
+}
+
+// lineTracker converts byte offsets of a stream into positions. Offsets have to be queried in an increasing order;
+// only the line breaks that have been read but not yet passed are kept in memory.
+type lineTracker struct {
+	r         io.Reader
+	read      int64
+	breaks    []int64
+	line      int
+	lineStart int64
+}
+
+func (t *lineTracker) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	for i := 0; i < n; i++ {
+		if p[i] == '\n' {
+			t.breaks = append(t.breaks, t.read+int64(i))
+		}
+	}
+	t.read += int64(n)
+	return n, err
+}
+
+func (t *lineTracker) position(offset int64) Position {
+	for len(t.breaks) > 0 && t.breaks[0] < offset {
+		t.line++
+		t.lineStart = t.breaks[0] + 1
+		t.breaks = t.breaks[1:]
+	}
+	return Position{Line: t.line + 1, Column: int(offset-t.lineStart) + 1}
+}
+
+// yamlDecoder reads the whole YAML manifest on the first call, as YAML documents cannot be decoded partially.
+type yamlDecoder struct {
+	r       io.Reader
+	decoded bool
+	items   []yamlItem
+}
+
+type yamlItem struct {
+	entry *Entry
+	diags []Diagnostic
+}
+
+func (d *yamlDecoder) next() (*Entry, []Diagnostic, error) {
+	if !d.decoded {
+		d.decoded = true
+		content, err := ioutil.ReadAll(d.r)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "cannot read the manifest")
+		}
+		d.items, err = decodeYAML(content)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(d.items) == 0 {
+		return nil, nil, io.EOF
+	}
+	item := d.items[0]
+	d.items = d.items[1:]
+	return item.entry, item.diags, nil
+}
+
+func decodeYAML(content []byte) ([]yamlItem, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(content, &root); err != nil {
+		pos := Position{Line: 1, Column: 1}
+		fmt.Sscanf(err.Error(), "yaml: line %d:", &pos.Line)
+		return nil, &SyntaxError{Position: pos, Message: fmt.Sprintf("invalid YAML manifest: %v", err)}
+	}
+	if len(root.Content) == 0 {
+		return nil, nil
+	}
+	doc := root.Content[0]
+	if doc.Kind != yaml.MappingNode {
+		return nil, &SyntaxError{Position: nodePosition(doc), Message: fmt.Sprintf("invalid YAML manifest: expected a mapping with %q", sourcesKey)}
+	}
+
+	var items []yamlItem
+	for i := 0; i+1 < len(doc.Content); i += 2 {
+		key, value := doc.Content[i], doc.Content[i+1]
+		if key.Value != sourcesKey {
+			items = append(items, yamlItem{diags: []Diagnostic{errorf(nodePosition(key), "unknown field %q", key.Value)}})
+			continue
+		}
+		if value.Kind != yaml.SequenceNode {
+			items = append(items, yamlItem{diags: []Diagnostic{errorf(nodePosition(value), "%q must be a list", sourcesKey)}})
+			continue
+		}
+		for _, node := range value.Content {
+			e, diags := decodeYAMLEntry(node)
+			items = append(items, yamlItem{entry: e, diags: diags})
+		}
+	}
+	return items, nil
+}
+
+func decodeYAMLEntry(node *yaml.Node) (*Entry, []Diagnostic) {
+	pos := nodePosition(node)
+	if node.Kind != yaml.MappingNode {
+		return nil, []Diagnostic{errorf(pos, "invalid entry: expected a mapping")}
+	}
+	var diags []Diagnostic
+	fieldPos := make(map[string]Position)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := node.Content[i]
+		if !knownFields[key.Value] {
+			diags = append(diags, errorf(nodePosition(key), "unknown field %q", key.Value))
+		}
+		fieldPos[key.Value] = nodePosition(node.Content[i+1])
+	}
+	e := &Entry{}
+	if err := node.Decode(e); err != nil {
+		return nil, append(diags, errorf(pos, "invalid entry: %v", err))
+	}
+	e.pos = pos
+	e.fieldPos = fieldPos
+	return e, diags
+}
+
+func nodePosition(node *yaml.Node) Position {
+	return Position{Line: node.Line, Column: node.Column}
+}
+
+var knownFields = map[string]bool{
+	fieldOrigin:         true,
+	fieldRevision:       true,
+	fieldDownloader:     true,
+	"with_dependencies": true,
+	fieldDepth:          true,
+	fieldShallowSince:   true,
+	fieldShallowExclude: true,
+	"full_history":      true,
+	"labels":            true,
+	fieldDestination:    true,
+	fieldPaths:          true,
+	"submodules":        true,
+	"lfs":               true,
+}
+
+// isComment returns true for blank lines and comments, which are skipped when detecting the format.
+func isComment(line []byte) bool {
+	line = bytes.TrimSpace(line)
+	return len(line) == 0 || line[0] == '#'
+}
+
+func trimLeadingComments(content []byte) []byte {
+	for len(content) > 0 {
+		i := bytes.IndexByte(content, '\n')
+		if i < 0 {
+			if isComment(content) {
+				return nil
+			}
+			return content
+		}
+		if !isComment(content[:i]) {
+			break
+		}
+		content = content[i+1:]
+	}
+	return bytes.TrimSpace(content)
+}
@@ -0,0 +1,214 @@
+package manifest
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+const testHash = "edb545b434a8cfd46b8651d7041aa87e85503004"
+
+func decodeAll(t *testing.T, content string, format Format) ([]*Entry, []Diagnostic) {
+	t.Helper()
+	dec := newEntryDecoder(strings.NewReader(content), format)
+	var entries []*Entry
+	var diags []Diagnostic
+	for {
+		e, entryDiags, err := dec.next()
+		if err == io.EOF {
+			return entries, diags
+		}
+		if err != nil {
+			t.Fatalf("decoding failed: %v", err)
+		}
+		diags = append(diags, entryDiags...)
+		if e != nil {
+			entries = append(entries, e)
+		}
+	}
+}
+
+func TestDecodePositions(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  Format
+		content string
+		// want are the positions of the fields of the entries, in order.
+		want []map[string]Position
+	}{
+		{
+			name:   "lines",
+			format: Lines,
+			content: "# comment\n" +
+				"\n" +
+				"https://host/org/a " + testHash + "\n" +
+				"  git@host:org/b.git\tmaster # trailing\n",
+			want: []map[string]Position{
+				{fieldOrigin: {3, 1}, fieldRevision: {3, 20}},
+				{fieldOrigin: {4, 3}, fieldRevision: {4, 22}},
+			},
+		},
+		{
+			name:   "json",
+			format: JSON,
+			content: "{\n" +
+				"  \"sources\": [\n" +
+				"    {\"origin\": \"https://host/org/a\", \"revision\": \"" + testHash + "\"},\n" +
+				"    {\n" +
+				"      \"origin\": \"git@host:org/b.git\",\n" +
+				"      \"revision\": \"master\",\n" +
+				"      \"depth\": 3\n" +
+				"    }\n" +
+				"  ]\n" +
+				"}\n",
+			want: []map[string]Position{
+				{fieldOrigin: {3, 16}, fieldRevision: {3, 50}},
+				{fieldOrigin: {5, 17}, fieldRevision: {6, 19}, fieldDepth: {7, 16}},
+			},
+		},
+		{
+			name:   "yaml",
+			format: YAML,
+			content: "sources:\n" +
+				"  - origin: https://host/org/a\n" +
+				"    revision: " + testHash + "\n" +
+				"  - origin: git@host:org/b.git\n" +
+				"    revision: master\n" +
+				"    depth: 3\n",
+			want: []map[string]Position{
+				{fieldOrigin: {2, 13}, fieldRevision: {3, 15}},
+				{fieldOrigin: {4, 13}, fieldRevision: {5, 15}, fieldDepth: {6, 12}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, diags := decodeAll(t, tt.content, tt.format)
+			if len(diags) > 0 {
+				t.Fatalf("unexpected diagnostics: %v", diags)
+			}
+			if len(entries) != len(tt.want) {
+				t.Fatalf("got %d entries, want %d", len(entries), len(tt.want))
+			}
+			for i, e := range entries {
+				for field, want := range tt.want[i] {
+					if got := e.position(field); got != want {
+						t.Errorf("entry %d: position of %s = %s, want %s", i, field, got, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeDiagnostics(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  Format
+		content string
+		want    []string
+	}{
+		{
+			name:    "lines",
+			format:  Lines,
+			content: "https://host/org/a\nhttps://host/org/b master extra\n",
+			want:    []string{"1:19: error: missing revision", "2:27: error: unexpected \"extra\""},
+		},
+		{
+			name:   "json",
+			format: JSON,
+			content: "{\"sources\": [\n" +
+				"  {\"origin\": \"https://host/org/a\", \"revison\": \"master\"},\n" +
+				"  {\"origin\": \"https://host/org/b\",\n" +
+				"   \"depth\": \"deep\"},\n" +
+				"  \"https://host/org/c\"\n" +
+				"], \"other\": 1}\n",
+			want: []string{
+				"2:36: error: unknown field \"revison\"",
+				"4:13: error: invalid entry",
+				"5:3: error: invalid entry: expected an object",
+				"6:13: error: unknown field \"other\"",
+			},
+		},
+		{
+			name:   "yaml",
+			format: YAML,
+			content: "sources:\n" +
+				"  - origin: https://host/org/a\n" +
+				"    revison: master\n" +
+				"  - just a string\n",
+			want: []string{"3:5: error: unknown field \"revison\"", "4:5: error: invalid entry: expected a mapping"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, diags := decodeAll(t, tt.content, tt.format)
+			if len(diags) != len(tt.want) {
+				t.Fatalf("got diagnostics %v, want %v", diags, tt.want)
+			}
+			for i, d := range diags {
+				if !strings.HasPrefix(d.String(), tt.want[i]) {
+					t.Errorf("diagnostic %d = %q, want prefix %q", i, d, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeSyntaxError(t *testing.T) {
+	tests := []struct {
+		format  Format
+		content string
+		want    Position
+	}{
+		{JSON, "{\"sources\": [\n  {\"origin\": }\n]}", Position{2, 14}},
+		{YAML, "sources:\n  - origin: [\n", Position{2, 1}},
+	}
+	for _, tt := range tests {
+		dec := newEntryDecoder(strings.NewReader(tt.content), tt.format)
+		var err error
+		for err == nil {
+			_, _, err = dec.next()
+		}
+		serr, ok := err.(*SyntaxError)
+		if !ok {
+			t.Errorf("%s: got %v, want a syntax error", tt.format, err)
+			continue
+		}
+		if serr.Position.Line != tt.want.Line {
+			t.Errorf("%s: syntax error at %s, want line %d", tt.format, serr.Position, tt.want.Line)
+		}
+	}
+}
+
+func TestParseLFS(t *testing.T) {
+	tests := []struct {
+		content string
+		want    *bool
+	}{
+		{"sources:\n  - origin: https://host/org/a\n    revision: master\n", nil},
+		{"sources:\n  - origin: https://host/org/a\n    revision: master\n    lfs: true\n", boolPtr(true)},
+		{`{"sources": [{"origin": "https://host/org/a", "revision": "master", "lfs": false}]}`, boolPtr(false)},
+	}
+	for _, tt := range tests {
+		format := YAML
+		if strings.HasPrefix(tt.content, "{") {
+			format = JSON
+		}
+		sources, err := Parse([]byte(tt.content), format)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", tt.content, err)
+		}
+		lfs := sources[0].Options.LFS
+		switch {
+		case tt.want == nil && lfs != nil:
+			t.Errorf("Parse(%q): LFS = %+v, want nil", tt.content, *lfs)
+		case tt.want != nil && (lfs == nil || lfs.Enabled != *tt.want):
+			t.Errorf("Parse(%q): LFS = %+v, want enabled %v", tt.content, lfs, *tt.want)
+		}
+	}
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
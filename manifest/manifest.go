@@ -0,0 +1,191 @@
+package manifest
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+
+	"github.com/arekziobrowski/sourcerer/model"
+	"github.com/pkg/errors"
+)
+
+type Format int
+
+const (
+	// Lines is the plain format with one "<origin> <revision>" entry per line.
+	Lines Format = iota
+	JSON
+	YAML
+)
+
+func (f Format) String() string {
+	switch f {
+	case JSON:
+		return "json"
+	case YAML:
+		return "yaml"
+	default:
+		return "lines"
+	}
+}
+
+// Entry is a single source definition of a manifest. The plain format only sets the Origin and the Revision.
+type Entry struct {
+	Origin           string            `json:"origin" yaml:"origin"`
+	Revision         string            `json:"revision" yaml:"revision"`
+	Downloader       string            `json:"downloader,omitempty" yaml:"downloader,omitempty"`
+	WithDependencies *bool             `json:"with_dependencies,omitempty" yaml:"with_dependencies,omitempty"`
+	Depth            int               `json:"depth,omitempty" yaml:"depth,omitempty"`
+	ShallowSince     string            `json:"shallow_since,omitempty" yaml:"shallow_since,omitempty"`
+	ShallowExclude   string            `json:"shallow_exclude,omitempty" yaml:"shallow_exclude,omitempty"`
+	FullHistory      bool              `json:"full_history,omitempty" yaml:"full_history,omitempty"`
+	Labels           map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+	Destination      string            `json:"destination,omitempty" yaml:"destination,omitempty"`
+	Paths            []string          `json:"paths,omitempty" yaml:"paths,omitempty"`
+	Submodules       *bool             `json:"submodules,omitempty" yaml:"submodules,omitempty"`
+	LFS              *bool             `json:"lfs,omitempty" yaml:"lfs,omitempty"`
+
+	pos      Position
+	fieldPos map[string]Position
+}
+
+// Read reads all the sources from the manifest file. The format is detected from the file extension or its contents.
+// Blank lines and comments are skipped; all invalid entries are reported together with their positions.
+func Read(filename string) ([]*model.Source, error) {
+	r, err := Open(filename, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	sources, diags, err := readAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := diagnosticsError(filename, diags); err != nil {
+		return nil, err
+	}
+	return sources, nil
+}
+
+// DetectFormat returns the manifest format based on the file extension, falling back to the contents.
+func DetectFormat(filename string, content []byte) Format {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		return JSON
+	case ".yaml", ".yml":
+		return YAML
+	case ".txt":
+		return Lines
+	}
+
+	trimmed := trimLeadingComments(content)
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("{")):
+		return JSON
+	case bytes.HasPrefix(trimmed, []byte("---")), bytes.HasPrefix(trimmed, []byte("sources:")):
+		return YAML
+	default:
+		return Lines
+	}
+}
+
+func Parse(content []byte, format Format) ([]*model.Source, error) {
+	sources, diags, err := readContent(content, format)
+	if err != nil {
+		return nil, err
+	}
+	if err := diagnosticsError("", diags); err != nil {
+		return nil, err
+	}
+	return sources, nil
+}
+
+// ToSource converts the entry to a source.
+func (e *Entry) ToSource() (*model.Source, error) {
+	src, diags := e.toSource()
+	if len(diags) > 0 {
+		return nil, errors.New(diags[0].Message)
+	}
+	return src, nil
+}
+
+// historyOption returns nil for the zero history, so that the global setting is used.
+func historyOption(h model.History) *model.History {
+	if h.IsZero() {
+		return nil
+	}
+	return &h
+}
+
+// Position returns the position of the entry in the manifest.
+func (e *Entry) Position() Position {
+	return e.pos
+}
+
+func (e *Entry) position(field string) Position {
+	if pos, ok := e.fieldPos[field]; ok {
+		return pos
+	}
+	return e.pos
+}
+
+func (e *Entry) toSource() (*model.Source, []Diagnostic) {
+	var diags []Diagnostic
+	origin, err := model.ParseOrigin(e.Origin)
+	if err == nil {
+		_, _, err = origin.NamespaceAndRepository()
+	}
+	if err != nil {
+		diags = append(diags, errorf(e.position(fieldOrigin), "invalid origin: %v", err))
+	}
+	if err := model.ValidateRevision(e.Revision); err != nil {
+		diags = append(diags, errorf(e.position(fieldRevision), "invalid revision: %v", err))
+	}
+	switch e.Downloader {
+	case "", model.DownloaderGit, model.DownloaderGitSystem:
+	default:
+		diags = append(diags, errorf(e.position(fieldDownloader), "unsupported downloader %q", e.Downloader))
+	}
+	history := model.History{Depth: e.Depth, Exclude: e.ShallowExclude, Full: e.FullHistory}
+	if e.ShallowSince != "" {
+		since, err := model.ParseDate(e.ShallowSince)
+		if err != nil {
+			diags = append(diags, errorf(e.position(fieldShallowSince), "invalid shallow_since: %v", err))
+		}
+		history.Since = since
+	}
+	if e.ShallowExclude != "" {
+		if err := model.ValidateRevision(e.ShallowExclude); err != nil {
+			diags = append(diags, errorf(e.position(fieldShallowExclude), "invalid shallow_exclude: %v", err))
+		}
+	}
+	if err := history.Validate(); err != nil {
+		diags = append(diags, errorf(e.position(fieldDepth), "%v", err))
+	}
+	for _, p := range e.Paths {
+		if strings.TrimSpace(p) == "" || strings.ContainsAny(p, "\n\r") {
+			diags = append(diags, errorf(e.position(fieldPaths), "invalid path pattern %q", p))
+		}
+	}
+	if len(diags) > 0 {
+		return nil, diags
+	}
+
+	src, err := model.NewSource(e.Origin, e.Revision)
+	if err != nil {
+		return nil, []Diagnostic{errorf(e.pos, "%v", err)}
+	}
+	src.Options = model.Options{
+		Downloader:       e.Downloader,
+		WithDependencies: e.WithDependencies,
+		History:          historyOption(history),
+		Labels:           e.Labels,
+		Destination:      e.Destination,
+		SparsePaths:      e.Paths,
+		Submodules:       e.Submodules,
+	}
+	if e.LFS != nil {
+		src.Options.LFS = &model.LFSOptions{Enabled: *e.LFS}
+	}
+	return src, nil
+}
@@ -0,0 +1,157 @@
+package manifest
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/arekziobrowski/sourcerer/model"
+	"github.com/pkg/errors"
+)
+
+// Stdin is the file name that makes Open read the manifest from the standard input.
+const Stdin = "-"
+
+const sniffSize = 4096
+
+// EntryError is returned by Reader.Next for an invalid entry. The reading can continue after it.
+type EntryError struct {
+	Filename string
+	// Origin and Revision are the values given in the entry, empty if missing or if the entry is not decoded.
+	Origin      string
+	Revision    string
+	Diagnostics []Diagnostic
+}
+
+func (e *EntryError) Error() string {
+	msgs := make([]string, 0, len(e.Diagnostics))
+	for _, d := range e.Diagnostics {
+		msgs = append(msgs, e.Filename+":"+d.String())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Reader reads the sources from a manifest one by one, so that arbitrarily large manifests
+// can be processed without reading them into memory first.
+type Reader struct {
+	filename string
+	decoder  entryDecoder
+	closer   io.Closer
+}
+
+// Open opens the manifest file, or the standard input for "-". The format is detected from the file extension
+// or from the beginning of the contents, unless a format is given.
+func Open(filename string, format *Format) (*Reader, error) {
+	var f *os.File
+	if filename == Stdin {
+		f = os.Stdin
+	} else {
+		var err error
+		f, err = os.Open(filename)
+		if err != nil {
+			return nil, errors.Wrap(err, "error while reading file")
+		}
+	}
+
+	br := bufio.NewReader(f)
+	if format == nil {
+		peeked, err := br.Peek(sniffSize)
+		if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+			f.Close()
+			return nil, errors.Wrap(err, "error while reading file")
+		}
+		detected := DetectFormat(filename, peeked)
+		format = &detected
+	}
+
+	r := NewReader(br, *format)
+	r.filename = filename
+	if f != os.Stdin {
+		r.closer = f
+	}
+	return r, nil
+}
+
+func NewReader(r io.Reader, format Format) *Reader {
+	return &Reader{decoder: newEntryDecoder(r, format)}
+}
+
+// Next returns the next source. It returns an *EntryError for an invalid entry and io.EOF at the end of the manifest.
+func (r *Reader) Next() (*model.Source, error) {
+	e, diags, err := r.decoder.next()
+	if err != nil {
+		if err != io.EOF && r.filename != "" {
+			err = errors.Wrap(err, r.filename)
+		}
+		return nil, err
+	}
+	entryErr := &EntryError{Filename: r.filename}
+	if e != nil {
+		src, entryDiags := e.toSource()
+		diags = append(diags, entryDiags...)
+		if len(diags) == 0 {
+			return src, nil
+		}
+		entryErr.Origin, entryErr.Revision = e.Origin, e.Revision
+	}
+	entryErr.Diagnostics = diags
+	return nil, entryErr
+}
+
+// Count returns the number of the entries of the manifest file, the invalid ones included, reading it through.
+// The entries after a syntax error are not counted. The standard input cannot be counted, as it can be read only once.
+func Count(filename string, format *Format) (int, error) {
+	if filename == Stdin {
+		return 0, errors.New("cannot count the entries of the standard input")
+	}
+	r, err := Open(filename, format)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	for n := 0; ; n++ {
+		if _, _, err := r.nextEntry(); err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+	}
+}
+
+// nextEntry returns the next entry without converting it to a source.
+func (r *Reader) nextEntry() (*Entry, []Diagnostic, error) {
+	return r.decoder.next()
+}
+
+func (r *Reader) Close() error {
+	if r.closer == nil {
+		return nil
+	}
+	return r.closer.Close()
+}
+
+// readAll reads all the sources, collecting the diagnostics of invalid entries.
+func readAll(r *Reader) ([]*model.Source, []Diagnostic, error) {
+	var sources []*model.Source
+	var diags []Diagnostic
+	for {
+		src, err := r.Next()
+		if err == io.EOF {
+			return sources, diags, nil
+		}
+		if entryErr, ok := err.(*EntryError); ok {
+			diags = append(diags, entryErr.Diagnostics...)
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		sources = append(sources, src)
+	}
+}
+
+func readContent(content []byte, format Format) ([]*model.Source, []Diagnostic, error) {
+	return readAll(NewReader(bytes.NewReader(content), format))
+}
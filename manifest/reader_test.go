@@ -0,0 +1,76 @@
+package manifest
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestCount(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		content  string
+		want     int
+		wantErr  bool
+	}{
+		{
+			name:     "lines",
+			filename: "sources.txt",
+			content:  "# comment\nhttps://github.com/org/a " + testHash + "\n\nhttps://github.com/org/b main\n",
+			want:     2,
+		},
+		{
+			name:     "invalid entries",
+			filename: "sources.txt",
+			content:  "https://github.com/org/a\nftp://host/org/b main\nhttps://github.com/org/c main\n",
+			want:     3,
+		},
+		{
+			name:     "json",
+			filename: "sources.json",
+			content:  `{"sources": [{"origin": "https://github.com/org/a", "revision": "main"}, {"origin": "https://github.com/org/b"}]}`,
+			want:     2,
+		},
+		{
+			name:     "yaml",
+			filename: "sources.yaml",
+			content:  "sources:\n  - origin: https://github.com/org/a\n    revision: main\n  - origin: https://github.com/org/b\n    revision: main\n",
+			want:     2,
+		},
+		{
+			name:     "empty",
+			filename: "sources.txt",
+		},
+		{
+			name:     "syntax error",
+			filename: "sources.json",
+			content:  `{"sources": [{"origin": "https://github.com/org/a", "revision": "main"}, {"origin": }]}`,
+			want:     1,
+			wantErr:  true,
+		},
+		{
+			name:     "stdin",
+			filename: Stdin,
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := tt.filename
+			if filename != Stdin {
+				filename = filepath.Join(t.TempDir(), tt.filename)
+				if err := ioutil.WriteFile(filename, []byte(tt.content), 0666); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := Count(filename, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Count = %d, %v, want an error: %v", got, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Count = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
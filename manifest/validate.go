@@ -0,0 +1,182 @@
+package manifest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/arekziobrowski/sourcerer/model"
+	"github.com/pkg/errors"
+)
+
+type Severity int
+
+const (
+	SeverityError Severity = iota
+	SeverityWarning
+)
+
+func (s Severity) String() string {
+	if s == SeverityWarning {
+		return "warning"
+	}
+	return "error"
+}
+
+// Diagnostic is a problem found in the manifest.
+type Diagnostic struct {
+	Position Position
+	Severity Severity
+	Message  string
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s: %s: %s", d.Position, d.Severity, d.Message)
+}
+
+func errorf(pos Position, format string, args ...interface{}) Diagnostic {
+	return Diagnostic{Position: pos, Severity: SeverityError, Message: fmt.Sprintf(format, args...)}
+}
+
+func warningf(pos Position, format string, args ...interface{}) Diagnostic {
+	return Diagnostic{Position: pos, Severity: SeverityWarning, Message: fmt.Sprintf(format, args...)}
+}
+
+// HasErrors returns true if any of the diagnostics is an error.
+func HasErrors(diags []Diagnostic) bool {
+	for _, d := range diags {
+		if d.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+func diagnosticsError(filename string, diags []Diagnostic) error {
+	var msgs []string
+	for _, d := range diags {
+		if d.Severity != SeverityError {
+			continue
+		}
+		if filename != "" {
+			msgs = append(msgs, filename+":"+d.String())
+		} else {
+			msgs = append(msgs, d.String())
+		}
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	return errors.Errorf("invalid manifest:\n%s", strings.Join(msgs, "\n"))
+}
+
+type ValidateOptions struct {
+	// Hosts are the supported Git hosts. Any host is supported if empty.
+	Hosts []string
+	// RejectMultipleRevisions reports the same repository pinned to different revisions as an error. The revisions
+	// are downloaded into different directories, so they are only reported when they collide otherwise.
+	RejectMultipleRevisions bool
+}
+
+// Validate parses the whole manifest file and reports every problem found in it.
+func Validate(filename string, opts ValidateOptions) ([]Diagnostic, error) {
+	r, err := Open(filename, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return validate(r, opts)
+}
+
+func ValidateContent(content []byte, format Format, opts ValidateOptions) ([]Diagnostic, error) {
+	return validate(NewReader(bytes.NewReader(content), format), opts)
+}
+
+func validate(r *Reader, opts ValidateOptions) ([]Diagnostic, error) {
+	var diags []Diagnostic
+	hosts := make(map[string]bool, len(opts.Hosts))
+	for _, h := range opts.Hosts {
+		if h = strings.TrimSpace(h); h != "" {
+			hosts[strings.ToLower(h)] = true
+		}
+	}
+	seen := make(map[string]*Entry)
+	destinations := make(map[string]*Entry)
+	for {
+		e, entryDiags, err := r.nextEntry()
+		if err == io.EOF {
+			break
+		}
+		if serr, ok := err.(*SyntaxError); ok {
+			// The remaining entries cannot be decoded, report the problems found so far along with the error.
+			diags = append(diags, errorf(serr.Position, "%s", serr.Message))
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		diags = append(diags, entryDiags...)
+		if e == nil {
+			continue
+		}
+		_, entryDiags = e.toSource()
+		diags = append(diags, entryDiags...)
+
+		origin, err := model.ParseOrigin(e.Origin)
+		if err != nil {
+			continue
+		}
+		if len(hosts) > 0 && origin.Scheme != model.SchemeFile && !hosts[origin.Host] {
+			diags = append(diags, errorf(e.position(fieldOrigin), "unsupported host %q", origin.Host))
+		}
+
+		key := origin.Canonical()
+		first, ok := seen[key]
+		if !ok {
+			seen[key] = e
+		}
+		duplicate := ok && normalizeRevision(first.Revision) == normalizeRevision(e.Revision)
+		switch {
+		case duplicate:
+			diags = append(diags, warningf(e.pos, "duplicate of the entry at line %d", first.pos.Line))
+		case ok && opts.RejectMultipleRevisions:
+			diags = append(diags, errorf(e.position(fieldRevision), "repository %s is pinned to conflicting revisions: %s (line %d) and %s",
+				model.Redact(e.Origin), first.Revision, first.pos.Line, e.Revision))
+		}
+
+		if e.Destination == "" || duplicate {
+			continue
+		}
+		dst := path.Clean(filepath.ToSlash(e.Destination))
+		if other, ok := destinations[dst]; ok {
+			diags = append(diags, errorf(e.position(fieldDestination), "destination %s is also used by the entry at line %d",
+				e.Destination, other.pos.Line))
+			continue
+		}
+		destinations[dst] = e
+	}
+	sortDiagnostics(diags)
+	return diags, nil
+}
+
+// normalizeRevision returns the full commit hashes in lower case, so that the letter case does not matter.
+func normalizeRevision(revision string) string {
+	if model.IsCommitHash(revision) {
+		return strings.ToLower(revision)
+	}
+	return revision
+}
+
+func sortDiagnostics(diags []Diagnostic) {
+	sort.SliceStable(diags, func(i, j int) bool {
+		a, b := diags[i].Position, diags[j].Position
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+}
@@ -0,0 +1,133 @@
+package manifest
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateContent(t *testing.T) {
+	const (
+		hash  = "edb545b434a8cfd46b8651d7041aa87e85503004"
+		other = "1111111111111111111111111111111111111111"
+	)
+	tests := []struct {
+		name    string
+		format  Format
+		content string
+		opts    ValidateOptions
+		want    []string
+	}{
+		{
+			name:    "valid",
+			content: "https://github.com/org/a " + hash + "\nhttps://github.com/org/b master\n",
+		},
+		{
+			name:    "invalid revision",
+			content: "https://github.com/org/a edb545b\n",
+			want:    []string{"1:26: error: "},
+		},
+		{
+			name:    "unsupported host",
+			content: "https://github.com/org/a master\nhttps://example.com/org/b master\n",
+			opts:    ValidateOptions{Hosts: []string{"github.com"}},
+			want:    []string{"2:1: error: unsupported host \"example.com\""},
+		},
+		{
+			name:    "hosts with spaces",
+			content: "https://github.com/org/a master\nhttps://gitlab.com/org/b master\n",
+			opts:    ValidateOptions{Hosts: []string{"github.com", " GitLab.com ", ""}},
+		},
+		{
+			name:    "duplicate",
+			content: "https://github.com/org/a master\ngit@github.com:org/a.git master\n",
+			want:    []string{"2:1: warning: duplicate of the entry at line 1"},
+		},
+		{
+			name:    "duplicate hash in another case",
+			content: "https://github.com/org/a " + hash + "\nhttps://github.com/org/a " + strings.ToUpper(hash) + "\n",
+			want:    []string{"2:1: warning: duplicate of the entry at line 1"},
+		},
+		{
+			name:    "multiple revisions",
+			content: "https://github.com/org/a " + hash + "\nhttps://github.com/org/a " + other + "\n",
+		},
+		{
+			name:    "multiple revisions rejected",
+			content: "https://github.com/org/a " + hash + "\nhttps://github.com/org/a " + other + "\n",
+			opts:    ValidateOptions{RejectMultipleRevisions: true},
+			want:    []string{"2:26: error: repository https://github.com/org/a is pinned to conflicting revisions"},
+		},
+		{
+			name:   "colliding destinations",
+			format: YAML,
+			content: "sources:\n" +
+				"  - origin: https://github.com/org/a\n" +
+				"    revision: " + hash + "\n" +
+				"    destination: deps/a\n" +
+				"  - origin: https://github.com/org/a\n" +
+				"    revision: " + other + "\n" +
+				"    destination: deps/a/\n" +
+				"  - origin: https://github.com/org/b\n" +
+				"    revision: master\n" +
+				"    destination: ./deps/a\n" +
+				"  - origin: https://github.com/org/b\n" +
+				"    revision: main\n" +
+				"    destination: deps/b\n",
+			want: []string{"7:18: error: destination deps/a/ is also used by the entry at line 2", "10:18: error: destination ./deps/a is also used by the entry at line 2"},
+		},
+		{
+			name:   "duplicate with a destination",
+			format: YAML,
+			content: "sources:\n" +
+				"  - origin: https://github.com/org/a\n" +
+				"    revision: master\n" +
+				"    destination: deps/a\n" +
+				"  - origin: https://github.com/org/a\n" +
+				"    revision: master\n" +
+				"    destination: deps/a\n",
+			want: []string{"5:5: warning: duplicate of the entry at line 2"},
+		},
+		{
+			name:    "syntax error",
+			content: "https://github.com/org/a\n",
+			want:    []string{"1:25: error: missing revision"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diags, err := ValidateContent([]byte(tt.content), tt.format, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(diags) != len(tt.want) {
+				t.Fatalf("got diagnostics %v, want %v", diags, tt.want)
+			}
+			for i, d := range diags {
+				if !strings.HasPrefix(d.String(), tt.want[i]) {
+					t.Errorf("diagnostic %d = %q, want prefix %q", i, d, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestValidateJSONPositions(t *testing.T) {
+	content := "{\"sources\": [\n" +
+		"  {\"origin\": \"https://github.com/org/a\",\n" +
+		"   \"revision\": \"edb545b\"},\n" +
+		"  {\"origin\": \"https://example.com/org/b\", \"revision\": \"master\"}\n" +
+		"]}\n"
+	diags, err := ValidateContent([]byte(content), JSON, ValidateOptions{Hosts: []string{"github.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"3:16: error: ", "4:14: error: unsupported host"}
+	if len(diags) != len(want) {
+		t.Fatalf("got diagnostics %v, want %v", diags, want)
+	}
+	for i, d := range diags {
+		if !strings.HasPrefix(d.String(), want[i]) {
+			t.Errorf("diagnostic %d = %q, want prefix %q", i, d, want[i])
+		}
+	}
+}
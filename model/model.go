@@ -1,53 +1,380 @@
 package model
 
 import (
+	"fmt"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
+const (
+	DownloaderGit       = "git"
+	DownloaderGitSystem = "git-system"
+)
+
 type Source struct {
-	Origin       string
-	Hash         string
+	Origin string
+	// Revision is the requested revision: a commit hash, a branch, a tag or any other reference.
+	Revision string
+	// Hash is the commit the Revision resolves to. It is empty until the Revision is resolved.
+	Hash   string
+	Scheme string
+	Host   string
+	// Port is the port of the origin, empty if it is the default port of the scheme.
+	Port string
+	// Namespace is the slash-separated path of groups the repository belongs to, e.g. "group/subgroup".
+	Namespace string
+	// Organization is the top-level element of the Namespace.
 	Organization string
 	Repository   string
+	Options      Options
+	// Mirror is the URL of a local mirror the commit is fetched from instead of the Origin.
+	Mirror string
+	// Submodules are the submodules checked out along with the source.
+	Submodules []Submodule
+	// UnresolvedLFSPointers are the Git LFS pointer files left in place of the contents.
+	UnresolvedLFSPointers []LFSPointer
+	// Status is the outcome of the download. It is empty until the source is handled.
+	Status Status
+	// Error is the reason of the failure of the download, empty unless the Status is StatusFailed or StatusInvalid.
+	Error string
+	// ErrorCategory is the step of the download that failed, empty unless the Status is StatusFailed or StatusInvalid.
+	ErrorCategory ErrorCategory
+	// Attempts are the attempts to download the source, in order. The transient failures are retried.
+	Attempts []Attempt
+	// Duration is the time the download of the source took, along with the retries and the dependencies.
+	Duration time.Duration
+	// Size is the size in bytes of the files in the source directory, zero unless it is measured.
+	Size int64
+	// Dependencies is the outcome of the download of the dependencies: StatusDownloaded, StatusSkipped or StatusFailed.
+	// It is empty if the dependencies are not downloaded for the source.
+	Dependencies Status
+	// Hooks are the runs of the hook commands on the source, in order.
+	Hooks []HookRun
+}
+
+// ErrorCategory is the step of the download of a source that failed.
+type ErrorCategory string
+
+const (
+	// ErrorResolve is a revision that could not be resolved to a commit.
+	ErrorResolve ErrorCategory = "resolve"
+	// ErrorNetwork is a failure of the network or of the remote that persisted after the retries.
+	ErrorNetwork ErrorCategory = "network"
+	// ErrorDownload is any other failure of the download, e.g. a missing repository or commit.
+	ErrorDownload ErrorCategory = "download"
+	// ErrorTimeout is a download that took longer than the source timeout.
+	ErrorTimeout ErrorCategory = "timeout"
+	// ErrorVerification is a source that failed the verification after the download.
+	ErrorVerification ErrorCategory = "verification"
+	// ErrorDependencies is a failure of the download of the dependencies.
+	ErrorDependencies ErrorCategory = "dependencies"
+	// ErrorFilesystem is a failure to inspect, create or move the directory of the source.
+	ErrorFilesystem ErrorCategory = "filesystem"
+	// ErrorHook is a hook command that failed in the strict mode.
+	ErrorHook ErrorCategory = "hook"
+	// ErrorManifest is an invalid entry of the input.
+	ErrorManifest ErrorCategory = "manifest"
+)
+
+// Attempt is a single attempt to download a source.
+type Attempt struct {
+	Start    time.Time
+	Duration time.Duration
+	// Error is the reason of the failure of the attempt, empty if it succeeded.
+	Error string
+	// Transient is true if the failure is likely to pass when the download is repeated.
+	Transient bool
+}
+
+// HookRun is a run of a hook command on a source.
+type HookRun struct {
+	// Hook is the step of the download the hook is run after: "source" or "dependencies".
+	Hook     string
+	Start    time.Time
+	Duration time.Duration
+	// Output is the combined standard output and error of the command, only its end if it is long.
+	Output string
+	// Error is the reason of the failure of the hook, empty if it succeeded.
+	Error string
+}
+
+// Status is the outcome of the download of a source.
+type Status string
+
+const (
+	// StatusDownloaded is a source downloaded into a new directory.
+	StatusDownloaded Status = "downloaded"
+	// StatusUpdated is a source whose directory was checked out at another commit and was updated in place.
+	StatusUpdated Status = "updated"
+	// StatusRepaired is a source whose directory was left unfinished by an earlier run and was downloaded again.
+	StatusRepaired Status = "repaired"
+	// StatusSkipped is a source whose directory was already checked out at the commit.
+	StatusSkipped Status = "skipped"
+	// StatusFailed is a source that could not be resolved, downloaded or verified.
+	StatusFailed Status = "failed"
+	// StatusInterrupted is a source whose download was stopped, or not started, because the run was stopped.
+	StatusInterrupted Status = "interrupted"
+	// StatusDuplicate is a source skipped because it is the same commit of the same repository, or in the same
+	// directory, as an earlier source.
+	StatusDuplicate Status = "duplicate"
+	// StatusInvalid is an entry of the input that is not a valid source. Its origin and revision are as given.
+	StatusInvalid Status = "invalid"
+)
+
+// Submodule is a submodule checked out at the commit recorded in the superproject.
+type Submodule struct {
+	// Path is the slash-separated path of the submodule relative to the source directory.
+	Path   string
+	Origin string
+	Hash   string
+}
+
+// LFSPointer is a Git LFS pointer file whose object was not downloaded.
+type LFSPointer struct {
+	// Path is the slash-separated path of the pointer file relative to the source directory.
+	Path   string
+	OID    string
+	Size   int64
+	Reason string
+}
+
+// LFSOptions are the settings of the Git LFS object download.
+type LFSOptions struct {
+	Enabled bool
+	// Include are the .gitignore-style patterns of the paths to download the objects for. All paths are included if empty.
+	Include []string
+	// Exclude are the .gitignore-style patterns of the paths not to download the objects for.
+	Exclude []string
+	// MaxSize is the size in bytes of the largest object to download. There is no limit if zero.
+	MaxSize int64
+}
+
+// History is the part of the commit history fetched along with the commit. At most one of the fields is set.
+type History struct {
+	// Depth is the number of commits to fetch.
+	Depth int
+	// Since is the date of the oldest commit to fetch.
+	Since time.Time
+	// Exclude is the reference whose commits are not fetched.
+	Exclude string
+	// Full fetches the complete history.
+	Full bool
+}
+
+// IsZero returns true if none of the fields is set.
+func (h History) IsZero() bool {
+	return h.Depth == 0 && h.Since.IsZero() && h.Exclude == "" && !h.Full
+}
+
+// Validate checks that at most one of the fields is set.
+func (h History) Validate() error {
+	set := 0
+	for _, ok := range []bool{h.Depth != 0, !h.Since.IsZero(), h.Exclude != "", h.Full} {
+		if ok {
+			set++
+		}
+	}
+	switch {
+	case h.Depth < 0:
+		return errors.Errorf("invalid depth: %d", h.Depth)
+	case set > 1:
+		return errors.New("only one of depth, shallow-since, shallow-exclude and full history can be set")
+	}
+	return nil
+}
+
+func (h History) String() string {
+	switch {
+	case h.Full:
+		return "full history"
+	case !h.Since.IsZero():
+		return "since " + h.Since.Format(time.RFC3339)
+	case h.Exclude != "":
+		return "excluding " + h.Exclude
+	default:
+		return fmt.Sprintf("depth %d", h.Depth)
+	}
+}
+
+// ParseDate parses a date given either as "2006-01-02" (UTC) or in the RFC 3339 format.
+func ParseDate(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, errors.Errorf("invalid date %q, expected YYYY-MM-DD or RFC 3339", s)
+	}
+	return t, nil
+}
+
+// Options are the per-source settings. Zero values fall back to the global settings.
+type Options struct {
+	// Downloader is the source downloader mode to use [git, git-system].
+	Downloader string
+	// WithDependencies overrides whether dependencies are downloaded along with the source.
+	WithDependencies *bool
+	// History is the part of the history to fetch along with the commit.
+	History *History
+	// Labels are arbitrary key-value pairs attached to the source.
+	Labels map[string]string
+	// Destination overrides the directory of the source. Relative paths are resolved against the destination directory.
+	Destination string
+	// SparsePaths are the .gitignore-style patterns of the paths to check out. All paths are checked out if empty.
+	SparsePaths []string
+	// Submodules enables the checkout of the submodules, recursively.
+	Submodules *bool
+	// LFS are the settings of the Git LFS object download. Without patterns and a size limit of their own,
+	// those of the client are used.
+	LFS *LFSOptions
+}
+
+// SubmodulesEnabled returns true if the submodules of the source should be checked out.
+func (o *Options) SubmodulesEnabled() bool {
+	return o.Submodules != nil && *o.Submodules
+}
+
+// LFSEnabled returns true if the Git LFS objects of the source should be downloaded.
+func (o *Options) LFSEnabled() bool {
+	return o.LFS != nil && o.LFS.Enabled
+}
+
+// Key returns the canonical identity of the source: the canonical origin and the resolved commit.
+func (s *Source) Key() string {
+	origin := s.Origin
+	if o, err := ParseOrigin(s.Origin); err == nil {
+		origin = o.Canonical()
+	}
+	return origin + "@" + s.Hash
+}
+
+// FetchURL returns the URL the commit is fetched from: the mirror if there is one, otherwise the origin.
+func (s *Source) FetchURL() string {
+	if s.Mirror != "" {
+		return s.Mirror
+	}
+	return s.Origin
+}
+
+// Resolved returns true if the revision of the source is resolved to a commit hash.
+func (s *Source) Resolved() bool {
+	return s.Hash != ""
+}
+
+// IsCommitHash returns true if the revision is a full, hex-encoded SHA-1 commit hash.
+func IsCommitHash(revision string) bool {
+	if len(revision) != 40 {
+		return false
+	}
+	for _, c := range revision {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidateRevision checks that the revision is either a full commit hash or a reference name.
+// Abbreviated hashes are rejected, because they cannot be fetched from a remote.
+func ValidateRevision(revision string) error {
+	if revision == "" {
+		return errors.New("missing revision")
+	}
+	if strings.ContainsAny(revision, " \t\n") {
+		return errors.Errorf("revision contains whitespace: %q", revision)
+	}
+	if strings.HasPrefix(revision, "-") {
+		return errors.Errorf("revision starts with a dash: %q", revision)
+	}
+	if IsCommitHash(revision) {
+		return nil
+	}
+	hex := true
+	for _, c := range revision {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			hex = false
+			break
+		}
+	}
+	switch {
+	case hex && len(revision) < 40:
+		return errors.Errorf("short commit hash %q, a full 40-character hash is required", revision)
+	case hex:
+		return errors.Errorf("invalid commit hash length %q, a 40-character hash is required", revision)
+	case len(revision) == 40 && !strings.Contains(revision, "/"):
+		return errors.Errorf("non-hex commit hash %q", revision)
+	}
+	return nil
+}
+
+// FetchHistory returns the part of the history to fetch for the source, only the commit itself if it is not set.
+func (s *Source) FetchHistory() History {
+	if s.Options.History == nil || s.Options.History.IsZero() {
+		return History{Depth: 1}
+	}
+	return *s.Options.History
+}
+
+// Directory returns the path of the source relative to the destination directory: the host with a non-default port,
+// the namespace and the repository with the commit. The sources of local origins have no host directory.
+func (s *Source) Directory() string {
+	host := s.Host
+	if s.Port != "" {
+		host += "_" + s.Port
+	}
+	return filepath.Join(host, filepath.FromSlash(s.Namespace), s.Repository+"-"+s.Hash)
 }
 
 func ToSource(src string) (*Source, error) {
-	origin, hash, err := extractOriginAndHash(src)
+	origin, revision, err := extractOriginAndRevision(src)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid input for origin and revision")
+	}
+	return NewSource(origin, revision)
+}
+
+// NewSource creates a source for the origin at the revision. Full commit hashes are resolved right away,
+// other revisions have to be resolved against the remote before the download.
+func NewSource(origin, revision string) (*Source, error) {
+	if err := ValidateRevision(revision); err != nil {
+		return nil, errors.Wrapf(err, "invalid revision for %s", Redact(origin))
+	}
+	o, err := ParseOrigin(origin)
 	if err != nil {
-		return nil, errors.Wrap(err, "invalid input for origin and hash")
+		return nil, errors.Wrap(err, "invalid input for origin")
 	}
-	organization, repo, err := extractOrganizationAndRepo(origin)
+	namespace, repo, err := o.NamespaceAndRepository()
 	if err != nil {
-		return nil, errors.Wrap(err, "invalid input for organization and name")
+		return nil, errors.Wrap(err, "invalid input for namespace and name")
+	}
+	var hash string
+	if IsCommitHash(revision) {
+		hash = strings.ToLower(revision)
+	}
+	port := o.Port
+	if port == defaultPorts[o.Scheme] {
+		port = ""
 	}
 	return &Source{
 		Origin:       origin,
+		Revision:     revision,
 		Hash:         hash,
-		Organization: organization,
+		Scheme:       o.Scheme,
+		Host:         o.Host,
+		Port:         port,
+		Namespace:    namespace,
+		Organization: strings.SplitN(namespace, "/", 2)[0],
 		Repository:   repo,
 	}, nil
 }
 
-func extractOriginAndHash(src string) (string, string, error) {
-	split := strings.Split(src, " ")
-	if len(split) != 2 {
-		return "", "", errors.Errorf("invalid origin and hash definition: %s", src)
-	}
-	return split[0], split[1], nil
-}
-
-func extractOrganizationAndRepo(origin string) (string, string, error) {
-	protocolSplit := strings.Split(origin, ":")
-	if len(protocolSplit) != 2 {
-		return "", "", errors.Errorf("invalid URL structure: %s", origin)
-	}
-
-	organizationAndRepo := strings.TrimSuffix(protocolSplit[1], ".git")
-	split := strings.Split(organizationAndRepo, "/")
+func extractOriginAndRevision(src string) (string, string, error) {
+	split := strings.Fields(src)
 	if len(split) != 2 {
-		return "", "", errors.Errorf("invalid organization and repository name structure: %s", organizationAndRepo)
+		return "", "", errors.Errorf("invalid origin and revision definition: %s", Redact(src))
 	}
 	return split[0], split[1], nil
 }
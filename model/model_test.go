@@ -0,0 +1,59 @@
+package model
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSourceDirectory(t *testing.T) {
+	const hash = "edb545b434a8cfd46b8651d7041aa87e85503004"
+	tests := []struct {
+		origin string
+		want   string
+	}{
+		{"https://github.com/org/repo.git", "github.com/org/repo-" + hash},
+		{"git@gitlab.com:group/subgroup/team/repo.git", "gitlab.com/group/subgroup/team/repo-" + hash},
+		{"https://gitlab.example.com/org/repo", "gitlab.example.com/org/repo-" + hash},
+		{"https://host:443/org/repo", "host/org/repo-" + hash},
+		{"https://host:8443/org/repo", "host_8443/org/repo-" + hash},
+		{"ssh://git@host:2222/org/repo", "host_2222/org/repo-" + hash},
+		{"file:///srv/mirrors/org/repo.git", "org/repo-" + hash},
+	}
+	for _, tt := range tests {
+		src, err := NewSource(tt.origin, hash)
+		if err != nil {
+			t.Fatalf("NewSource(%q) failed: %v", tt.origin, err)
+		}
+		if got := src.Directory(); got != filepath.FromSlash(tt.want) {
+			t.Errorf("Directory(%q) = %q, want %q", tt.origin, got, tt.want)
+		}
+	}
+}
+
+func TestSourceKey(t *testing.T) {
+	const hash = "edb545b434a8cfd46b8651d7041aa87e85503004"
+	same := []string{
+		"git@github.com:a/b.git",
+		"https://github.com/a/b",
+		"ssh://git@github.com/A/B.git",
+	}
+	var key string
+	for _, origin := range same {
+		src, err := NewSource(origin, hash)
+		if err != nil {
+			t.Fatalf("NewSource(%q) failed: %v", origin, err)
+		}
+		if key == "" {
+			key = src.Key()
+		} else if src.Key() != key {
+			t.Errorf("Key(%q) = %q, want %q", origin, src.Key(), key)
+		}
+	}
+	other, err := NewSource("https://gitlab.com/a/b", hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Key() == key {
+		t.Errorf("Key of another host is the same: %q", key)
+	}
+}
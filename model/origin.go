@@ -0,0 +1,191 @@
+package model
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	SchemeSSH   = "ssh"
+	SchemeHTTPS = "https"
+	SchemeHTTP  = "http"
+	SchemeGit   = "git"
+	SchemeFile  = "file"
+)
+
+// caseInsensitiveHosts are the hosts documented to match the repository paths regardless of the letter case.
+var caseInsensitiveHosts = map[string]bool{
+	"github.com":    true,
+	"gitlab.com":    true,
+	"bitbucket.org": true,
+}
+
+var defaultPorts = map[string]string{
+	SchemeSSH:   "22",
+	SchemeHTTPS: "443",
+	SchemeHTTP:  "80",
+	SchemeGit:   "9418",
+}
+
+// Origin is a parsed Git remote URL. Both URL forms (https://, ssh://, git://, file://)
+// and the scp-like form (git@host:org/repo.git) are supported; the latter is reported as ssh.
+type Origin struct {
+	Scheme string
+	User   string
+	Host   string
+	Port   string
+	// Path is the repository path without the leading slash and the ".git" suffix.
+	Path string
+}
+
+func ParseOrigin(origin string) (*Origin, error) {
+	if origin == "" {
+		return nil, errors.New("empty origin")
+	}
+	if !strings.Contains(origin, "://") {
+		return parseScpLikeOrigin(origin)
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		if uerr, ok := err.(*url.Error); ok {
+			// The error of the URL holds the URL itself, with the credentials.
+			err = uerr.Err
+		}
+		return nil, errors.Wrapf(err, "invalid URL: %s", Redact(origin))
+	}
+	scheme := strings.ToLower(u.Scheme)
+	switch scheme {
+	case SchemeSSH, "git+ssh", "ssh+git":
+		scheme = SchemeSSH
+	case SchemeHTTPS, SchemeHTTP, SchemeGit:
+	case SchemeFile:
+		if u.Host != "" && u.Host != "localhost" {
+			return nil, errors.Errorf("file URL with a remote host is not supported: %s", Redact(origin))
+		}
+	default:
+		return nil, errors.Errorf("unsupported URL scheme %q: %s", u.Scheme, Redact(origin))
+	}
+	if scheme != SchemeFile && u.Hostname() == "" {
+		return nil, errors.Errorf("missing host: %s", Redact(origin))
+	}
+
+	o := &Origin{
+		Scheme: scheme,
+		Host:   strings.ToLower(u.Hostname()),
+		Port:   u.Port(),
+		Path:   trimRepositoryPath(u.Path),
+	}
+	if scheme == SchemeFile {
+		o.Host = ""
+	}
+	if u.User != nil {
+		o.User = u.User.Username()
+	}
+	if o.Path == "" {
+		return nil, errors.Errorf("missing repository path: %s", Redact(origin))
+	}
+	if err := o.validateArguments(origin); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// validateArguments checks that none of the parts of the origin starts with a dash, so that git cannot take
+// the origin for an option.
+func (o *Origin) validateArguments(origin string) error {
+	for _, part := range []string{o.User, o.Host, o.Path} {
+		if strings.HasPrefix(part, "-") {
+			return errors.Errorf("invalid origin, %q starts with a dash: %s", part, Redact(origin))
+		}
+	}
+	return nil
+}
+
+// Canonical returns the identity of the repository: the host in lower case with a non-default port and the repository
+// path. Origins which differ only in the protocol or the user have the same identity. The letter case of the path
+// is ignored only for the hosts known to ignore it.
+func (o *Origin) Canonical() string {
+	host := o.Host
+	if o.Port != "" && o.Port != defaultPorts[o.Scheme] {
+		host += ":" + o.Port
+	}
+	path := o.Path
+	if caseInsensitiveHosts[o.Host] {
+		path = strings.ToLower(path)
+	}
+	return host + "/" + path
+}
+
+// urlUserinfo matches the scheme and the userinfo of the URLs.
+var urlUserinfo = regexp.MustCompile(`(?i)\b([a-z][a-z0-9+.-]*)://([^/?#@\s'"]+)@`)
+
+// Redact returns the text with the credentials in the URLs it contains replaced by "xxxxx", like url.URL.Redacted,
+// so that the origins and the messages mentioning them can be logged and reported. The user name of the HTTP(S) URLs
+// without a password is replaced as well, as it is commonly an access token.
+func Redact(s string) string {
+	return urlUserinfo.ReplaceAllStringFunc(s, func(m string) string {
+		parts := urlUserinfo.FindStringSubmatch(m)
+		scheme, userinfo := parts[1], parts[2]
+		if colon := strings.IndexByte(userinfo, ':'); colon >= 0 {
+			userinfo = userinfo[:colon] + ":xxxxx"
+		} else if scheme = strings.ToLower(scheme); scheme == SchemeHTTPS || scheme == SchemeHTTP {
+			userinfo = "xxxxx"
+		}
+		return parts[1] + "://" + userinfo + "@"
+	})
+}
+
+// NamespaceAndRepository splits the origin path into the namespace and the repository name.
+func (o *Origin) NamespaceAndRepository() (string, string, error) {
+	split := strings.Split(o.Path, "/")
+	// Local mirrors live under arbitrary directories, so only the last two path elements are used.
+	if o.Scheme == SchemeFile && len(split) > 2 {
+		split = split[len(split)-2:]
+	}
+	if len(split) < 2 {
+		return "", "", errors.Errorf("invalid namespace and repository name structure: %s", o.Path)
+	}
+	for _, e := range split {
+		if e == "" || e == "." || e == ".." {
+			return "", "", errors.Errorf("invalid namespace and repository name structure: %s", o.Path)
+		}
+	}
+	return strings.Join(split[:len(split)-1], "/"), split[len(split)-1], nil
+}
+
+func parseScpLikeOrigin(origin string) (*Origin, error) {
+	colon := strings.Index(origin, ":")
+	if colon < 0 || strings.Contains(origin[:colon], "/") {
+		return nil, errors.Errorf("invalid URL structure: %s", Redact(origin))
+	}
+	user, host := "", origin[:colon]
+	if at := strings.LastIndex(host, "@"); at >= 0 {
+		user, host = host[:at], host[at+1:]
+	}
+	if host == "" {
+		return nil, errors.Errorf("missing host: %s", Redact(origin))
+	}
+	path := trimRepositoryPath(origin[colon+1:])
+	if path == "" {
+		return nil, errors.Errorf("missing repository path: %s", Redact(origin))
+	}
+	o := &Origin{
+		Scheme: SchemeSSH,
+		User:   user,
+		Host:   strings.ToLower(host),
+		Path:   path,
+	}
+	if err := o.validateArguments(origin); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func trimRepositoryPath(path string) string {
+	path = strings.Trim(path, "/")
+	return strings.TrimSuffix(path, ".git")
+}
@@ -0,0 +1,223 @@
+package source
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arekziobrowski/sourcerer/model"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	mirrorSuffix     = ".git"
+	mirrorLockSuffix = ".lock"
+)
+
+// Cache is a directory of bare mirrors of the origins, reused across the runs. The commits are fetched into the mirrors
+// incrementally and the sources are fetched from the mirrors. The mirrors are guarded by file locks, so that concurrent
+// runs can share the cache: a mirror is locked exclusively while it is updated or evicted, and shared while it is read.
+type Cache struct {
+	dir     string
+	maxSize int64
+	maxAge  time.Duration
+}
+
+// MirrorFetchFunc fetches the commit of the source into the bare mirror repository in the directory,
+// creating the repository if it does not exist.
+type MirrorFetchFunc func(ctx context.Context, dir string, src *model.Source) error
+
+// NewCache creates the cache in the directory. Mirrors unused for longer than maxAge and the least recently used mirrors
+// exceeding maxSize bytes in total are evicted; there is no limit if zero.
+func NewCache(dir string, maxSize int64, maxAge time.Duration) *Cache {
+	return &Cache{
+		dir:     dir,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+	}
+}
+
+// mirrorLockInterval is the interval of the attempts to lock a mirror locked by another download or run.
+const mirrorLockInterval = 100 * time.Millisecond
+
+// Acquire makes sure the commit of the source is in the mirror of its origin and sets the mirror as the repository
+// the source is fetched from. The mirror is not evicted until the returned function is called; it may be called more
+// than once. The wait for the lock of the mirror is stopped when the context is done.
+func (c *Cache) Acquire(ctx context.Context, src *model.Source, fetch MirrorFetchFunc) (func(), error) {
+	dir, err := c.mirrorDir(src.Origin)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(dir), 0777); err != nil {
+		return nil, errors.Wrap(err, "cannot create the cache directory")
+	}
+	lock, err := os.OpenFile(dir+mirrorLockSuffix, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot open the lock of %s", dir)
+	}
+	// Closing the file releases the lock.
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			lock.Close()
+		})
+	}
+
+	if err := lockMirror(ctx, lock, true); err != nil {
+		release()
+		return nil, errors.Wrapf(err, "cannot lock %s", dir)
+	}
+	if err := fetch(ctx, dir, src); err != nil {
+		release()
+		return nil, errors.Wrapf(err, "failed to update the mirror %s", dir)
+	}
+	// The modification time of the lock is the last use of the mirror.
+	now := time.Now()
+	if err := os.Chtimes(lock.Name(), now, now); err != nil {
+		log.Warnf("Cannot record the use of the mirror %s: %v", dir, err)
+	}
+	if err := lockMirror(ctx, lock, false); err != nil {
+		release()
+		return nil, errors.Wrapf(err, "cannot lock %s", dir)
+	}
+
+	url := filepath.ToSlash(dir)
+	if !strings.HasPrefix(url, "/") {
+		url = "/" + url
+	}
+	src.Mirror = "file://" + url
+	return release, nil
+}
+
+// lockMirror locks the file of the mirror, polling it instead of waiting, so that the wait can be stopped.
+func lockMirror(ctx context.Context, lock *os.File, exclusive bool) error {
+	for {
+		locked, err := lockFile(lock, exclusive, false)
+		if err != nil || locked {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(mirrorLockInterval):
+		}
+	}
+}
+
+type mirrorReleaseKey struct{}
+
+// WithMirrorRelease returns the context of a download from the mirror acquired in the cache. The download releases
+// the mirror with the function as soon as it does not read from it any more, not to delay its updates.
+func WithMirrorRelease(ctx context.Context, release func()) context.Context {
+	return context.WithValue(ctx, mirrorReleaseKey{}, release)
+}
+
+// releaseMirror releases the mirror the download reads from, if any.
+func releaseMirror(ctx context.Context) {
+	if release, ok := ctx.Value(mirrorReleaseKey{}).(func()); ok {
+		release()
+	}
+}
+
+func (c *Cache) mirrorDir(origin string) (string, error) {
+	o, err := model.ParseOrigin(origin)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(filepath.Join(c.dir, filepath.FromSlash(o.Canonical())+mirrorSuffix))
+}
+
+type cachedMirror struct {
+	dir      string
+	lastUsed time.Time
+	size     int64
+}
+
+// Evict removes the mirrors unused for longer than the maximum age, then the least recently used mirrors until
+// the cache fits in the maximum size. The mirrors in use are skipped.
+func (c *Cache) Evict() error {
+	if c.maxSize <= 0 && c.maxAge <= 0 {
+		return nil
+	}
+	var mirrors []cachedMirror
+	var total int64
+	err := filepath.Walk(c.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() || !strings.HasSuffix(path, mirrorSuffix) {
+			return nil
+		}
+		m := cachedMirror{dir: path, lastUsed: info.ModTime()}
+		if lock, err := os.Stat(path + mirrorLockSuffix); err == nil {
+			m.lastUsed = lock.ModTime()
+		}
+		if m.size, err = dirSize(path); err != nil {
+			return err
+		}
+		mirrors = append(mirrors, m)
+		total += m.size
+		return filepath.SkipDir
+	})
+	if err != nil {
+		return errors.Wrap(err, "cannot list the cached mirrors")
+	}
+
+	sort.Slice(mirrors, func(i, j int) bool {
+		return mirrors[i].lastUsed.Before(mirrors[j].lastUsed)
+	})
+	now := time.Now()
+	for _, m := range mirrors {
+		expired := c.maxAge > 0 && now.Sub(m.lastUsed) > c.maxAge
+		if !expired && (c.maxSize <= 0 || total <= c.maxSize) {
+			continue
+		}
+		evicted, err := evictMirror(m.dir)
+		if err != nil {
+			return errors.Wrapf(err, "cannot evict the mirror %s", m.dir)
+		}
+		if !evicted {
+			log.Infof("Not evicting the mirror %s, it is in use", m.dir)
+			continue
+		}
+		total -= m.size
+		log.Infof("Evicted the mirror %s (%d bytes, last used at %s)", m.dir, m.size, m.lastUsed.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// evictMirror removes the mirror unless it is locked. The lock file is kept, as it may be opened by another process.
+func evictMirror(dir string) (bool, error) {
+	lock, err := os.OpenFile(dir+mirrorLockSuffix, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return false, err
+	}
+	defer lock.Close()
+	locked, err := lockFile(lock, true, false)
+	if err != nil || !locked {
+		return false, err
+	}
+	return true, os.RemoveAll(dir)
+}
+
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,154 @@
+package source
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/arekziobrowski/sourcerer/model"
+)
+
+// fakeMirror returns the fetch function creating a mirror with a file of the size.
+func fakeMirror(size int) MirrorFetchFunc {
+	return func(ctx context.Context, dir string, src *model.Source) error {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			return err
+		}
+		return ioutil.WriteFile(filepath.Join(dir, "pack"), make([]byte, size), 0666)
+	}
+}
+
+func acquireTest(t *testing.T, c *Cache, origin string, size int) (string, func()) {
+	t.Helper()
+	src := &model.Source{Origin: origin}
+	release, err := c.Acquire(context.Background(), src, fakeMirror(size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := c.mirrorDir(origin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, release
+}
+
+func setLastUsed(t *testing.T, dir string, lastUsed time.Time) {
+	t.Helper()
+	if err := os.Chtimes(dir+mirrorLockSuffix, lastUsed, lastUsed); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestEvict(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		maxSize int64
+		maxAge  time.Duration
+		inUse   bool
+		want    []bool
+	}{
+		{name: "unlimited", want: []bool{true, true, true}},
+		{name: "max age", maxAge: 150 * time.Minute, want: []bool{false, true, true}},
+		{name: "max size", maxSize: 250, want: []bool{false, true, true}},
+		{name: "max size and age", maxSize: 150, maxAge: 150 * time.Minute, want: []bool{false, false, true}},
+		{name: "in use", maxAge: time.Minute, inUse: true, want: []bool{true, false, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCache(t.TempDir(), tt.maxSize, tt.maxAge)
+			var dirs []string
+			for i, origin := range []string{"https://host/org/old", "https://host/org/recent", "https://host/other/new"} {
+				dir, release := acquireTest(t, c, origin, 100)
+				if i == 0 && tt.inUse {
+					defer release()
+				} else {
+					release()
+				}
+				setLastUsed(t, dir, now.Add(-time.Duration(3-i)*time.Hour))
+				dirs = append(dirs, dir)
+			}
+			if err := c.Evict(); err != nil {
+				t.Fatal(err)
+			}
+			for i, dir := range dirs {
+				if got := exists(dir); got != tt.want[i] {
+					t.Errorf("%s kept = %v, want %v", dir, got, tt.want[i])
+				}
+				// The lock files are kept, as other runs may have them open.
+				if !exists(dir + mirrorLockSuffix) {
+					t.Errorf("%s removed", dir+mirrorLockSuffix)
+				}
+			}
+		})
+	}
+}
+
+func TestEvictMissingDirectory(t *testing.T) {
+	c := NewCache(filepath.Join(t.TempDir(), "missing"), 1, time.Hour)
+	if err := c.Evict(); err != nil {
+		t.Errorf("evicting from a missing cache failed: %v", err)
+	}
+}
+
+func TestAcquireCancelled(t *testing.T) {
+	c := NewCache(t.TempDir(), 0, 0)
+	const origin = "https://host/org/repo"
+	_, release := acquireTest(t, c, origin, 1)
+	defer release()
+
+	// The mirror cannot be updated while it is read.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*mirrorLockInterval)
+	defer cancel()
+	start := time.Now()
+	_, err := c.Acquire(ctx, &model.Source{Origin: origin}, fakeMirror(1))
+	if err == nil {
+		t.Fatal("acquiring the mirror in use succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("the wait for the lock stopped after %s", elapsed)
+	}
+
+	release()
+	src := &model.Source{Origin: origin}
+	release, err = c.Acquire(context.Background(), src, fakeMirror(1))
+	if err != nil {
+		t.Fatalf("acquiring the released mirror failed: %v", err)
+	}
+	defer release()
+	if src.Mirror == "" {
+		t.Error("the mirror of the source is not set")
+	}
+}
+
+func TestReleaseMirror(t *testing.T) {
+	c := NewCache(t.TempDir(), 0, time.Nanosecond)
+	dir, release := acquireTest(t, c, "https://host/org/repo", 1)
+	defer release()
+	ctx := WithMirrorRelease(context.Background(), release)
+
+	if err := c.Evict(); err != nil {
+		t.Fatal(err)
+	}
+	if !exists(dir) {
+		t.Fatal("the mirror in use was evicted")
+	}
+	releaseMirror(ctx)
+	// Releasing again, as the caller does after the download, has no effect.
+	releaseMirror(ctx)
+	releaseMirror(context.Background())
+	if err := c.Evict(); err != nil {
+		t.Fatal(err)
+	}
+	if exists(dir) {
+		t.Error("the released mirror was not evicted")
+	}
+}
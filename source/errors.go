@@ -0,0 +1,107 @@
+package source
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"syscall"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+// CommandError is the failure of a command, along with what it wrote to the standard error.
+type CommandError struct {
+	Command string
+	Stderr  string
+	Err     error
+}
+
+func (e *CommandError) Error() string {
+	stderr := strings.TrimSpace(e.Stderr)
+	if stderr == "" {
+		return e.Command + ": " + e.Err.Error()
+	}
+	return e.Command + ": " + e.Err.Error() + ": " + stderr
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// transientStderr matches the messages of git about the failures of the network or of the remote that are likely
+// to pass when the command is repeated.
+var transientStderr = regexp.MustCompile(`(?i)` + strings.Join([]string{
+	`could not resolve host`,
+	`temporary failure in name resolution`,
+	`connection (timed out|reset|refused|closed)`,
+	`operation timed out`,
+	`failed to connect`,
+	`the remote end hung up unexpectedly`,
+	`early eof`,
+	`unexpected disconnect`,
+	`rpc failed`,
+	`returned error: (5\d\d|429)`,
+	`http/2 stream \d+ was not closed cleanly`,
+	`gnutls_handshake\(\) failed`,
+	`ssl_(read|connect|error)`,
+	`ssh_exchange_identification`,
+	`kex_exchange_identification`,
+	`index-pack failed`,
+}, "|"))
+
+// IsTransient returns true if the error is a failure of the network or of the remote that is likely to pass when
+// the download is repeated: a timeout, a dropped connection or a 5xx response. Other errors, e.g. a repository
+// or a commit that does not exist or failed authentication, are permanent.
+func IsTransient(err error) bool {
+	for err != nil {
+		switch e := err.(type) {
+		case *CommandError:
+			if transientStderr.MatchString(e.Stderr) {
+				return true
+			}
+		case *githttp.Err:
+			code := e.StatusCode()
+			return code >= http.StatusInternalServerError || code == http.StatusTooManyRequests || code == http.StatusRequestTimeout
+		case *net.OpError, *net.DNSError:
+			return true
+		case syscall.Errno:
+			// syscall.Errno implements net.Error, so it is matched first.
+			return e == syscall.ECONNRESET || e == syscall.ECONNREFUSED || e == syscall.ECONNABORTED ||
+				e == syscall.ETIMEDOUT || e == syscall.EPIPE || e == syscall.EHOSTUNREACH || e == syscall.ENETUNREACH
+		case net.Error:
+			if e.Timeout() {
+				return true
+			}
+		}
+		switch err {
+		case transport.ErrRepositoryNotFound, transport.ErrEmptyRemoteRepository, transport.ErrAuthenticationRequired,
+			transport.ErrAuthorizationFailed, transport.ErrInvalidAuthMethod, plumbing.ErrObjectNotFound,
+			context.Canceled:
+			return false
+		case io.ErrUnexpectedEOF, context.DeadlineExceeded:
+			return true
+		}
+		err = unwrap(err)
+	}
+	return false
+}
+
+// unwrap returns the error wrapped by the error, either with github.com/pkg/errors or with the standard library.
+func unwrap(err error) error {
+	switch e := err.(type) {
+	case interface{ Cause() error }:
+		return e.Cause()
+	case interface{ Unwrap() error }:
+		return e.Unwrap()
+	case *plumbing.UnexpectedError:
+		return e.Err
+	case *plumbing.PermanentError:
+		return e.Err
+	}
+	return nil
+}
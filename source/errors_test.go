@@ -0,0 +1,60 @@
+package source
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/pkg/errors"
+)
+
+func TestIsTransient(t *testing.T) {
+	exit := &exec.ExitError{}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "nil"},
+		{name: "other", err: errors.New("unsupported")},
+		{name: "git timeout", err: &CommandError{Command: "git fetch", Stderr: "fatal: unable to access 'https://github.com/a/b/': Connection timed out", Err: exit}, want: true},
+		{name: "git host", err: &CommandError{Command: "git fetch", Stderr: "fatal: unable to access 'https://github.com/a/b/': Could not resolve host: github.com", Err: exit}, want: true},
+		{name: "git hung up", err: &CommandError{Command: "git fetch", Stderr: "fatal: the remote end hung up unexpectedly", Err: exit}, want: true},
+		{name: "git 503", err: &CommandError{Command: "git fetch", Stderr: "error: RPC failed; HTTP 503 curl 22 The requested URL returned error: 503", Err: exit}, want: true},
+		{name: "git 429", err: &CommandError{Command: "git fetch", Stderr: "fatal: The requested URL returned error: 429", Err: exit}, want: true},
+		{name: "git not found", err: &CommandError{Command: "git fetch", Stderr: "remote: Repository not found.\nfatal: repository 'https://github.com/a/b/' not found", Err: exit}},
+		{name: "git 403", err: &CommandError{Command: "git fetch", Stderr: "fatal: The requested URL returned error: 403", Err: exit}},
+		{name: "git missing commit", err: &CommandError{Command: "git fetch", Stderr: "fatal: remote error: upload-pack: not our ref", Err: exit}},
+		{name: "wrapped git", err: errors.Wrap(&CommandError{Command: "git fetch", Stderr: "fatal: early EOF", Err: exit}, "cannot fetch"), want: true},
+		{name: "http 500", err: githttp.NewErr(&http.Response{StatusCode: http.StatusInternalServerError}), want: true},
+		{name: "http 429", err: githttp.NewErr(&http.Response{StatusCode: http.StatusTooManyRequests}), want: true},
+		{name: "http 408", err: githttp.NewErr(&http.Response{StatusCode: http.StatusRequestTimeout}), want: true},
+		{name: "http 400", err: githttp.NewErr(&http.Response{StatusCode: http.StatusBadRequest})},
+		{name: "http 404", err: githttp.NewErr(&http.Response{StatusCode: http.StatusNotFound})},
+		{name: "repository not found", err: transport.ErrRepositoryNotFound},
+		{name: "authentication", err: errors.Wrap(transport.ErrAuthenticationRequired, "cannot fetch")},
+		{name: "object not found", err: plumbing.ErrObjectNotFound},
+		{name: "dial", err: &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, want: true},
+		{name: "dns", err: errors.Wrap(&net.DNSError{Err: "no such host", Name: "github.com"}, "cannot fetch"), want: true},
+		{name: "reset", err: os.NewSyscallError("read", syscall.ECONNRESET), want: true},
+		{name: "permission", err: os.NewSyscallError("open", syscall.EACCES)},
+		{name: "unexpected eof", err: plumbing.NewUnexpectedError(io.ErrUnexpectedEOF), want: true},
+		{name: "deadline", err: errors.Wrap(context.DeadlineExceeded, "cannot fetch"), want: true},
+		{name: "canceled", err: errors.Wrap(context.Canceled, "cannot fetch")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsTransient(tt.err); got != tt.want {
+				t.Errorf("IsTransient(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package source
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+
+	"github.com/arekziobrowski/sourcerer/model"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const alternatesFile = "objects/info/alternates"
+
+// GitAlternatesDownloader checks out the source with go-git from the store of its origin. The repository
+// of the source refers to the objects of the store with objects/info/alternates instead of copying them.
+type GitAlternatesDownloader struct {
+	workingDirectory string
+	store            *Store
+}
+
+func NewGitAlternatesDownloader(wd string, store *Store) *GitAlternatesDownloader {
+	return &GitAlternatesDownloader{
+		workingDirectory: wd,
+		store:            store,
+	}
+}
+
+// sharedObjectsStorage is the storage of a repository whose objects are read from the store. go-git supports
+// alternates, but it reloads the pack indexes of the alternate repository on every lookup.
+type sharedObjectsStorage struct {
+	*filesystem.Storage
+	*filesystem.ObjectStorage
+}
+
+func (g *GitAlternatesDownloader) Get(ctx context.Context, src *model.Source) error {
+	const remoteName = "origin"
+	log.Infof("Downloading %s-%s", model.Redact(src.Origin), src.Hash)
+
+	auth := getAuth(src)
+	err := g.store.fetch(src.Hash, src.FetchHistory(), func(s *Store, hashes []string, history model.History) error {
+		return fetchIntoGoGitStore(ctx, s, src.FetchURL(), hashes, history, auth)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to fetch from remote for revision: %s", src.Hash)
+	}
+	releaseMirror(ctx)
+	store := filesystem.NewStorage(osfs.New(g.store.Dir()), cache.NewObjectLRUDefault())
+
+	fs := osfs.New(g.workingDirectory)
+	dot, err := fs.Chroot(".git")
+	if err != nil {
+		return errors.Wrap(err, "cannot create a .git directory")
+	}
+	storage := filesystem.NewStorage(dot, cache.NewObjectLRUDefault())
+	shared := &sharedObjectsStorage{Storage: storage, ObjectStorage: &store.ObjectStorage}
+	repo, err := git.Init(shared, fs)
+	if err == git.ErrRepositoryAlreadyExists {
+		repo, err = git.Open(shared, fs)
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to init repo")
+	}
+	_, err = createRemote(repo, remoteName, src.Origin)
+	if err != nil {
+		return errors.Wrapf(err, "failed to invoke 'git remote add %s %s'", remoteName, model.Redact(src.Origin))
+	}
+
+	objects, err := filepath.Abs(filepath.Join(g.store.Dir(), "objects"))
+	if err != nil {
+		return err
+	}
+	if err := util.WriteFile(dot, alternatesFile, []byte(objects+"\n"), 0666); err != nil {
+		return errors.Wrapf(err, "cannot write %s", alternatesFile)
+	}
+	shallows, err := store.Shallow()
+	if err != nil {
+		return err
+	}
+	if err := storage.SetShallow(shallows); err != nil {
+		return err
+	}
+
+	h := plumbing.NewHash(src.Hash)
+	// The source is checked out at a detached HEAD, the same way as a 'git worktree add --detach'.
+	if err := storage.SetReference(plumbing.NewHashReference(plumbing.HEAD, h)); err != nil {
+		return err
+	}
+	workTree, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+	err = disableSparseCheckout(repo, fs)
+	if err != nil {
+		return errors.Wrap(err, "failed to disable sparse checkout")
+	}
+	err = workTree.Reset(&git.ResetOptions{
+		Commit: h,
+		Mode:   git.HardReset,
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to invoke 'git reset --hard SHA1'")
+	}
+
+	err = fetchLFSObjects(ctx, src, g.workingDirectory)
+	if err != nil {
+		return errors.Wrap(err, "failed to download LFS objects")
+	}
+
+	if src.Options.SubmodulesEnabled() {
+		links, err := gitlinks(repo, h)
+		if err != nil {
+			return err
+		}
+		err = updateSubmodules(ctx, src, g.workingDirectory, links, func(wd string) downloader {
+			return NewGitDownloader(wd)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	log.Infof("Finished downloading for: %s-%s", model.Redact(src.Origin), src.Hash)
+	return nil
+}
+
+// fetchIntoGoGitStore fetches the commits from the URL into the store in a single negotiation, creating the store if needed.
+func fetchIntoGoGitStore(ctx context.Context, s *Store, url string, hashes []string, history model.History, auth transport.AuthMethod) error {
+	storage := filesystem.NewStorage(osfs.New(s.Dir()), cache.NewObjectLRUDefault())
+	repo, err := git.Open(withProgress(ctx, storage), nil)
+	if err == git.ErrRepositoryNotExists {
+		repo, err = git.Init(withProgress(ctx, storage), nil)
+		if err == nil {
+			_, err = repo.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{s.origin}})
+		}
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to open the store %s", s.Dir())
+	}
+
+	// The commits fetched before are the haves, the go-git fetch cannot negotiate in a shallow repository.
+	var haves []plumbing.Hash
+	refs, err := storage.IterReferences()
+	if err != nil {
+		return err
+	}
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference && strings.HasPrefix(ref.Name().String(), storeRefPrefix) {
+			haves = append(haves, ref.Hash())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	wants := make([]plumbing.Hash, 0, len(hashes))
+	for _, h := range hashes {
+		wants = append(wants, plumbing.NewHash(h))
+	}
+	if err := fetchPack(ctx, repo, url, wants, haves, history, auth); err != nil {
+		return err
+	}
+	for _, h := range wants {
+		ref := plumbing.NewHashReference(plumbing.ReferenceName(storeRefPrefix+h.String()), h)
+		if err := storage.SetReference(ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,18 +1,27 @@
 package source
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"math"
 	"os/user"
 	"strings"
 
 	"github.com/arekziobrowski/sourcerer/model"
-	"github.com/go-git/go-billy/v5"
 	"github.com/go-git/go-billy/v5/osfs"
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/config"
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/sideband"
 	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
 	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
 	"github.com/go-git/go-git/v5/storage/filesystem"
 	"github.com/pkg/errors"
@@ -29,9 +38,9 @@ func NewGitDownloader(wd string) *GitDownloader {
 	}
 }
 
-func (g *GitDownloader) Get(src *model.Source) error {
+func (g *GitDownloader) Get(ctx context.Context, src *model.Source) error {
 	const remoteName = "origin"
-	log.Infof("Downloading %s-%s", src.Origin, src.Hash)
+	log.Infof("Downloading %s-%s", model.Redact(src.Origin), src.Hash)
 
 	fs := osfs.New(g.workingDirectory)
 	dot, err := fs.Chroot(".git")
@@ -40,38 +49,58 @@ func (g *GitDownloader) Get(src *model.Source) error {
 	}
 	storage := filesystem.NewStorage(dot, cache.NewObjectLRUDefault())
 
-	repo, err := git.Init(storage, fs)
+	repo, err := git.Init(withProgress(ctx, storage), fs)
+	existing := err == git.ErrRepositoryAlreadyExists
+	if existing {
+		repo, err = git.Open(withProgress(ctx, storage), fs)
+	}
 	if err != nil {
 		return errors.Wrap(err, "failed to init repo")
 	}
 
-	remote, err := repo.CreateRemote(&config.RemoteConfig{
-		Name: remoteName,
-		URLs: []string{src.Origin},
-	})
+	remote, err := createRemote(repo, remoteName, src.FetchURL())
 	if err != nil {
-		return errors.Wrapf(err, "failed to invoke 'git remote add %s %s'", remoteName, src.Origin)
+		return errors.Wrapf(err, "failed to invoke 'git remote add %s %s'", remoteName, model.Redact(src.Origin))
 	}
 
-	sshAuth := getSshKeyAuth()
+	auth := getAuth(src)
 
-	branch, err := getDefaultBranchName(remote)
+	branch, err := getDefaultBranchName(ctx, remote, auth)
 	if err != nil {
 		return err
 	}
 
-	refSpec := config.RefSpec(fmt.Sprintf("%v:%v", src.Hash, strings.Join([]string{"refs/remotes", remoteName, branch}, "/")))
-	err = remote.Fetch(&git.FetchOptions{
-		RemoteName: remoteName,
-		Depth:      1,
-		RefSpecs: []config.RefSpec{
-			refSpec,
-		},
-		Auth: sshAuth,
-	})
+	history := src.FetchHistory()
+	remoteRef := plumbing.ReferenceName(strings.Join([]string{"refs/remotes", remoteName, branch}, "/"))
+	// The go-git fetch cannot negotiate in a shallow repository, so the repositories of the earlier runs
+	// are fetched into with the commit checked out as the have.
+	if history.Since.IsZero() && history.Exclude == "" && !existing {
+		depth := history.Depth
+		if history.Full {
+			depth = 0
+		}
+		err = remote.FetchContext(ctx, &git.FetchOptions{
+			RemoteName: remoteName,
+			Depth:      depth,
+			RefSpecs: []config.RefSpec{
+				config.RefSpec(fmt.Sprintf("%v:%v", src.Hash, remoteRef)),
+			},
+			Auth: auth,
+		})
+	} else {
+		var haves []plumbing.Hash
+		if head, err := repo.Head(); err == nil {
+			haves = append(haves, head.Hash())
+		}
+		err = fetchPack(ctx, repo, src.FetchURL(), []plumbing.Hash{plumbing.NewHash(src.Hash)}, haves, history, auth)
+		if err == nil {
+			err = repo.Storer.SetReference(plumbing.NewHashReference(remoteRef, plumbing.NewHash(src.Hash)))
+		}
+	}
 	if err != nil {
-		return errors.Wrapf(err, "failed to invoke 'git fetch %s %s --depth=1'", remoteName, src.Hash)
+		return errors.Wrapf(err, "failed to invoke 'git fetch %s %s' with %s", remoteName, src.Hash, history)
 	}
+	releaseMirror(ctx)
 
 	workTree, err := repo.Worktree()
 	if err != nil {
@@ -83,25 +112,185 @@ func (g *GitDownloader) Get(src *model.Source) error {
 		return errors.Wrap(err, "cannot resolve revision")
 	}
 
-	err = createHeadRef(fs, branch)
+	err = createHeadRef(repo, branch, *h)
 	if err != nil {
 		return err
 	}
 
-	err = workTree.Reset(&git.ResetOptions{
-		Commit: *h,
-		Mode:   git.HardReset,
-	})
+	if len(src.Options.SparsePaths) > 0 {
+		err = sparseCheckout(repo, fs, *h, src.Options.SparsePaths)
+		if err != nil {
+			return err
+		}
+	} else {
+		err = disableSparseCheckout(repo, fs)
+		if err != nil {
+			return errors.Wrap(err, "failed to disable sparse checkout")
+		}
+		err = workTree.Reset(&git.ResetOptions{
+			Commit: *h,
+			Mode:   git.HardReset,
+		})
+		if err != nil {
+			return errors.Wrap(err, "failed to invoke 'git reset --hard SHA1'")
+		}
+	}
+
+	if src.Mirror != "" {
+		err = setRemoteURL(repo, remoteName, src.Origin)
+		if err != nil {
+			return errors.Wrapf(err, "failed to set the remote URL to %s", model.Redact(src.Origin))
+		}
+	}
 
+	err = fetchLFSObjects(ctx, src, g.workingDirectory)
 	if err != nil {
-		return errors.Wrap(err, "failed to invoke 'git reset --hard SHA1'")
+		return errors.Wrap(err, "failed to download LFS objects")
 	}
-	log.Infof("Finished downloading for: %s-%s", src.Origin, src.Hash)
+
+	if src.Options.SubmodulesEnabled() {
+		links, err := gitlinks(repo, *h)
+		if err != nil {
+			return err
+		}
+		err = updateSubmodules(ctx, src, g.workingDirectory, links, func(wd string) downloader {
+			return NewGitDownloader(wd)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	log.Infof("Finished downloading for: %s-%s", model.Redact(src.Origin), src.Hash)
 	return nil
 }
 
-func getDefaultBranchName(remote *git.Remote) (string, error) {
-	refs, err := remote.List(&git.ListOptions{Auth: getSshKeyAuth()})
+// fetchPack fetches the commits along with their history in a single negotiation. Unlike the go-git fetch, it can limit
+// the history by a date or a reference, and it can fetch into a shallow repository: instead of walking the local
+// history, only the haves are reported as present.
+func fetchPack(ctx context.Context, repo *git.Repository, origin string, wants, haves []plumbing.Hash, history model.History, auth transport.AuthMethod) error {
+	ep, err := transport.NewEndpoint(origin)
+	if err != nil {
+		return err
+	}
+	cl, err := client.NewClient(ep)
+	if err != nil {
+		return err
+	}
+	session, err := cl.NewUploadPackSession(ep, auth)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	ar, err := session.AdvertisedReferencesContext(ctx)
+	if err != nil {
+		return err
+	}
+	shallows, err := repo.Storer.Shallow()
+	if err != nil {
+		return err
+	}
+
+	req := packp.NewUploadPackRequestFromCapabilities(ar.Capabilities)
+	req.Wants = wants
+	req.Haves = haves
+	req.Shallows = shallows
+	req.Capabilities.Delete(capability.ThinPack)
+	var deepen capability.Capability
+	switch {
+	case history.Full && len(shallows) > 0:
+		// The same as 'git fetch --unshallow'.
+		req.Depth = packp.DepthCommits(math.MaxInt32)
+	case history.Full:
+	case !history.Since.IsZero():
+		deepen = capability.DeepenSince
+		req.Depth = packp.DepthSince(history.Since)
+	case history.Exclude != "":
+		deepen = capability.DeepenNot
+		req.Depth = packp.DepthReference(history.Exclude)
+	default:
+		req.Depth = packp.DepthCommits(history.Depth)
+	}
+	if deepen != "" {
+		if !ar.Capabilities.Supports(deepen) {
+			return errors.Errorf("the remote does not support %s", deepen)
+		}
+		if err := req.Capabilities.Set(deepen); err != nil {
+			return err
+		}
+	}
+	if !req.Depth.IsZero() || len(shallows) > 0 {
+		if err := req.Capabilities.Set(capability.Shallow); err != nil {
+			return err
+		}
+	}
+
+	resp, err := session.UploadPack(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Close()
+	if err := updateShallows(repo, shallows, resp.ShallowUpdate); err != nil {
+		return err
+	}
+	var pack io.Reader = resp
+	switch {
+	case req.Capabilities.Supports(capability.Sideband64k):
+		pack = sideband.NewDemuxer(sideband.Sideband64k, resp)
+	case req.Capabilities.Supports(capability.Sideband):
+		pack = sideband.NewDemuxer(sideband.Sideband, resp)
+	}
+	return packfile.UpdateObjectStorage(repo.Storer, pack)
+}
+
+func updateShallows(repo *git.Repository, shallows []plumbing.Hash, update packp.ShallowUpdate) error {
+	if len(update.Shallows) == 0 && len(update.Unshallows) == 0 {
+		return nil
+	}
+	unshallows := make(map[plumbing.Hash]bool, len(update.Unshallows))
+	for _, h := range update.Unshallows {
+		unshallows[h] = true
+	}
+	seen := make(map[plumbing.Hash]bool, len(shallows)+len(update.Shallows))
+	var updated []plumbing.Hash
+	for _, h := range append(shallows, update.Shallows...) {
+		if !seen[h] && !unshallows[h] {
+			seen[h] = true
+			updated = append(updated, h)
+		}
+	}
+	return repo.Storer.SetShallow(updated)
+}
+
+// gitlinks returns the submodule entries of the commit tree.
+func gitlinks(repo *git.Repository, hash plumbing.Hash) ([]gitlink, error) {
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot find commit %s", hash)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	walker := object.NewTreeWalker(tree, true, nil)
+	defer walker.Close()
+
+	var links []gitlink
+	for {
+		name, entry, err := walker.Next()
+		if err == io.EOF {
+			return links, nil
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot walk the tree")
+		}
+		if entry.Mode == filemode.Submodule {
+			links = append(links, gitlink{path: name, hash: entry.Hash.String()})
+		}
+	}
+}
+
+func getDefaultBranchName(ctx context.Context, remote *git.Remote, auth transport.AuthMethod) (string, error) {
+	refs, err := remote.ListContext(ctx, &git.ListOptions{Auth: auth})
 	if err != nil {
 		return "", errors.Wrap(err, "cannot invoke ls-remote")
 	}
@@ -114,20 +303,64 @@ func getDefaultBranchName(remote *git.Remote) (string, error) {
 	return "", errors.New("cannot find a HEAD reference in remote references list")
 }
 
-func createHeadRef(fs billy.Filesystem, refName string) error {
-	heads, err := fs.Chroot(".git/refs/heads")
-	if err != nil {
-		return errors.Wrap(err, "cannot chroot for .git/refs/heads")
+// createHeadRef points the branch at the commit and HEAD at the branch, the same way as in a clone of the remote.
+func createHeadRef(repo *git.Repository, branch string, hash plumbing.Hash) error {
+	name := plumbing.NewBranchReferenceName(branch)
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(name, hash)); err != nil {
+		return errors.Wrapf(err, "cannot create a refname: %s", name)
 	}
-	_, err = heads.Create(refName)
-	if err != nil {
-		return errors.Wrapf(err, "cannot create a refname: %s", refName)
+	if err := repo.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, name)); err != nil {
+		return errors.Wrapf(err, "cannot point HEAD to %s", name)
 	}
 	return nil
 }
 
+// createRemote creates the remote, or sets its URL if the repository was created by an earlier run.
+func createRemote(repo *git.Repository, name, url string) (*git.Remote, error) {
+	remote, err := repo.CreateRemote(&config.RemoteConfig{
+		Name: name,
+		URLs: []string{url},
+	})
+	if err != git.ErrRemoteExists {
+		return remote, err
+	}
+	if err := setRemoteURL(repo, name, url); err != nil {
+		return nil, err
+	}
+	return repo.Remote(name)
+}
+
+// setRemoteURL sets the URL of the remote in the repository configuration.
+func setRemoteURL(repo *git.Repository, name, url string) error {
+	cfg, err := repo.Config()
+	if err != nil {
+		return err
+	}
+	remote, ok := cfg.Remotes[name]
+	if !ok {
+		return errors.Errorf("remote %s not found", name)
+	}
+	remote.URLs = []string{url}
+	return repo.SetConfig(cfg)
+}
+
+// getAuth returns the SSH key authentication for SSH origins. Other transports, including the local mirrors,
+// are used anonymously.
+func getAuth(src *model.Source) transport.AuthMethod {
+	if src.Scheme != model.SchemeSSH || src.Mirror != "" {
+		return nil
+	}
+	return getSshKeyAuth()
+}
+
 func getSshKeyAuth() transport.AuthMethod {
-	usr, _ := user.Current()
-	auth, _ := ssh.NewPublicKeysFromFile("git", usr.HomeDir+"/.ssh/id_rsa", "")
+	usr, err := user.Current()
+	if err != nil {
+		return nil
+	}
+	auth, err := ssh.NewPublicKeysFromFile("git", usr.HomeDir+"/.ssh/id_rsa", "")
+	if err != nil {
+		return nil
+	}
 	return auth
 }
@@ -0,0 +1,50 @@
+package source
+
+import (
+	"context"
+	"testing"
+
+	"github.com/arekziobrowski/sourcerer/model"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+func TestFetchPackHistory(t *testing.T) {
+	origin, hashes := newHistoryTestOrigin(t)
+	tip := plumbing.NewHash(hashes[4])
+	for _, tt := range historyTests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := filesystem.NewStorage(osfs.New(t.TempDir()), cache.NewObjectLRUDefault())
+			repo, err := git.Init(storage, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var haves []plumbing.Hash
+			if tt.history.Full {
+				// The complete history is fetched into a shallow repository.
+				if err := fetchPack(context.Background(), repo, origin, []plumbing.Hash{tip}, nil, model.History{Depth: 1}, nil); err != nil {
+					t.Fatal(err)
+				}
+				haves = []plumbing.Hash{tip}
+			}
+			if err := fetchPack(context.Background(), repo, origin, []plumbing.Hash{tip}, haves, tt.history, nil); err != nil {
+				t.Fatalf("the fetch failed: %v", err)
+			}
+			has := func(hash string) bool {
+				return storage.HasEncodedObject(plumbing.NewHash(hash)) == nil
+			}
+			shallows, err := storage.Shallow()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var shallow []string
+			for _, h := range shallows {
+				shallow = append(shallow, h.String())
+			}
+			checkHistory(t, hashes, has, shallow, tt.wantCommits, tt.wantShallow)
+		})
+	}
+}
@@ -2,14 +2,19 @@ package source
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"os/exec"
 	"strings"
 
 	"github.com/arekziobrowski/sourcerer/model"
+	"github.com/go-git/go-billy/v5/osfs"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
+const blobFilter = "blob:none"
+
 type SystemGitDownloader struct {
 	workingDirectory string
 }
@@ -20,60 +25,223 @@ func NewSystemGitDownloader(wd string) *SystemGitDownloader {
 	}
 }
 
-func (g *SystemGitDownloader) Get(src *model.Source) error {
+func (g *SystemGitDownloader) Get(ctx context.Context, src *model.Source) error {
 	const remoteName = "origin"
-	log.Infof("Downloading %s-%s", src.Origin, src.Hash)
+	log.Infof("Downloading %s-%s", model.Redact(src.Origin), src.Hash)
 
-	err := g.initialize()
+	err := g.initialize(ctx)
 	if err != nil {
-		return errors.Wrapf(err, "failed to initialize the repository: %s", src)
+		return errors.Wrapf(err, "failed to initialize the repository: %s", model.Redact(src.Origin))
 	}
 
-	err = g.remoteAdd(remoteName, src.Origin)
+	err = g.setRemote(ctx, remoteName, src.FetchURL())
 	if err != nil {
-		return errors.Wrapf(err, "failed to add remote for %s", src.Origin)
+		return errors.Wrapf(err, "failed to add remote for %s", model.Redact(src.Origin))
+	}
+
+	sparse := len(src.Options.SparsePaths) > 0
+	if sparse {
+		err = g.configureSparseCheckout(ctx, remoteName, src.Options.SparsePaths)
+		if err != nil {
+			return errors.Wrap(err, "failed to configure sparse checkout")
+		}
+	} else {
+		err = g.disableSparseCheckout(ctx)
+		if err != nil {
+			return errors.Wrap(err, "failed to disable sparse checkout")
+		}
 	}
 
-	err = g.fetch(remoteName, src.Hash)
+	err = g.fetch(ctx, remoteName, src.Hash, src.FetchHistory(), sparse)
 	if err != nil {
 		return errors.Wrapf(err, "failed to fetch from remote for revision: %s", src.Hash)
 	}
 
-	err = g.reset()
+	err = g.reset(ctx)
 	if err != nil {
 		return errors.Wrap(err, "failed to reset to FETCH_HEAD")
 	}
 
-	log.Infof("Finished downloading for: %s-%s", src.Origin, src.Hash)
+	if src.Mirror != "" {
+		err = run(ctx, g.workingDirectory, "git", "remote", "set-url", "--", remoteName, src.Origin)
+		if err != nil {
+			return errors.Wrapf(err, "failed to set the remote URL to %s", model.Redact(src.Origin))
+		}
+	}
+	// The blobs filtered out of a sparse fetch are fetched by the checkout, so the mirror is read until then.
+	releaseMirror(ctx)
+
+	err = fetchLFSObjects(ctx, src, g.workingDirectory)
+	if err != nil {
+		return errors.Wrap(err, "failed to download LFS objects")
+	}
+
+	if src.Options.SubmodulesEnabled() {
+		links, err := g.gitlinks(ctx)
+		if err != nil {
+			return errors.Wrap(err, "failed to list submodules")
+		}
+		err = updateSubmodules(ctx, src, g.workingDirectory, links, func(wd string) downloader {
+			return NewSystemGitDownloader(wd)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Infof("Finished downloading for: %s-%s", model.Redact(src.Origin), src.Hash)
 
 	return nil
 }
 
-func (g *SystemGitDownloader) initialize() error {
-	return run(g.workingDirectory, "git", "init")
+func (g *SystemGitDownloader) initialize(ctx context.Context) error {
+	return run(ctx, g.workingDirectory, "git", "init")
 }
 
-func (g *SystemGitDownloader) remoteAdd(originName, remote string) error {
-	return run(g.workingDirectory, "git", "remote", "add", originName, remote)
+func (g *SystemGitDownloader) remoteAdd(ctx context.Context, originName, remote string) error {
+	return run(ctx, g.workingDirectory, "git", "remote", "add", "--", originName, remote)
 }
 
-func (g *SystemGitDownloader) fetch(originName, hash string) error {
-	return run(g.workingDirectory, "git", "fetch", originName, hash, "--depth=1")
+// setRemote adds the remote, or sets its URL if the repository was created by an earlier run.
+func (g *SystemGitDownloader) setRemote(ctx context.Context, originName, remote string) error {
+	cmd := exec.CommandContext(ctx, "git", "remote", "get-url", originName)
+	cmd.Dir = g.workingDirectory
+	if cmd.Run() != nil {
+		return g.remoteAdd(ctx, originName, remote)
+	}
+	return run(ctx, g.workingDirectory, "git", "remote", "set-url", "--", originName, remote)
 }
 
-func (g *SystemGitDownloader) reset() error {
-	return run(g.workingDirectory, "git", "reset", "--hard", "FETCH_HEAD")
+// configureSparseCheckout makes the remote a partial clone source, so that only the blobs of the sparse paths
+// are downloaded when the worktree is checked out.
+func (g *SystemGitDownloader) configureSparseCheckout(ctx context.Context, originName string, patterns []string) error {
+	if err := writeSparseCheckoutFile(osfs.New(g.workingDirectory), patterns); err != nil {
+		return err
+	}
+	if err := run(ctx, g.workingDirectory, "git", "config", "core.sparseCheckout", "true"); err != nil {
+		return err
+	}
+	if err := run(ctx, g.workingDirectory, "git", "config", "remote."+originName+".promisor", "true"); err != nil {
+		return err
+	}
+	return run(ctx, g.workingDirectory, "git", "config", "remote."+originName+".partialclonefilter", blobFilter)
 }
 
-func run(wd, command string, args ...string) error {
-	cmd := exec.Command(command, args...)
+// disableSparseCheckout checks out all the paths of a repository sparsely checked out by an earlier run,
+// the same way 'git sparse-checkout disable' does.
+func (g *SystemGitDownloader) disableSparseCheckout(ctx context.Context) error {
+	cmd := exec.CommandContext(ctx, "git", "config", "--bool", "core.sparseCheckout")
+	cmd.Dir = g.workingDirectory
+	if out, err := cmd.Output(); err != nil || strings.TrimSpace(string(out)) != "true" {
+		return nil
+	}
+	if err := writeSparseCheckoutFile(osfs.New(g.workingDirectory), []string{"/*"}); err != nil {
+		return err
+	}
+	if err := run(ctx, g.workingDirectory, "git", "read-tree", "-mu", "HEAD"); err != nil {
+		return err
+	}
+	return run(ctx, g.workingDirectory, "git", "config", "core.sparseCheckout", "false")
+}
+
+func (g *SystemGitDownloader) fetch(ctx context.Context, originName, hash string, history model.History, sparse bool) error {
+	// The directory may be left shallow by an earlier download of the source.
+	args, err := fetchHistoryArgs(ctx, g.workingDirectory, history)
+	if err != nil {
+		return err
+	}
+	if sparse {
+		args = append(args, "--filter="+blobFilter)
+	}
+	return fetch(ctx, g.workingDirectory, append(args, "--", originName, hash)...)
+}
+
+// historyArgs returns the 'git fetch' arguments limiting the fetched history.
+func historyArgs(history model.History) []string {
+	switch {
+	case history.Full:
+		return nil
+	case !history.Since.IsZero():
+		return []string{fmt.Sprintf("--shallow-since=%d", history.Since.Unix())}
+	case history.Exclude != "":
+		return []string{"--shallow-exclude=" + history.Exclude}
+	default:
+		return []string{fmt.Sprintf("--depth=%d", history.Depth)}
+	}
+}
+
+// fetchHistoryArgs returns the 'git fetch' arguments limiting the history fetched into the repository in dir,
+// unshallowing the repository if the complete history is fetched into a shallow one.
+func fetchHistoryArgs(ctx context.Context, dir string, history model.History) ([]string, error) {
+	args := historyArgs(history)
+	if history.Full {
+		shallow, err := output(ctx, dir, "git", "rev-parse", "--is-shallow-repository")
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(shallow) == "true" {
+			args = append(args, "--unshallow")
+		}
+	}
+	return args, nil
+}
+
+func (g *SystemGitDownloader) reset(ctx context.Context) error {
+	return run(ctx, g.workingDirectory, "git", "reset", "--hard", "FETCH_HEAD")
+}
+
+// gitlinks returns the submodule entries of the HEAD tree.
+func (g *SystemGitDownloader) gitlinks(ctx context.Context) ([]gitlink, error) {
+	out, err := output(ctx, g.workingDirectory, "git", "ls-tree", "-r", "-z", "HEAD")
+	if err != nil {
+		return nil, err
+	}
+	var links []gitlink
+	for _, entry := range strings.Split(out, "\x00") {
+		// <mode> SP <type> SP <object> TAB <file>
+		tab := strings.IndexByte(entry, '\t')
+		if tab < 0 {
+			continue
+		}
+		fields := strings.Fields(entry[:tab])
+		if len(fields) == 3 && fields[0] == "160000" {
+			links = append(links, gitlink{path: entry[tab+1:], hash: fields[2]})
+		}
+	}
+	return links, nil
+}
+
+func output(ctx context.Context, wd, command string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, command, args...)
+	cmd.Dir = wd
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", commandError(ctx, wd, command, args, stderr.String(), err)
+	}
+	return stdout.String(), nil
+}
+
+func run(ctx context.Context, wd, command string, args ...string) error {
+	cmd := exec.CommandContext(ctx, command, args...)
 	cmd.Dir = wd
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
-	err := cmd.Run()
-	if err != nil {
-		log.Errorf("[%s] Error occured when running %q: %s", wd, command+" "+strings.Join(args, " "), stderr.String())
-		return err
+	if err := cmd.Run(); err != nil {
+		return commandError(ctx, wd, command, args, stderr.String(), err)
 	}
 	return nil
 }
+
+// commandError returns the failure of the command. A command killed because the context is done fails with
+// the error of the context. The credentials in the command line and in the output are redacted.
+func commandError(ctx context.Context, wd, command string, args []string, stderr string, err error) error {
+	line := model.Redact(command + " " + strings.Join(args, " "))
+	stderr = model.Redact(stderr)
+	log.Debugf("[%s] Error occured when running %q: %s", wd, line, stderr)
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return &CommandError{Command: line, Stderr: stderr, Err: err}
+}
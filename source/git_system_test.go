@@ -0,0 +1,146 @@
+package source
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arekziobrowski/sourcerer/model"
+)
+
+func TestHistoryArgs(t *testing.T) {
+	since := time.Date(2020, 9, 13, 12, 26, 40, 0, time.UTC)
+	tests := []struct {
+		name    string
+		history model.History
+		want    []string
+	}{
+		{name: "full", history: model.History{Full: true}, want: nil},
+		{name: "since", history: model.History{Since: since}, want: []string{"--shallow-since=1600000000"}},
+		{name: "exclude", history: model.History{Exclude: "v1.0"}, want: []string{"--shallow-exclude=v1.0"}},
+		{name: "depth", history: model.History{Depth: 3}, want: []string{"--depth=3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := historyArgs(tt.history); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("historyArgs(%+v) = %q, want %q", tt.history, got, tt.want)
+			}
+		})
+	}
+}
+
+// historyTestStart is the date of the first commit of the history test origin, the next ones are a day apart.
+var historyTestStart = time.Date(2020, 9, 13, 12, 26, 40, 0, time.UTC)
+
+// newHistoryTestOrigin creates a repository with five commits a day apart, the second one tagged v2,
+// and returns its origin and the commits from the oldest one.
+func newHistoryTestOrigin(t *testing.T) (string, []string) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir := t.TempDir()
+	gitTest(t, dir, "init", "-q")
+	gitTest(t, dir, "config", "uploadpack.allowAnySHA1InWant", "true")
+	var hashes []string
+	for i := 0; i < 5; i++ {
+		if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte(fmt.Sprintln(i)), 0666); err != nil {
+			t.Fatal(err)
+		}
+		gitTest(t, dir, "add", "file")
+		date := fmt.Sprintf("%d +0000", historyTestStart.AddDate(0, 0, i).Unix())
+		cmd := exec.Command("git", "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", fmt.Sprint(i))
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_DATE="+date, "GIT_COMMITTER_DATE="+date)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git commit failed: %v: %s", err, out)
+		}
+		hashes = append(hashes, strings.TrimSpace(gitTest(t, dir, "rev-parse", "HEAD")))
+	}
+	gitTest(t, dir, "tag", "v2", hashes[1])
+	return "file://" + filepath.ToSlash(dir), hashes
+}
+
+// historyTests are the histories fetched at the last commit of the history test origin, with the indexes
+// of the commits fetched and of the shallow commits.
+var historyTests = []struct {
+	name        string
+	history     model.History
+	wantCommits []int
+	wantShallow []int
+}{
+	{name: "depth", history: model.History{Depth: 2}, wantCommits: []int{3, 4}, wantShallow: []int{3}},
+	{name: "since", history: model.History{Since: historyTestStart.AddDate(0, 0, 2)}, wantCommits: []int{2, 3, 4}, wantShallow: []int{2}},
+	{name: "exclude", history: model.History{Exclude: "v2"}, wantCommits: []int{2, 3, 4}, wantShallow: []int{2}},
+	{name: "full", history: model.History{Full: true}, wantCommits: []int{0, 1, 2, 3, 4}},
+}
+
+// checkHistory checks that only the wanted commits were fetched and that the shallow commits are as wanted.
+func checkHistory(t *testing.T, hashes []string, has func(hash string) bool, shallow []string, wantCommits, wantShallow []int) {
+	t.Helper()
+	for i, hash := range hashes {
+		want := false
+		for _, j := range wantCommits {
+			want = want || i == j
+		}
+		if got := has(hash); got != want {
+			t.Errorf("commit %d fetched = %v, want %v", i, got, want)
+		}
+	}
+	want := []string{}
+	for _, i := range wantShallow {
+		want = append(want, hashes[i])
+	}
+	got := append([]string{}, shallow...)
+	sort.Strings(got)
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("shallow = %q, want %q", got, want)
+	}
+}
+
+// systemShallow returns the shallow commits of the repository in the directory.
+func systemShallow(t *testing.T, dir string) []string {
+	t.Helper()
+	data, err := ioutil.ReadFile(filepath.Join(dir, ".git", "shallow"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Fields(string(data))
+}
+
+func TestSystemGitFetchHistory(t *testing.T) {
+	origin, hashes := newHistoryTestOrigin(t)
+	for _, tt := range historyTests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			gitTest(t, dir, "init", "-q")
+			gitTest(t, dir, "remote", "add", "origin", origin)
+			g := NewSystemGitDownloader(dir)
+			if tt.history.Full {
+				// The complete history is fetched into a shallow repository.
+				if err := g.fetch(context.Background(), "origin", hashes[4], model.History{Depth: 1}, false); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := g.fetch(context.Background(), "origin", hashes[4], tt.history, false); err != nil {
+				t.Fatalf("the fetch failed: %v", err)
+			}
+			has := func(hash string) bool {
+				return exec.Command("git", "-C", dir, "cat-file", "-e", hash).Run() == nil
+			}
+			checkHistory(t, hashes, has, systemShallow(t, dir), tt.wantCommits, tt.wantShallow)
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package source
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/arekziobrowski/sourcerer/model"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// SystemGitWorktreeDownloader checks out the source as a 'git worktree' of the store of its origin,
+// so that the objects are shared with the other sources of the origin.
+type SystemGitWorktreeDownloader struct {
+	workingDirectory string
+	store            *Store
+}
+
+func NewSystemGitWorktreeDownloader(wd string, store *Store) *SystemGitWorktreeDownloader {
+	return &SystemGitWorktreeDownloader{
+		workingDirectory: wd,
+		store:            store,
+	}
+}
+
+func (g *SystemGitWorktreeDownloader) Get(ctx context.Context, src *model.Source) error {
+	log.Infof("Downloading %s-%s", model.Redact(src.Origin), src.Hash)
+
+	err := g.store.fetch(src.Hash, src.FetchHistory(), func(s *Store, hashes []string, history model.History) error {
+		return fetchIntoStore(ctx, s, src.FetchURL(), hashes, history)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to fetch from remote for revision: %s", src.Hash)
+	}
+	releaseMirror(ctx)
+
+	if _, err := os.Lstat(filepath.Join(g.workingDirectory, ".git")); err == nil {
+		// The worktree added by an earlier run is moved to the commit.
+		err = run(ctx, g.workingDirectory, "git", "update-ref", "--no-deref", "--", "HEAD", src.Hash)
+		if err != nil {
+			return errors.Wrapf(err, "failed to update the worktree of %s", g.store.Dir())
+		}
+	} else {
+		// Adding a worktree changes the store, the checkout itself only writes to the worktree.
+		err = g.store.locked(func() error {
+			if err := run(ctx, g.store.Dir(), "git", "worktree", "prune"); err != nil {
+				return err
+			}
+			return run(ctx, g.store.Dir(), "git", "worktree", "add", "--detach", "--no-checkout", "--", g.workingDirectory, src.Hash)
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to add a worktree of %s", g.store.Dir())
+		}
+	}
+	err = (&SystemGitDownloader{workingDirectory: g.workingDirectory}).disableSparseCheckout(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to disable sparse checkout")
+	}
+	err = run(ctx, g.workingDirectory, "git", "reset", "--hard")
+	if err != nil {
+		return errors.Wrapf(err, "failed to check out %s", src.Hash)
+	}
+
+	err = fetchLFSObjects(ctx, src, g.workingDirectory)
+	if err != nil {
+		return errors.Wrap(err, "failed to download LFS objects")
+	}
+
+	if src.Options.SubmodulesEnabled() {
+		links, err := (&SystemGitDownloader{workingDirectory: g.workingDirectory}).gitlinks(ctx)
+		if err != nil {
+			return errors.Wrap(err, "failed to list submodules")
+		}
+		err = updateSubmodules(ctx, src, g.workingDirectory, links, func(wd string) downloader {
+			return NewSystemGitDownloader(wd)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Infof("Finished downloading for: %s-%s", model.Redact(src.Origin), src.Hash)
+	return nil
+}
+
+// fetchIntoStore fetches the commits from the URL into the store with a single 'git fetch', creating the store if needed.
+func fetchIntoStore(ctx context.Context, s *Store, url string, hashes []string, history model.History) error {
+	if _, err := os.Stat(filepath.Join(s.Dir(), "HEAD")); os.IsNotExist(err) {
+		if err := initStore(ctx, s); err != nil {
+			return errors.Wrapf(err, "failed to initialize the store %s", s.Dir())
+		}
+	}
+	args, err := fetchHistoryArgs(ctx, s.Dir(), history)
+	if err != nil {
+		return err
+	}
+	args = append(args, "--", url)
+	for _, h := range hashes {
+		args = append(args, h+":"+storeRefPrefix+h)
+	}
+	return fetch(ctx, s.Dir(), args...)
+}
+
+func initStore(ctx context.Context, s *Store) error {
+	if err := os.MkdirAll(s.Dir(), 0777); err != nil {
+		return err
+	}
+	if err := run(ctx, s.Dir(), "git", "init", "--bare"); err != nil {
+		return err
+	}
+	if err := run(ctx, s.Dir(), "git", "remote", "add", "--", "origin", s.origin); err != nil {
+		return err
+	}
+	// The automatic garbage collection would compete with the concurrent checkouts.
+	return run(ctx, s.Dir(), "git", "config", "gc.auto", "0")
+}
+
+// MoveDirectory renames the directory of a source, and points the store at the directory if it is a worktree.
+// The store of the worktree has to be locked, see Store.MoveDirectory.
+func MoveDirectory(from, to string) error {
+	if err := os.Rename(from, to); err != nil {
+		return err
+	}
+	return relocateWorktree(to)
+}
+
+// MoveDirectory renames the directory of a source of the store holding the lock of the store, so that a concurrent
+// 'git worktree prune' does not remove the worktree from the store before it is relocated.
+func (s *Store) MoveDirectory(from, to string) error {
+	return s.locked(func() error {
+		return MoveDirectory(from, to)
+	})
+}
+
+// relocateWorktree points the store at the worktree in the directory after the directory was moved, the same way
+// 'git worktree repair' does, so that the worktree is not pruned. Other repositories are left as they are.
+func relocateWorktree(dir string) error {
+	dotGit := filepath.Join(dir, ".git")
+	info, err := os.Lstat(dotGit)
+	if os.IsNotExist(err) || err == nil && info.IsDir() {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(dotGit)
+	if err != nil {
+		return err
+	}
+	admin := strings.TrimSpace(strings.TrimPrefix(string(content), "gitdir:"))
+	if !filepath.IsAbs(admin) {
+		admin = filepath.Join(dir, admin)
+	}
+	abs, err := filepath.Abs(dotGit)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(admin, "gitdir"), []byte(abs+"\n"), 0666)
+}
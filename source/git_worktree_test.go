@@ -0,0 +1,102 @@
+package source
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// gitTest runs the git command in the directory, failing the test on errors.
+func gitTest(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s failed: %v: %s", strings.Join(args, " "), err, out)
+	}
+	return string(out)
+}
+
+func TestMoveDirectory(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	tests := []struct {
+		name string
+		// create creates the source directory in dir, checked out from the store if it is a worktree.
+		create   func(t *testing.T, store, dir string)
+		worktree bool
+	}{
+		{
+			name: "worktree",
+			create: func(t *testing.T, store, dir string) {
+				gitTest(t, store, "worktree", "add", "--detach", dir, "HEAD")
+			},
+			worktree: true,
+		},
+		{
+			name: "repository",
+			create: func(t *testing.T, store, dir string) {
+				gitTest(t, filepath.Dir(dir), "clone", "-q", store, dir)
+			},
+		},
+		{
+			name: "directory",
+			create: func(t *testing.T, store, dir string) {
+				if err := os.Mkdir(dir, 0777); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			work := filepath.Join(root, "work")
+			gitTest(t, root, "init", "-q", work)
+			if err := ioutil.WriteFile(filepath.Join(work, "f"), []byte("content\n"), 0666); err != nil {
+				t.Fatal(err)
+			}
+			gitTest(t, work, "add", "f")
+			gitTest(t, work, "commit", "-q", "-m", "test")
+			storeDir := filepath.Join(root, "store.git")
+			gitTest(t, root, "clone", "-q", "--bare", work, storeDir)
+			store := NewStore(storeDir, work)
+
+			from := filepath.Join(root, "staging", "src")
+			to := filepath.Join(root, "dst", "src")
+			for _, dir := range []string{filepath.Dir(from), filepath.Dir(to)} {
+				if err := os.MkdirAll(dir, 0777); err != nil {
+					t.Fatal(err)
+				}
+			}
+			tt.create(t, storeDir, from)
+			if err := store.MoveDirectory(from, to); err != nil {
+				t.Fatalf("MoveDirectory failed: %v", err)
+			}
+			if _, err := os.Stat(from); !os.IsNotExist(err) {
+				t.Errorf("%s is left after the move", from)
+			}
+			// The worktree is not pruned once it is moved.
+			if err := run(context.Background(), storeDir, "git", "worktree", "prune"); err != nil {
+				t.Fatal(err)
+			}
+			list := gitTest(t, storeDir, "worktree", "list", "--porcelain")
+			if strings.Contains(list, to) != tt.worktree {
+				t.Errorf("worktree list of the store:\n%s\nwant %s listed: %v", list, to, tt.worktree)
+			}
+			if tt.worktree || tt.name == "repository" {
+				if out := gitTest(t, to, "status", "--porcelain"); out != "" {
+					t.Errorf("the moved source has changes:\n%s", out)
+				}
+			}
+		})
+	}
+}
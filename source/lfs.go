@@ -0,0 +1,482 @@
+package source
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/arekziobrowski/sourcerer/model"
+	formatcfg "github.com/go-git/go-git/v5/plumbing/format/config"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	lfsPointerVersion = "version https://git-lfs.github.com/spec/v1"
+	lfsMediaType      = "application/vnd.git-lfs+json"
+	lfsConfigFile     = ".lfsconfig"
+	// maxLFSPointerSize is the size of the largest pointer file allowed by the specification.
+	maxLFSPointerSize = 1024
+	// lfsBatchSize is the number of objects requested at once, the same as the git-lfs default.
+	lfsBatchSize = 100
+)
+
+type lfsObject struct {
+	OID  string `json:"oid"`
+	Size int64  `json:"size"`
+}
+
+type lfsBatchRequest struct {
+	Operation string      `json:"operation"`
+	Transfers []string    `json:"transfers"`
+	Objects   []lfsObject `json:"objects"`
+}
+
+type lfsBatchResponse struct {
+	Transfer string              `json:"transfer"`
+	Objects  []lfsObjectResponse `json:"objects"`
+	Message  string              `json:"message"`
+}
+
+type lfsObjectResponse struct {
+	lfsObject
+	Actions map[string]lfsAction `json:"actions"`
+	Error   *lfsObjectError      `json:"error"`
+}
+
+type lfsAction struct {
+	Href   string            `json:"href"`
+	Header map[string]string `json:"header"`
+}
+
+type lfsObjectError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// lfsPointer is a pointer file found in the worktree.
+type lfsPointer struct {
+	lfsObject
+	// path is slash-separated and relative to the worktree.
+	path string
+}
+
+// fetchLFSObjects replaces the LFS pointer files of the worktree with the objects downloaded with the LFS batch API.
+// The pointer files left in place are recorded in the source.
+func fetchLFSObjects(ctx context.Context, src *model.Source, wd string) error {
+	if !src.Options.LFSEnabled() {
+		return nil
+	}
+	pointers, err := findLFSPointers(wd)
+	if err != nil {
+		return errors.Wrap(err, "failed to find LFS pointer files")
+	}
+	if len(pointers) == 0 {
+		return nil
+	}
+
+	opts := src.Options.LFS
+	include := newSparseMatcher(opts.Include)
+	exclude := newSparseMatcher(opts.Exclude)
+	var wanted []lfsPointer
+	for _, p := range pointers {
+		path := strings.Split(p.path, "/")
+		switch {
+		case include != nil && !include.Match(path, false):
+			unresolvedLFSPointer(src, p, "not included")
+		case exclude != nil && exclude.Match(path, false):
+			unresolvedLFSPointer(src, p, "excluded")
+		case opts.MaxSize > 0 && p.Size > opts.MaxSize:
+			unresolvedLFSPointer(src, p, fmt.Sprintf("larger than %d bytes", opts.MaxSize))
+		default:
+			wanted = append(wanted, p)
+		}
+	}
+	if len(wanted) == 0 {
+		return nil
+	}
+
+	client, err := newLFSClient(ctx, src.Origin, wd)
+	if err != nil {
+		return err
+	}
+	if client == nil {
+		for _, p := range wanted {
+			unresolvedLFSPointer(src, p, "no LFS endpoint for the origin")
+		}
+		return nil
+	}
+
+	log.Infof("Downloading %d LFS objects of %s-%s from %s", len(wanted), model.Redact(src.Origin), src.Hash, model.Redact(client.endpoint))
+	downloaded := 0
+	for start := 0; start < len(wanted); start += lfsBatchSize {
+		end := start + lfsBatchSize
+		if end > len(wanted) {
+			end = len(wanted)
+		}
+		downloaded += client.fetch(ctx, src, wd, wanted[start:end])
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	log.Infof("Downloaded %d of %d LFS objects of %s-%s", downloaded, len(wanted), model.Redact(src.Origin), src.Hash)
+	return nil
+}
+
+func unresolvedLFSPointer(src *model.Source, p lfsPointer, reason string) {
+	src.UnresolvedLFSPointers = append(src.UnresolvedLFSPointers, model.LFSPointer{
+		Path:   p.path,
+		OID:    p.OID,
+		Size:   p.Size,
+		Reason: reason,
+	})
+}
+
+// findLFSPointers returns the pointer files of the worktree. The repositories nested in the worktree are skipped.
+func findLFSPointers(wd string) ([]lfsPointer, error) {
+	var pointers []lfsPointer
+	err := filepath.Walk(wd, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			if path != wd {
+				if _, err := os.Lstat(filepath.Join(path, ".git")); err == nil {
+					return filepath.SkipDir
+				}
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() || info.Size() > maxLFSPointerSize {
+			return nil
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		obj, ok := parseLFSPointer(content)
+		if !ok {
+			return nil
+		}
+		rel, err := filepath.Rel(wd, path)
+		if err != nil {
+			return err
+		}
+		pointers = append(pointers, lfsPointer{lfsObject: obj, path: filepath.ToSlash(rel)})
+		return nil
+	})
+	return pointers, err
+}
+
+// parseLFSPointer parses the pointer file, see https://github.com/git-lfs/git-lfs/blob/main/docs/spec.md.
+func parseLFSPointer(content []byte) (lfsObject, bool) {
+	var obj lfsObject
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	if len(lines) < 3 || lines[0] != lfsPointerVersion {
+		return obj, false
+	}
+	sized := false
+	for _, line := range lines[1:] {
+		sep := strings.IndexByte(line, ' ')
+		if sep < 0 {
+			return obj, false
+		}
+		key, value := line[:sep], line[sep+1:]
+		switch key {
+		case "oid":
+			if !strings.HasPrefix(value, "sha256:") {
+				return obj, false
+			}
+			obj.OID = strings.TrimPrefix(value, "sha256:")
+		case "size":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || size < 0 {
+				return obj, false
+			}
+			obj.Size = size
+			sized = true
+		}
+	}
+	if _, err := hex.DecodeString(obj.OID); err != nil || len(obj.OID) != 2*sha256.Size || !sized {
+		return obj, false
+	}
+	return obj, true
+}
+
+// newLFSClient returns the client of the LFS server: the "lfs.url" of the .lfsconfig file of the worktree if set,
+// otherwise the server derived from the origin the same way git-lfs does. The credentials are taken from the user
+// info of HTTP(S) origins, and from 'git-lfs-authenticate' run over ssh for SSH origins. The client is nil
+// for local origins.
+func newLFSClient(ctx context.Context, origin, wd string) (*lfsClient, error) {
+	configured, err := lfsConfigURL(wd)
+	if err != nil {
+		return nil, err
+	}
+	o, err := model.ParseOrigin(origin)
+	if err != nil {
+		return nil, err
+	}
+	c := &lfsClient{client: http.DefaultClient}
+	switch o.Scheme {
+	case model.SchemeHTTPS, model.SchemeHTTP:
+		u, err := url.Parse(origin)
+		if err != nil {
+			return nil, err
+		}
+		c.user, u.User = u.User, nil
+		c.endpoint = strings.TrimSuffix(u.String(), "/")
+		if !strings.HasSuffix(c.endpoint, ".git") {
+			c.endpoint += ".git"
+		}
+		c.endpoint += "/info/lfs"
+	case model.SchemeSSH:
+		c.endpoint = "https://" + o.Host + "/" + o.Path + ".git/info/lfs"
+		if configured == "" {
+			auth, err := lfsAuthenticate(ctx, o)
+			if err != nil {
+				log.Warnf("Cannot authenticate to the LFS server of %s, continuing without credentials: %v", o.Host, err)
+			} else {
+				if auth.Href != "" {
+					c.endpoint = auth.Href
+				}
+				c.header = auth.Header
+			}
+		}
+	case model.SchemeGit:
+		c.endpoint = "https://" + o.Host + "/" + o.Path + ".git/info/lfs"
+	default:
+		if configured == "" {
+			return nil, nil
+		}
+	}
+	if configured != "" {
+		// The credentials of the origin are not sent to another server.
+		if u, err := url.Parse(configured); err != nil || u.Host != o.Host {
+			c.user = nil
+		}
+		c.endpoint = configured
+	}
+	return c, nil
+}
+
+// lfsAuthenticate runs 'git-lfs-authenticate' on the SSH server of the origin, with the ssh command of git.
+func lfsAuthenticate(ctx context.Context, o *model.Origin) (*lfsAction, error) {
+	var args []string
+	if o.Port != "" {
+		args = append(args, "-p", o.Port)
+	}
+	host := o.Host
+	if o.User != "" {
+		host = o.User + "@" + host
+	}
+	args = append(args, host, "git-lfs-authenticate "+o.Path+" download")
+	var cmd *exec.Cmd
+	if command := os.Getenv("GIT_SSH_COMMAND"); command != "" {
+		// The command is run by the shell, the same way as by git.
+		cmd = exec.CommandContext(ctx, "sh", append([]string{"-c", command + ` "$@"`, command}, args...)...)
+	} else {
+		cmd = exec.CommandContext(ctx, "ssh", args...)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "git-lfs-authenticate failed: %s", strings.TrimSpace(stderr.String()))
+	}
+	auth := &lfsAction{}
+	if err := json.Unmarshal(out, auth); err != nil {
+		return nil, errors.Wrap(err, "invalid git-lfs-authenticate response")
+	}
+	return auth, nil
+}
+
+func lfsConfigURL(wd string) (string, error) {
+	f, err := os.Open(filepath.Join(wd, lfsConfigFile))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	cfg := formatcfg.New()
+	if err := formatcfg.NewDecoder(f).Decode(cfg); err != nil {
+		return "", errors.Wrapf(err, "failed to parse %s", lfsConfigFile)
+	}
+	return cfg.Section("lfs").Option("url"), nil
+}
+
+type lfsClient struct {
+	endpoint string
+	// user are the credentials of the batch requests, from the URL of the origin.
+	user *url.Userinfo
+	// header are the headers of the batch requests, e.g. the authorization returned by git-lfs-authenticate.
+	header map[string]string
+	client *http.Client
+}
+
+// fetch downloads the objects of the pointers and returns the number of the replaced pointer files.
+func (c *lfsClient) fetch(ctx context.Context, src *model.Source, wd string, pointers []lfsPointer) int {
+	seen := make(map[string]bool, len(pointers))
+	var objects []lfsObject
+	for _, p := range pointers {
+		if !seen[p.OID] {
+			seen[p.OID] = true
+			objects = append(objects, p.lfsObject)
+		}
+	}
+	resp, err := c.batch(ctx, objects)
+	if err != nil {
+		for _, p := range pointers {
+			unresolvedLFSPointer(src, p, err.Error())
+		}
+		return 0
+	}
+	byOID := make(map[string]lfsObjectResponse, len(resp.Objects))
+	for _, obj := range resp.Objects {
+		byOID[obj.OID] = obj
+	}
+
+	downloaded := 0
+	for _, p := range pointers {
+		obj, ok := byOID[p.OID]
+		switch {
+		case !ok:
+			unresolvedLFSPointer(src, p, "missing in the batch response")
+		case obj.Error != nil:
+			unresolvedLFSPointer(src, p, fmt.Sprintf("%d %s", obj.Error.Code, obj.Error.Message))
+		case obj.Actions["download"].Href == "":
+			unresolvedLFSPointer(src, p, "no download action in the batch response")
+		default:
+			if err := c.download(ctx, wd, p, obj.Actions["download"]); err != nil {
+				unresolvedLFSPointer(src, p, err.Error())
+				continue
+			}
+			downloaded++
+		}
+	}
+	return downloaded
+}
+
+func (c *lfsClient) batch(ctx context.Context, objects []lfsObject) (*lfsBatchResponse, error) {
+	body, err := json.Marshal(&lfsBatchRequest{
+		Operation: "download",
+		Transfers: []string{"basic"},
+		Objects:   objects,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint+"/objects/batch", bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid LFS batch request")
+	}
+	req.Header.Set("Accept", lfsMediaType)
+	req.Header.Set("Content-Type", lfsMediaType)
+	if c.user != nil {
+		password, _ := c.user.Password()
+		req.SetBasicAuth(c.user.Username(), password)
+	}
+	for k, v := range c.header {
+		req.Header.Set(k, v)
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "LFS batch request failed")
+	}
+	defer res.Body.Close()
+
+	resp := &lfsBatchResponse{}
+	decodeErr := json.NewDecoder(res.Body).Decode(resp)
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("LFS batch request failed: %s %s", res.Status, resp.Message)
+	}
+	if decodeErr != nil {
+		return nil, errors.Wrap(decodeErr, "invalid LFS batch response")
+	}
+	if resp.Transfer != "" && resp.Transfer != "basic" {
+		return nil, errors.Errorf("unsupported LFS transfer adapter %q", resp.Transfer)
+	}
+	return resp, nil
+}
+
+// download replaces the pointer file with the object, once its size and checksum are verified.
+func (c *lfsClient) download(ctx context.Context, wd string, p lfsPointer, action lfsAction) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, action.Href, nil)
+	if err != nil {
+		return errors.Wrap(err, "invalid download action")
+	}
+	for k, v := range action.Header {
+		req.Header.Set(k, v)
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "download failed")
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return errors.Errorf("download failed: %s", res.Status)
+	}
+
+	filename := filepath.Join(wd, filepath.FromSlash(p.path))
+	info, err := os.Lstat(filename)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), ".lfs-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(res.Body, p.Size+1))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return errors.Wrap(err, "download failed")
+	}
+	if n != p.Size {
+		return errors.Errorf("size mismatch: expected %d bytes, downloaded %d", p.Size, n)
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != p.OID {
+		return errors.Errorf("checksum mismatch: downloaded %s", sum)
+	}
+	if err := os.Chmod(tmp.Name(), info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// isLFSObject returns true if the file holds the object the pointer refers to, i.e. the pointer was replaced
+// with the downloaded object.
+func isLFSObject(filename string, pointer []byte) bool {
+	obj, ok := parseLFSPointer(pointer)
+	if !ok {
+		return false
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	hash := sha256.New()
+	n, err := io.Copy(hash, f)
+	return err == nil && n == obj.Size && hex.EncodeToString(hash.Sum(nil)) == obj.OID
+}
@@ -0,0 +1,31 @@
+//go:build !windows
+// +build !windows
+
+package source
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile places an advisory lock on the file, shared between the processes. If wait is false and the file is locked,
+// false is returned instead of waiting for the lock to be released. A shared lock may be converted to an exclusive one
+// and the other way round.
+func lockFile(f *os.File, exclusive, wait bool) (bool, error) {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+	err := syscall.Flock(int(f.Fd()), how)
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,32 @@
+//go:build windows
+// +build windows
+
+package source
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// lockFile places a lock on the file, shared between the processes. If wait is false and the file is locked,
+// false is returned instead of waiting for the lock to be released. A held lock is released before it is converted.
+func lockFile(f *os.File, exclusive, wait bool) (bool, error) {
+	var flags uint32
+	if exclusive {
+		flags |= windows.LOCKFILE_EXCLUSIVE_LOCK
+	}
+	if !wait {
+		flags |= windows.LOCKFILE_FAIL_IMMEDIATELY
+	}
+	unlockFile(f)
+	err := windows.LockFileEx(windows.Handle(f.Fd()), flags, 0, 1, 0, &windows.Overlapped{})
+	if err == windows.ERROR_LOCK_VIOLATION {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func unlockFile(f *os.File) error {
+	return windows.UnlockFileEx(windows.Handle(f.Fd()), 0, 1, 0, &windows.Overlapped{})
+}
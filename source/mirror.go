@@ -0,0 +1,190 @@
+package source
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/arekziobrowski/sourcerer/model"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// mirrorRefSpecs are the references of the origin kept in the mirrors.
+var mirrorRefSpecs = []string{"+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*"}
+
+// mirrorUploadPackOptions allow fetching any commit from the mirror and partial clones of it.
+var mirrorUploadPackOptions = []string{"allowAnySHA1InWant", "allowFilter"}
+
+// FetchSystemGitMirror updates the branches and the tags of the mirror with the git command, unless the commit
+// of the source is already there. The commits not reachable from them are fetched alone.
+func FetchSystemGitMirror(ctx context.Context, dir string, src *model.Source) error {
+	err := initMirror(dir, func(tmp string) error {
+		return initSystemGitMirror(ctx, tmp, src.Origin)
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to initialize the mirror")
+	}
+	if hasCommit(dir, src.Hash) {
+		return nil
+	}
+	log.Infof("Updating the mirror %s of %s", dir, model.Redact(src.Origin))
+	if err := fetch(ctx, dir, append([]string{"--prune", "--", "origin"}, mirrorRefSpecs...)...); err != nil {
+		return err
+	}
+	if hasCommit(dir, src.Hash) {
+		return nil
+	}
+	return fetch(ctx, dir, "--", "origin", src.Hash+":"+storeRefPrefix+src.Hash)
+}
+
+// initMirror initializes the mirror in the directory unless it exists. The mirror is initialized in a temporary
+// directory, renamed into place once complete, so that a failed initialization leaves no broken mirror behind.
+func initMirror(dir string, init func(tmp string) error) error {
+	if _, err := os.Stat(filepath.Join(dir, "HEAD")); !os.IsNotExist(err) {
+		return err
+	}
+	// The directory may be left incomplete by an earlier version.
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dir), 0777); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempDir(filepath.Dir(dir), filepath.Base(dir)+".init-")
+	if err != nil {
+		return err
+	}
+	if err := init(tmp); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	return nil
+}
+
+func initSystemGitMirror(ctx context.Context, dir, origin string) error {
+	if err := run(ctx, dir, "git", "init", "--bare"); err != nil {
+		return err
+	}
+	if err := run(ctx, dir, "git", "remote", "add", "--", "origin", origin); err != nil {
+		return err
+	}
+	for _, option := range mirrorUploadPackOptions {
+		if err := run(ctx, dir, "git", "config", "uploadpack."+option, "true"); err != nil {
+			return err
+		}
+	}
+	// The HEAD of the mirror has to point to the default branch of the origin, as it does in a clone.
+	out, err := output(ctx, dir, "git", "ls-remote", "--symref", "--", "origin", "HEAD")
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if fields := strings.Fields(line); len(fields) == 3 && fields[0] == "ref:" {
+			return run(ctx, dir, "git", "symbolic-ref", "HEAD", fields[1])
+		}
+	}
+	return nil
+}
+
+func hasCommit(dir, hash string) bool {
+	cmd := exec.Command("git", "cat-file", "-e", hash+"^{commit}")
+	cmd.Dir = dir
+	return cmd.Run() == nil
+}
+
+// FetchGitMirror updates the branches and the tags of the mirror with go-git, unless the commit of the source
+// is already there. The commits not reachable from them are fetched alone. Unlike with the git command,
+// the references deleted in the origin are kept.
+func FetchGitMirror(ctx context.Context, dir string, src *model.Source) error {
+	const remoteName = "origin"
+	err := initMirror(dir, func(tmp string) error {
+		return initGitMirror(ctx, tmp, src)
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to initialize the mirror")
+	}
+	storage := filesystem.NewStorage(osfs.New(dir), cache.NewObjectLRUDefault())
+	repo, err := git.Open(withProgress(ctx, storage), nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to open the mirror")
+	}
+	hash := plumbing.NewHash(src.Hash)
+	if _, err := repo.CommitObject(hash); err == nil {
+		return nil
+	}
+
+	log.Infof("Updating the mirror %s of %s", dir, model.Redact(src.Origin))
+	auth := getAuth(src)
+	refSpecs := make([]config.RefSpec, 0, len(mirrorRefSpecs))
+	for _, rs := range mirrorRefSpecs {
+		refSpecs = append(refSpecs, config.RefSpec(rs))
+	}
+	err = repo.FetchContext(ctx, &git.FetchOptions{
+		RemoteName: remoteName,
+		RefSpecs:   refSpecs,
+		Auth:       auth,
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return err
+	}
+	if _, err := repo.CommitObject(hash); err == nil {
+		return nil
+	}
+	err = repo.FetchContext(ctx, &git.FetchOptions{
+		RemoteName: remoteName,
+		RefSpecs:   []config.RefSpec{config.RefSpec(fmt.Sprintf("%s:%s%s", hash, storeRefPrefix, hash))},
+		Auth:       auth,
+	})
+	if err == git.NoErrAlreadyUpToDate {
+		return nil
+	}
+	return err
+}
+
+func initGitMirror(ctx context.Context, dir string, src *model.Source) error {
+	storage := filesystem.NewStorage(osfs.New(dir), cache.NewObjectLRUDefault())
+	repo, err := git.Init(storage, nil)
+	if err != nil {
+		return err
+	}
+	remote, err := repo.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{src.Origin}})
+	if err != nil {
+		return err
+	}
+	cfg, err := repo.Config()
+	if err != nil {
+		return err
+	}
+	for _, option := range mirrorUploadPackOptions {
+		cfg.Raw.Section("uploadpack").SetOption(option, "true")
+	}
+	if err := repo.SetConfig(cfg); err != nil {
+		return err
+	}
+	// The HEAD of the mirror has to point to the default branch of the origin, as it does in a clone.
+	refs, err := remote.ListContext(ctx, &git.ListOptions{Auth: getAuth(src)})
+	if err != nil {
+		return errors.Wrap(err, "cannot invoke ls-remote")
+	}
+	for _, ref := range refs {
+		if ref.Name() == plumbing.HEAD && ref.Type() == plumbing.SymbolicReference {
+			return storage.SetReference(ref)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package source
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/arekziobrowski/sourcerer/model"
+)
+
+func TestFetchMirror(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	tests := []struct {
+		name  string
+		fetch MirrorFetchFunc
+	}{
+		{"git-system", FetchSystemGitMirror},
+		{"git", FetchGitMirror},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			origin := filepath.Join(root, "org", "repo")
+			gitTest(t, root, "init", "-q", origin)
+			if err := ioutil.WriteFile(filepath.Join(origin, "f"), []byte("content\n"), 0666); err != nil {
+				t.Fatal(err)
+			}
+			gitTest(t, origin, "add", "f")
+			gitTest(t, origin, "commit", "-q", "-m", "test")
+			hash := strings.TrimSpace(gitTest(t, origin, "rev-parse", "HEAD"))
+			cache := filepath.Join(root, "cache")
+			dir := filepath.Join(cache, "repo.git")
+
+			// A mirror that cannot be initialized is not left behind, so that the next run starts over.
+			missing := &model.Source{Origin: "file://" + filepath.Join(root, "org", "missing"), Hash: hash}
+			if err := tt.fetch(context.Background(), dir, missing); err == nil {
+				t.Fatal("fetching from a missing origin succeeded")
+			}
+			if entries, _ := ioutil.ReadDir(cache); len(entries) > 0 {
+				t.Fatalf("the failed initialization left %s behind", entries[0].Name())
+			}
+
+			src := &model.Source{Origin: "file://" + origin, Hash: hash}
+			if err := tt.fetch(context.Background(), dir, src); err != nil {
+				t.Fatalf("fetching the mirror failed: %v", err)
+			}
+			if !hasCommit(dir, hash) {
+				t.Errorf("the mirror lacks the commit %s", hash)
+			}
+			if head := strings.TrimSpace(gitTest(t, dir, "symbolic-ref", "HEAD")); head != strings.TrimSpace(gitTest(t, origin, "symbolic-ref", "HEAD")) {
+				t.Errorf("HEAD of the mirror is %s", head)
+			}
+			if entries, _ := ioutil.ReadDir(cache); len(entries) != 1 {
+				t.Errorf("the cache has %d entries, want only the mirror", len(entries))
+			}
+			// The mirror is reused as it is.
+			if err := tt.fetch(context.Background(), dir, src); err != nil {
+				t.Fatalf("fetching the mirror again failed: %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "HEAD")); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package source
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"sync"
+
+	"github.com/go-git/go-git/v5/storage"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+// Progress receives the progress of the downloads. The bytes received by git are taken from the progress
+// of git fetch. go-git does not report the received bytes, so the size of the packs it writes is counted instead.
+type Progress interface {
+	// Received adds the number of the bytes received from a remote.
+	Received(n int64)
+}
+
+type progressKey struct{}
+
+// WithProgress returns the context whose downloads report their progress to the progress.
+func WithProgress(ctx context.Context, p Progress) context.Context {
+	return context.WithValue(ctx, progressKey{}, p)
+}
+
+func progressFrom(ctx context.Context) Progress {
+	p, _ := ctx.Value(progressKey{}).(Progress)
+	return p
+}
+
+// progressStorage reports the bytes of the packs written to the storage to the progress. The packs are written while
+// they are received, so the bytes received by a go-git fetch are counted whatever the transport, without replacing
+// the transports of go-git.
+type progressStorage struct {
+	*filesystem.Storage
+	progress Progress
+}
+
+// withProgress returns the storage reporting the bytes of the fetched packs to the progress of the context, if any.
+func withProgress(ctx context.Context, s *filesystem.Storage) storage.Storer {
+	p := progressFrom(ctx)
+	if p == nil {
+		return s
+	}
+	return &progressStorage{Storage: s, progress: p}
+}
+
+func (s *progressStorage) PackfileWriter() (io.WriteCloser, error) {
+	w, err := s.Storage.PackfileWriter()
+	if err != nil {
+		return nil, err
+	}
+	return &progressPackWriter{WriteCloser: w, progress: s.progress}, nil
+}
+
+type progressPackWriter struct {
+	io.WriteCloser
+	progress Progress
+}
+
+func (w *progressPackWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	if n > 0 {
+		w.progress.Received(int64(n))
+	}
+	return n, err
+}
+
+// progressLine matches the progress lines of git, e.g. "Receiving objects:  45% (450/1000), 1.20 MiB | 500.00 KiB/s",
+// also when relayed from the remote.
+var progressLine = regexp.MustCompile(`^(remote: )?([A-Z][a-z]+( [a-z]+)*: +(\d+% \(\d+/\d+\)|\d+, done\.)|Total \d+ \(delta \d+\))`)
+
+// receivedBytes matches the size of the received objects in the progress lines of git.
+var receivedBytes = regexp.MustCompile(`^(Receiving|Unpacking) objects: .*, ([0-9.]+) (bytes|KiB|MiB|GiB|TiB)`)
+
+var units = map[string]float64{"bytes": 1, "KiB": 1 << 10, "MiB": 1 << 20, "GiB": 1 << 30, "TiB": 1 << 40}
+
+// progressWriter reads the progress output of a git command and reports the received bytes. Other lines are written to the output, so that the errors of the command are kept without
+// the progress.
+type progressWriter struct {
+	mutex    sync.Mutex
+	progress Progress
+	out      io.Writer
+	line     []byte
+	received int64
+}
+
+func newProgressWriter(p Progress, out io.Writer) *progressWriter {
+	return &progressWriter{progress: p, out: out}
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for _, c := range p {
+		// The progress lines are redrawn with carriage returns.
+		if c == '\r' || c == '\n' {
+			w.flushLine()
+			continue
+		}
+		w.line = append(w.line, c)
+	}
+	return len(p), nil
+}
+
+// Flush handles the last line if it is not terminated.
+func (w *progressWriter) Flush() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.flushLine()
+}
+
+func (w *progressWriter) flushLine() {
+	line := w.line
+	w.line = w.line[:0]
+	if len(line) == 0 {
+		return
+	}
+	if !progressLine.Match(line) {
+		if w.out != nil {
+			w.out.Write(append(line, '\n'))
+		}
+		return
+	}
+	m := receivedBytes.FindSubmatch(line)
+	if m == nil {
+		return
+	}
+	size, err := strconv.ParseFloat(string(m[2]), 64)
+	if err != nil {
+		return
+	}
+	// The size is the total received so far, rounded, only the growth is reported.
+	if received := int64(size * units[string(m[3])]); received > w.received {
+		w.progress.Received(received - w.received)
+		w.received = received
+	}
+}
+
+// fetch runs the git fetch command with the arguments, reporting the received bytes to the progress of the context.
+// The fetched objects are always kept in a pack, even for the small fetches, so that the objects are stored the same
+// way whether the progress is requested or not: the received bytes are written only by index-pack.
+func fetch(ctx context.Context, wd string, args ...string) error {
+	p := progressFrom(ctx)
+	if p == nil {
+		return run(ctx, wd, "git", append([]string{"-c", "fetch.unpackLimit=1", "fetch"}, args...)...)
+	}
+	// git writes the progress only to a terminal unless it is requested.
+	args = append([]string{"-c", "fetch.unpackLimit=1", "fetch", "--progress"}, args...)
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = wd
+	var stderr bytes.Buffer
+	w := newProgressWriter(p, &stderr)
+	cmd.Stderr = w
+	err := cmd.Run()
+	w.Flush()
+	if err != nil {
+		return commandError(ctx, wd, "git", args, stderr.String(), err)
+	}
+	return nil
+}
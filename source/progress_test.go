@@ -0,0 +1,169 @@
+package source
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+type testProgress struct {
+	received int64
+}
+
+func (p *testProgress) Received(n int64) {
+	atomic.AddInt64(&p.received, n)
+}
+
+func TestProgressWriter(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   int64
+		// wantOut is the output left without the progress.
+		wantOut string
+	}{
+		{
+			name:   "receiving",
+			output: "remote: Counting objects: 100% (3/3), done.\rReceiving objects:  50% (1/2), 1.00 KiB | 1.00 KiB/s\rReceiving objects: 100% (2/2), 2.00 KiB | 1.00 KiB/s, done.\n",
+			want:   2048,
+		},
+		{
+			name:   "unpacking",
+			output: "Unpacking objects: 100% (3/3), 512 bytes | 512.00 KiB/s, done.",
+			want:   512,
+		},
+		{
+			name:    "errors",
+			output:  "Receiving objects: 100% (2/2), 1.50 MiB | 1.00 MiB/s, done.\nfatal: the remote end hung up unexpectedly\n",
+			want:    3 << 19,
+			wantOut: "fatal: the remote end hung up unexpectedly\n",
+		},
+		{
+			name:   "no size",
+			output: "remote: Total 3 (delta 0), reused 0 (delta 0)\nReceiving objects: 100% (3/3), done.\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &testProgress{}
+			var out bytes.Buffer
+			w := newProgressWriter(p, &out)
+			// The output is written in small chunks, the lines are split across the writes.
+			for i := 0; i < len(tt.output); i += 7 {
+				end := i + 7
+				if end > len(tt.output) {
+					end = len(tt.output)
+				}
+				w.Write([]byte(tt.output[i:end]))
+			}
+			w.Flush()
+			if p.received != tt.want {
+				t.Errorf("received %d bytes, want %d", p.received, tt.want)
+			}
+			if out.String() != tt.wantOut {
+				t.Errorf("output = %q, want %q", out.String(), tt.wantOut)
+			}
+		})
+	}
+}
+
+func TestFetch(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	root := t.TempDir()
+	origin := filepath.Join(root, "origin")
+	gitTest(t, root, "init", "-q", origin)
+	if err := ioutil.WriteFile(filepath.Join(origin, "f"), []byte("f\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	gitTest(t, origin, "add", "f")
+	gitTest(t, origin, "commit", "-q", "-m", "first")
+
+	tests := []struct {
+		name     string
+		progress bool
+	}{
+		{name: "without progress"},
+		{name: "with progress", progress: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "repo")
+			gitTest(t, root, "init", "-q", dir)
+			ctx := context.Background()
+			if tt.progress {
+				ctx = WithProgress(ctx, &testProgress{})
+			}
+			if err := fetch(ctx, dir, "--", origin, "HEAD"); err != nil {
+				t.Fatal(err)
+			}
+			// The objects are kept in a pack either way, even for a fetch this small.
+			counts := gitTest(t, dir, "count-objects", "-v")
+			if !strings.Contains(counts, "\ncount: 0\n") && !strings.HasPrefix(counts, "count: 0\n") {
+				t.Errorf("loose objects fetched:\n%s", counts)
+			}
+			if strings.Contains(counts, "in-pack: 0\n") {
+				t.Errorf("no objects packed:\n%s", counts)
+			}
+		})
+	}
+}
+
+func TestProgressStorage(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	root := t.TempDir()
+	origin := filepath.Join(root, "origin")
+	gitTest(t, root, "init", "-q", origin)
+	if err := ioutil.WriteFile(filepath.Join(origin, "f"), []byte("f\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	gitTest(t, origin, "add", "f")
+	gitTest(t, origin, "commit", "-q", "-m", "first")
+
+	p := &testProgress{}
+	ctx := WithProgress(context.Background(), p)
+	storage := filesystem.NewStorage(osfs.New(filepath.Join(root, "repo")), cache.NewObjectLRUDefault())
+	repo, err := git.Init(withProgress(ctx, storage), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{origin}}); err != nil {
+		t.Fatal(err)
+	}
+	err = repo.FetchContext(ctx, &git.FetchOptions{
+		RefSpecs: []config.RefSpec{"+refs/heads/*:refs/remotes/origin/*"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	packs, err := filepath.Glob(filepath.Join(root, "repo", "objects", "pack", "*.pack"))
+	if err != nil || len(packs) != 1 {
+		t.Fatalf("packs = %v, %v", packs, err)
+	}
+	info, err := os.Stat(packs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.received != info.Size() {
+		t.Errorf("received %d bytes, want the size of the pack %d", p.received, info.Size())
+	}
+
+	if s := withProgress(context.Background(), storage); s != storage {
+		t.Errorf("storage replaced without a progress")
+	}
+}
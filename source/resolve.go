@@ -0,0 +1,106 @@
+package source
+
+import (
+	"context"
+	"strings"
+
+	"github.com/arekziobrowski/sourcerer/model"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	headRef      = "HEAD"
+	peeledSuffix = "^{}"
+)
+
+// SystemGitResolver resolves revisions to commits with 'git ls-remote'.
+type SystemGitResolver struct{}
+
+func NewSystemGitResolver() *SystemGitResolver {
+	return &SystemGitResolver{}
+}
+
+func (r *SystemGitResolver) Resolve(ctx context.Context, src *model.Source) (string, error) {
+	// Peeled tags are listed only when their own name matches a pattern.
+	out, err := output(ctx, "", "git", "ls-remote", "--", src.Origin, src.Revision, src.Revision+peeledSuffix)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to invoke 'git ls-remote %s %s'", model.Redact(src.Origin), src.Revision)
+	}
+	refs := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		refs[fields[1]] = fields[0]
+	}
+	return selectRevision(src, refs)
+}
+
+// GitResolver resolves revisions to commits with the references advertised by the remote, using go-git.
+type GitResolver struct{}
+
+func NewGitResolver() *GitResolver {
+	return &GitResolver{}
+}
+
+func (r *GitResolver) Resolve(ctx context.Context, src *model.Source) (string, error) {
+	ep, err := transport.NewEndpoint(src.Origin)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid endpoint: %s", model.Redact(src.Origin))
+	}
+	c, err := client.NewClient(ep)
+	if err != nil {
+		return "", err
+	}
+	session, err := c.NewUploadPackSession(ep, getAuth(src))
+	if err != nil {
+		return "", errors.Wrap(err, "cannot invoke ls-remote")
+	}
+	defer session.Close()
+
+	ar, err := session.AdvertisedReferencesContext(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot invoke ls-remote")
+	}
+	refs := make(map[string]string, len(ar.References)+len(ar.Peeled))
+	for name, hash := range ar.References {
+		refs[name] = hash.String()
+	}
+	for name, hash := range ar.Peeled {
+		refs[name+peeledSuffix] = hash.String()
+	}
+	if ar.Head != nil {
+		refs[headRef] = ar.Head.String()
+	}
+	return selectRevision(src, refs)
+}
+
+// selectRevision picks the commit for the revision from the remote references, following the precedence
+// of 'git rev-parse': an exact match first, then tags and branches. Annotated tags are peeled to their commits.
+func selectRevision(src *model.Source, refs map[string]string) (string, error) {
+	rev := src.Revision
+	candidates := []string{rev}
+	if rev != headRef && !strings.HasPrefix(rev, "refs/") {
+		candidates = []string{"refs/" + rev, "refs/tags/" + rev, "refs/heads/" + rev}
+	}
+	for _, name := range candidates {
+		hash, ok := refs[name+peeledSuffix]
+		if !ok {
+			hash, ok = refs[name]
+		}
+		if !ok {
+			continue
+		}
+		// The commit is passed to git as an argument, it cannot be anything else than a hash.
+		if !model.IsCommitHash(hash) {
+			return "", errors.Errorf("invalid commit %q of %s in %s", hash, name, model.Redact(src.Origin))
+		}
+		log.Infof("Resolved %s@%s (%s) to %s", model.Redact(src.Origin), rev, name, hash)
+		return strings.ToLower(hash), nil
+	}
+	return "", errors.Errorf("cannot find a reference matching %s in %s", rev, model.Redact(src.Origin))
+}
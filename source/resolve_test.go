@@ -0,0 +1,53 @@
+package source
+
+import (
+	"testing"
+
+	"github.com/arekziobrowski/sourcerer/model"
+)
+
+func TestSelectRevision(t *testing.T) {
+	const (
+		branch = "1111111111111111111111111111111111111111"
+		tag    = "2222222222222222222222222222222222222222"
+		peeled = "3333333333333333333333333333333333333333"
+		head   = "4444444444444444444444444444444444444444"
+	)
+	refs := map[string]string{
+		"HEAD":                   head,
+		"refs/heads/main":        branch,
+		"refs/heads/v1":          branch,
+		"refs/tags/v1":           tag,
+		"refs/tags/v1^{}":        peeled,
+		"refs/tags/light":        tag,
+		"refs/heads/bad":         "--upload-pack=x",
+		"refs/heads/UPPER":       "ABCDEFABCDEFABCDEFABCDEFABCDEFABCDEFABCD",
+		"refs/remotes/other/dev": branch,
+	}
+	tests := []struct {
+		revision string
+		want     string
+	}{
+		{"HEAD", head},
+		{"main", branch},
+		{"refs/heads/main", branch},
+		{"v1", peeled},
+		{"light", tag},
+		{"remotes/other/dev", branch},
+		{"UPPER", "abcdefabcdefabcdefabcdefabcdefabcdefabcd"},
+		{"missing", ""},
+		{"bad", ""},
+	}
+	for _, tt := range tests {
+		got, err := selectRevision(&model.Source{Origin: "https://host/org/repo", Revision: tt.revision}, refs)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("selectRevision(%q) = %q, want an error", tt.revision, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("selectRevision(%q) = %q, %v, want %q", tt.revision, got, err, tt.want)
+		}
+	}
+}
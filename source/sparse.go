@@ -0,0 +1,229 @@
+package source
+
+import (
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+	"github.com/go-git/go-git/v5/plumbing/format/index"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/pkg/errors"
+)
+
+const sparseCheckoutFile = ".git/info/sparse-checkout"
+
+// writeSparseCheckoutFile writes the patterns in the format of the non-cone mode of 'git sparse-checkout',
+// which uses the .gitignore syntax.
+func writeSparseCheckoutFile(fs billy.Filesystem, patterns []string) error {
+	f, err := fs.Create(sparseCheckoutFile)
+	if err != nil {
+		return errors.Wrapf(err, "cannot create %s", sparseCheckoutFile)
+	}
+	defer f.Close()
+	_, err = io.WriteString(f, strings.Join(patterns, "\n")+"\n")
+	return err
+}
+
+// newSparseMatcher returns the matcher of the paths to check out, or nil if all paths are checked out.
+func newSparseMatcher(patterns []string) gitignore.Matcher {
+	if len(patterns) == 0 {
+		return nil
+	}
+	ps := make([]gitignore.Pattern, 0, len(patterns))
+	for _, p := range patterns {
+		ps = append(ps, gitignore.ParsePattern(p, nil))
+	}
+	return gitignore.NewMatcher(ps)
+}
+
+// sparseCheckout checks out only the files of the commit matching the patterns. The other files are kept
+// in the index with the skip-worktree bit, the same way 'git sparse-checkout' does.
+func sparseCheckout(repo *git.Repository, fs billy.Filesystem, hash plumbing.Hash, patterns []string) error {
+	if err := writeSparseCheckoutFile(fs, patterns); err != nil {
+		return err
+	}
+	cfg, err := repo.Config()
+	if err != nil {
+		return err
+	}
+	cfg.Raw.Section("core").SetOption("sparseCheckout", "true")
+	if err := repo.SetConfig(cfg); err != nil {
+		return errors.Wrap(err, "cannot enable sparse checkout")
+	}
+
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		return errors.Wrapf(err, "cannot find commit %s", hash)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+
+	matcher := newSparseMatcher(patterns)
+
+	// The submodules are kept in the index too, the same way as in a full checkout, so that they can be checked out
+	// and the state of the directory can be compared with the tree.
+	idx := &index.Index{Version: 3}
+	walker := object.NewTreeWalker(tree, true, nil)
+	defer walker.Close()
+	for {
+		name, entry, err := walker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to check out the sparse paths")
+		}
+		if entry.Mode == filemode.Dir {
+			continue
+		}
+		e, err := sparseCheckoutEntry(repo, fs, matcher, name, entry)
+		if err != nil {
+			return errors.Wrap(err, "failed to check out the sparse paths")
+		}
+		idx.Entries = append(idx.Entries, e)
+	}
+	sort.Slice(idx.Entries, func(i, j int) bool {
+		return idx.Entries[i].Name < idx.Entries[j].Name
+	})
+	if err := repo.Storer.SetIndex(idx); err != nil {
+		return errors.Wrap(err, "cannot write the index")
+	}
+	return setHeadCommit(repo, hash)
+}
+
+// sparseCheckoutEntry checks out the tree entry if it matches the sparse paths, and removes it otherwise.
+// A matching submodule is checked out as an empty directory, the same way as by 'git checkout'.
+func sparseCheckoutEntry(repo *git.Repository, fs billy.Filesystem, matcher gitignore.Matcher, name string, entry object.TreeEntry) (*index.Entry, error) {
+	e := &index.Entry{Name: name, Hash: entry.Hash, Mode: entry.Mode}
+	matched := matcher.Match(strings.Split(name, "/"), false)
+	if entry.Mode == filemode.Submodule {
+		if !matched {
+			// The submodule may be left checked out by an earlier run, it is removed only if empty.
+			fs.Remove(name)
+			e.SkipWorktree = true
+			return e, nil
+		}
+		if err := fs.MkdirAll(name, 0777); err != nil {
+			return nil, err
+		}
+	} else {
+		blob, err := repo.BlobObject(entry.Hash)
+		if err != nil {
+			return nil, err
+		}
+		e.Size = uint32(blob.Size)
+		if !matched {
+			// The file may be left by an earlier checkout of the repository.
+			if err := removeFile(fs, name); err != nil {
+				return nil, err
+			}
+			e.SkipWorktree = true
+			return e, nil
+		}
+		if err := checkoutFile(fs, object.NewFile(name, entry.Mode, blob)); err != nil {
+			return nil, err
+		}
+	}
+	if fi, err := fs.Lstat(name); err == nil {
+		e.ModifiedAt = fi.ModTime()
+	}
+	return e, nil
+}
+
+func checkoutFile(fs billy.Filesystem, f *object.File) error {
+	if err := fs.MkdirAll(path.Dir(f.Name), 0777); err != nil {
+		return err
+	}
+	// The path may be left by an earlier checkout when the source is updated. The file is created anew,
+	// as a symbolic link cannot be overwritten and an existing file would keep its mode.
+	if err := util.RemoveAll(fs, f.Name); err != nil {
+		return err
+	}
+	if f.Mode == filemode.Symlink {
+		target, err := f.Contents()
+		if err != nil {
+			return err
+		}
+		return fs.Symlink(target, f.Name)
+	}
+
+	perm := os.FileMode(0666)
+	if f.Mode == filemode.Executable {
+		perm = 0777
+	}
+	r, err := f.Reader()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	out, err := fs.OpenFile(f.Name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// removeFile removes the file, along with the parent directories left empty.
+func removeFile(fs billy.Filesystem, name string) error {
+	if err := fs.Remove(name); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		if fs.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// setHeadCommit points HEAD, or the branch HEAD refers to, at the commit.
+func setHeadCommit(repo *git.Repository, hash plumbing.Hash) error {
+	head, err := repo.Storer.Reference(plumbing.HEAD)
+	if err != nil {
+		return errors.Wrap(err, "cannot read HEAD")
+	}
+	name := plumbing.HEAD
+	if head.Type() == plumbing.SymbolicReference {
+		name = head.Target()
+	}
+	return repo.Storer.SetReference(plumbing.NewHashReference(name, hash))
+}
+
+// disableSparseCheckout makes the next checkout of a repository sparsely checked out by an earlier run
+// check out all the paths.
+func disableSparseCheckout(repo *git.Repository, fs billy.Filesystem) error {
+	cfg, err := repo.Config()
+	if err != nil {
+		return err
+	}
+	core := cfg.Raw.Section("core")
+	if core.Option("sparseCheckout") != "true" {
+		return nil
+	}
+	core.RemoveOption("sparseCheckout")
+	if err := repo.SetConfig(cfg); err != nil {
+		return err
+	}
+	if err := fs.Remove(sparseCheckoutFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// The reset does not check out the entries of the index with the skip-worktree bit.
+	return repo.Storer.SetIndex(&index.Index{Version: 2})
+}
@@ -0,0 +1,186 @@
+package source
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// gitlinkHash is the commit of the submodule in the test tree, not present in the repository.
+var gitlinkHash = plumbing.NewHash("1111111111111111111111111111111111111111")
+
+// newSparseTestRepository creates a repository with a commit of README.md, src/main.go, docs/guide.md
+// and the submodule lib/dep.
+func newSparseTestRepository(t *testing.T) (*git.Repository, billy.Filesystem, plumbing.Hash) {
+	t.Helper()
+	fs := memfs.New()
+	repo, err := git.Init(memory.NewStorage(), fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := repo.Storer
+	blob := func(content string) plumbing.Hash {
+		obj := store.NewEncodedObject()
+		obj.SetType(plumbing.BlobObject)
+		w, _ := obj.Writer()
+		w.Write([]byte(content))
+		w.Close()
+		h, err := store.SetEncodedObject(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	tree := func(entries ...object.TreeEntry) plumbing.Hash {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+		obj := store.NewEncodedObject()
+		if err := (&object.Tree{Entries: entries}).Encode(obj); err != nil {
+			t.Fatal(err)
+		}
+		h, err := store.SetEncodedObject(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	root := tree(
+		object.TreeEntry{Name: "README.md", Mode: filemode.Regular, Hash: blob("readme\n")},
+		object.TreeEntry{Name: "src", Mode: filemode.Dir, Hash: tree(
+			object.TreeEntry{Name: "main.go", Mode: filemode.Regular, Hash: blob("package main\n")},
+		)},
+		object.TreeEntry{Name: "docs", Mode: filemode.Dir, Hash: tree(
+			object.TreeEntry{Name: "guide.md", Mode: filemode.Regular, Hash: blob("guide\n")},
+		)},
+		object.TreeEntry{Name: "lib", Mode: filemode.Dir, Hash: tree(
+			object.TreeEntry{Name: "dep", Mode: filemode.Submodule, Hash: gitlinkHash},
+		)},
+	)
+	sig := object.Signature{Name: "test", Email: "test@example.com", When: time.Unix(0, 0)}
+	obj := store.NewEncodedObject()
+	if err := (&object.Commit{Author: sig, Committer: sig, Message: "test\n", TreeHash: root}).Encode(obj); err != nil {
+		t.Fatal(err)
+	}
+	commit, err := store.SetEncodedObject(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return repo, fs, commit
+}
+
+func TestSparseCheckout(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		// checkedOut are the paths checked out, the other paths of the tree are skipped.
+		checkedOut []string
+	}{
+		{"directory", []string{"/src/"}, []string{"src/main.go"}},
+		{"file", []string{"README.md"}, []string{"README.md"}},
+		{"submodule", []string{"/lib/"}, []string{"lib/dep"}},
+		{"several", []string{"*.md", "/lib/dep"}, []string{"README.md", "docs/guide.md", "lib/dep"}},
+	}
+	all := []string{"README.md", "docs/guide.md", "lib/dep", "src/main.go"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo, fs, commit := newSparseTestRepository(t)
+			if err := sparseCheckout(repo, fs, commit, tt.patterns); err != nil {
+				t.Fatalf("sparseCheckout failed: %v", err)
+			}
+			idx, err := repo.Storer.Index()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, e := range idx.Entries {
+				names = append(names, e.Name)
+			}
+			if !equalStrings(names, all) {
+				t.Fatalf("index entries = %v, want %v", names, all)
+			}
+			checkedOut := make(map[string]bool)
+			for _, name := range tt.checkedOut {
+				checkedOut[name] = true
+			}
+			for _, e := range idx.Entries {
+				if e.SkipWorktree == checkedOut[e.Name] {
+					t.Errorf("%s: skip-worktree = %v, want %v", e.Name, e.SkipWorktree, !checkedOut[e.Name])
+				}
+				if _, err := fs.Lstat(e.Name); (err == nil) != checkedOut[e.Name] {
+					t.Errorf("%s: exists = %v, want %v", e.Name, err == nil, checkedOut[e.Name])
+				}
+				if e.Name == "lib/dep" && (e.Mode != filemode.Submodule || e.Hash != gitlinkHash) {
+					t.Errorf("%s: mode %s and hash %s, want the gitlink %s", e.Name, e.Mode, e.Hash, gitlinkHash)
+				}
+			}
+		})
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestCheckoutFileAgain(t *testing.T) {
+	store := memory.NewStorage()
+	file := func(name string, mode filemode.FileMode, content string) *object.File {
+		obj := store.NewEncodedObject()
+		obj.SetType(plumbing.BlobObject)
+		w, _ := obj.Writer()
+		w.Write([]byte(content))
+		w.Close()
+		h, err := store.SetEncodedObject(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blob, err := object.GetBlob(store, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return object.NewFile(name, mode, blob)
+	}
+	fs := osfs.New(t.TempDir())
+
+	// The files of the first checkout are replaced by the second one, as when the source is updated.
+	for _, f := range []*object.File{
+		file("bin/tool", filemode.Regular, "v1\n"),
+		file("link", filemode.Symlink, "bin/tool"),
+		file("bin/tool", filemode.Executable, "v2\n"),
+		file("link", filemode.Symlink, "README.md"),
+	} {
+		if err := checkoutFile(fs, f); err != nil {
+			t.Fatalf("checking out %s as %s failed: %v", f.Name, f.Mode, err)
+		}
+	}
+
+	info, err := fs.Lstat("bin/tool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&0100 == 0 {
+		t.Errorf("bin/tool has the mode %s, want it executable", info.Mode())
+	}
+	if content, err := util.ReadFile(fs, "bin/tool"); err != nil || string(content) != "v2\n" {
+		t.Errorf("bin/tool = %q, %v, want %q", content, err, "v2\n")
+	}
+	if target, err := fs.Readlink("link"); err != nil || target != "README.md" {
+		t.Errorf("link points to %q, %v, want README.md", target, err)
+	}
+}
@@ -0,0 +1,431 @@
+package source
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/arekziobrowski/sourcerer/model"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/index"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/pkg/errors"
+)
+
+// State is the state of a source directory left by an earlier run.
+type State int
+
+const (
+	// StateMissing is a directory without a repository.
+	StateMissing State = iota
+	// StatePartial is a repository whose download was not finished, e.g. without the commit checked out.
+	StatePartial
+	// StateOutdated is a repository checked out at another commit, with other sparse paths or with local changes.
+	StateOutdated
+	// StateCurrent is a repository checked out at the commit of the source, without local changes.
+	StateCurrent
+)
+
+func (s State) String() string {
+	switch s {
+	case StateMissing:
+		return "missing"
+	case StatePartial:
+		return "partial"
+	case StateOutdated:
+		return "outdated"
+	case StateCurrent:
+		return "current"
+	}
+	return "unknown"
+}
+
+// SystemGitInspector inspects the source directory with the git command.
+type SystemGitInspector struct {
+	workingDirectory string
+}
+
+func NewSystemGitInspector(wd string) *SystemGitInspector {
+	return &SystemGitInspector{
+		workingDirectory: wd,
+	}
+}
+
+func (i *SystemGitInspector) Inspect(ctx context.Context, src *model.Source) (State, error) {
+	state, _, err := i.inspect(ctx, src)
+	if ctx.Err() != nil {
+		// The git commands killed because the context is done would make the directory look partial.
+		return StateMissing, ctx.Err()
+	}
+	return state, err
+}
+
+// Verify checks that the directory is checked out at the commit of the source without changes. If objects is set,
+// the objects of the repository are checked with 'git fsck' as well.
+func (i *SystemGitInspector) Verify(ctx context.Context, src *model.Source, objects bool) error {
+	state, reason, err := i.inspect(ctx, src)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		return err
+	}
+	if state != StateCurrent {
+		return errors.New(reason)
+	}
+	if objects {
+		if err := run(ctx, i.workingDirectory, "git", "fsck", "--no-dangling", "--no-progress"); err != nil {
+			return errors.Wrap(err, "'git fsck' found broken objects")
+		}
+	}
+	return nil
+}
+
+// inspect returns the state of the directory, along with the reason if it is not current.
+func (i *SystemGitInspector) inspect(ctx context.Context, src *model.Source) (State, string, error) {
+	if _, err := os.Lstat(filepath.Join(i.workingDirectory, ".git")); os.IsNotExist(err) {
+		return StateMissing, "there is no repository", nil
+	} else if err != nil {
+		return StateMissing, "", err
+	}
+	head, err := i.git(ctx, "rev-parse", "--verify", "--quiet", "HEAD^{commit}")
+	if err != nil {
+		return StatePartial, "HEAD is not a commit", nil
+	}
+	if head = strings.TrimSpace(head); head != src.Hash {
+		return StateOutdated, fmt.Sprintf("HEAD is at %s", head), nil
+	}
+	sparse, _ := i.git(ctx, "config", "--bool", "core.sparseCheckout")
+	if sparseCheckoutChanged(i.workingDirectory, strings.TrimSpace(sparse) == "true", src.Options.SparsePaths) {
+		return StateOutdated, "the sparse checkout paths differ", nil
+	}
+
+	// Untracked files, e.g. the downloaded dependencies, are not local changes of the source.
+	status, err := i.git(ctx, "status", "--porcelain", "-z", "--untracked-files=no")
+	if err != nil {
+		return StatePartial, "cannot read the status", nil
+	}
+	for _, entry := range strings.Split(status, "\x00") {
+		// XY SP <path>
+		if len(entry) < 4 {
+			continue
+		}
+		path := entry[3:]
+		if entry[:2] == " M" && i.unchanged(ctx, path) {
+			continue
+		}
+		return StateOutdated, fmt.Sprintf("%s is changed", path), nil
+	}
+	return StateCurrent, "", nil
+}
+
+// unchanged returns true if the file reported as modified was checked out from the index without changes,
+// e.g. a file with CRLF line endings committed before the text attribute was set, or an LFS pointer replaced
+// with its object.
+func (i *SystemGitInspector) unchanged(ctx context.Context, path string) bool {
+	blob, err := i.git(ctx, "rev-parse", ":"+path)
+	if err != nil {
+		return false
+	}
+	blob = strings.TrimSpace(blob)
+	if hash, err := i.git(ctx, "hash-object", "--no-filters", "--", path); err == nil && strings.TrimSpace(hash) == blob {
+		return true
+	}
+	pointer, err := i.git(ctx, "cat-file", "blob", blob)
+	return err == nil && isLFSObject(filepath.Join(i.workingDirectory, filepath.FromSlash(path)), []byte(pointer))
+}
+
+// git runs the git command in the source directory. The repositories the directory is nested in are not looked up,
+// and the errors are expected, so they are not logged.
+func (i *SystemGitInspector) git(ctx context.Context, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = i.workingDirectory
+	cmd.Env = append(os.Environ(), "GIT_CEILING_DIRECTORIES="+filepath.Dir(i.workingDirectory))
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	err := cmd.Run()
+	return stdout.String(), err
+}
+
+// GitInspector inspects the source directory with go-git.
+type GitInspector struct {
+	workingDirectory string
+}
+
+func NewGitInspector(wd string) *GitInspector {
+	return &GitInspector{
+		workingDirectory: wd,
+	}
+}
+
+func (i *GitInspector) Inspect(ctx context.Context, src *model.Source) (State, error) {
+	state, _, err := i.inspect(src)
+	return state, err
+}
+
+// Verify checks that the directory is checked out at the commit of the source without changes. If objects is set,
+// the objects reachable from the commit are checked as well.
+func (i *GitInspector) Verify(ctx context.Context, src *model.Source, objects bool) error {
+	state, reason, err := i.inspect(src)
+	if err != nil {
+		return err
+	}
+	if state != StateCurrent {
+		return errors.New(reason)
+	}
+	if objects {
+		repo, err := git.PlainOpenWithOptions(i.workingDirectory, &git.PlainOpenOptions{EnableDotGitCommonDir: true})
+		if err != nil {
+			return err
+		}
+		return verifyObjects(ctx, repo, plumbing.NewHash(src.Hash))
+	}
+	return nil
+}
+
+// inspect returns the state of the directory, along with the reason if it is not current.
+func (i *GitInspector) inspect(src *model.Source) (State, string, error) {
+	if _, err := os.Lstat(filepath.Join(i.workingDirectory, ".git")); os.IsNotExist(err) {
+		return StateMissing, "there is no repository", nil
+	} else if err != nil {
+		return StateMissing, "", err
+	}
+	repo, err := git.PlainOpenWithOptions(i.workingDirectory, &git.PlainOpenOptions{EnableDotGitCommonDir: true})
+	if err != nil {
+		return StatePartial, fmt.Sprintf("cannot open the repository: %v", err), nil
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return StatePartial, fmt.Sprintf("cannot read HEAD: %v", err), nil
+	}
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return StatePartial, "HEAD is not a commit", nil
+	}
+	if head.Hash().String() != src.Hash {
+		return StateOutdated, fmt.Sprintf("HEAD is at %s", head.Hash()), nil
+	}
+	cfg, err := repo.Config()
+	if err != nil {
+		return StatePartial, fmt.Sprintf("cannot read the configuration: %v", err), nil
+	}
+	sparse := cfg.Raw.Section("core").Option("sparseCheckout") == "true"
+	if sparseCheckoutChanged(i.workingDirectory, sparse, src.Options.SparsePaths) {
+		return StateOutdated, "the sparse checkout paths differ", nil
+	}
+
+	// The worktree is compared with the index, as the go-git status does not support the sparse checkouts.
+	idx, err := repo.Storer.Index()
+	if err != nil {
+		return StatePartial, fmt.Sprintf("cannot read the index: %v", err), nil
+	}
+	entries, err := treeEntries(commit)
+	if err != nil {
+		return StatePartial, fmt.Sprintf("cannot read the tree of HEAD: %v", err), nil
+	}
+	if len(entries) != len(idx.Entries) {
+		return StateOutdated, "the index differs from HEAD", nil
+	}
+	for _, e := range idx.Entries {
+		if t, ok := entries[e.Name]; !ok || t.Hash != e.Hash || t.Mode != e.Mode {
+			return StateOutdated, fmt.Sprintf("%s is changed in the index", e.Name), nil
+		}
+		if !e.SkipWorktree && i.changed(repo, e) {
+			return StateOutdated, fmt.Sprintf("%s is changed", e.Name), nil
+		}
+	}
+	return StateCurrent, "", nil
+}
+
+// treeEntries returns the file and submodule entries of the commit tree by their paths.
+func treeEntries(commit *object.Commit) (map[string]object.TreeEntry, error) {
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	walker := object.NewTreeWalker(tree, true, nil)
+	defer walker.Close()
+
+	entries := make(map[string]object.TreeEntry)
+	for {
+		name, entry, err := walker.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if entry.Mode != filemode.Dir {
+			entries[name] = entry
+		}
+	}
+}
+
+// changed returns true if the worktree differs from the index entry. An LFS pointer replaced with its object
+// and a submodule that is not checked out are not changes.
+func (i *GitInspector) changed(repo *git.Repository, e *index.Entry) bool {
+	filename := filepath.Join(i.workingDirectory, filepath.FromSlash(e.Name))
+	info, err := os.Lstat(filename)
+	if err != nil {
+		return true
+	}
+	hasher := plumbing.NewHasher(plumbing.BlobObject, info.Size())
+	switch e.Mode {
+	case filemode.Submodule:
+		sub, err := git.PlainOpen(filename)
+		if err == git.ErrRepositoryNotExists {
+			return false
+		}
+		if err != nil {
+			return true
+		}
+		head, err := sub.Head()
+		return err != nil || head.Hash() != e.Hash
+	case filemode.Symlink:
+		target, err := os.Readlink(filename)
+		if err != nil {
+			return true
+		}
+		target = filepath.ToSlash(target)
+		hasher = plumbing.NewHasher(plumbing.BlobObject, int64(len(target)))
+		io.WriteString(hasher, target)
+	default:
+		if !info.Mode().IsRegular() {
+			return true
+		}
+		f, err := os.Open(filename)
+		if err != nil {
+			return true
+		}
+		_, err = io.Copy(hasher, f)
+		f.Close()
+		if err != nil {
+			return true
+		}
+	}
+	return hasher.Sum() != e.Hash && !i.isLFSObject(repo, e.Hash, filename)
+}
+
+// isLFSObject returns true if the file was checked out from the blob of an LFS pointer that was replaced with its object.
+func (i *GitInspector) isLFSObject(repo *git.Repository, hash plumbing.Hash, filename string) bool {
+	blob, err := repo.BlobObject(hash)
+	if err != nil || blob.Size > maxLFSPointerSize {
+		return false
+	}
+	r, err := blob.Reader()
+	if err != nil {
+		return false
+	}
+	defer r.Close()
+	pointer, err := ioutil.ReadAll(io.LimitReader(r, maxLFSPointerSize))
+	return err == nil && isLFSObject(filename, pointer)
+}
+
+// sparseCheckoutChanged returns true if the sparse checkout of the directory differs from the patterns.
+func sparseCheckoutChanged(wd string, enabled bool, patterns []string) bool {
+	if !enabled {
+		return len(patterns) > 0
+	}
+	content, err := ioutil.ReadFile(filepath.Join(wd, filepath.FromSlash(sparseCheckoutFile)))
+	if err != nil {
+		return true
+	}
+	return len(patterns) == 0 || string(content) != strings.Join(patterns, "\n")+"\n"
+}
+
+// verifyObjects reads the objects reachable from the commit, down to the shallow commits, and checks their hashes.
+func verifyObjects(ctx context.Context, repo *git.Repository, hash plumbing.Hash) error {
+	shallows, err := repo.Storer.Shallow()
+	if err != nil {
+		return err
+	}
+	shallow := make(map[plumbing.Hash]bool, len(shallows))
+	for _, h := range shallows {
+		shallow[h] = true
+	}
+	seen := make(map[plumbing.Hash]bool)
+	commits := []plumbing.Hash{hash}
+	for len(commits) > 0 {
+		h := commits[len(commits)-1]
+		commits = commits[:len(commits)-1]
+		if seen[h] {
+			continue
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		seen[h] = true
+		if err := verifyObject(repo, h); err != nil {
+			return err
+		}
+		commit, err := repo.CommitObject(h)
+		if err != nil {
+			return errors.Wrapf(err, "cannot read commit %s", h)
+		}
+		if err := verifyTree(repo, commit.TreeHash, seen); err != nil {
+			return err
+		}
+		if !shallow[h] {
+			commits = append(commits, commit.ParentHashes...)
+		}
+	}
+	return nil
+}
+
+func verifyTree(repo *git.Repository, hash plumbing.Hash, seen map[plumbing.Hash]bool) error {
+	if seen[hash] {
+		return nil
+	}
+	seen[hash] = true
+	if err := verifyObject(repo, hash); err != nil {
+		return err
+	}
+	tree, err := repo.TreeObject(hash)
+	if err != nil {
+		return errors.Wrapf(err, "cannot read tree %s", hash)
+	}
+	for _, e := range tree.Entries {
+		switch {
+		case e.Mode == filemode.Dir:
+			if err := verifyTree(repo, e.Hash, seen); err != nil {
+				return err
+			}
+		case e.Mode == filemode.Submodule || seen[e.Hash]:
+		default:
+			seen[e.Hash] = true
+			if err := verifyObject(repo, e.Hash); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// verifyObject checks that the object exists and its contents match its hash.
+func verifyObject(repo *git.Repository, hash plumbing.Hash) error {
+	obj, err := repo.Storer.EncodedObject(plumbing.AnyObject, hash)
+	if err != nil {
+		return errors.Wrapf(err, "cannot read object %s", hash)
+	}
+	r, err := obj.Reader()
+	if err != nil {
+		return errors.Wrapf(err, "cannot read object %s", hash)
+	}
+	defer r.Close()
+	hasher := plumbing.NewHasher(obj.Type(), obj.Size())
+	if _, err := io.Copy(hasher, r); err != nil {
+		return errors.Wrapf(err, "cannot read object %s", hash)
+	}
+	if sum := hasher.Sum(); sum != hash {
+		return errors.Errorf("object %s is corrupt, its contents hash to %s", hash, sum)
+	}
+	return nil
+}
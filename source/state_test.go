@@ -0,0 +1,127 @@
+package source
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/arekziobrowski/sourcerer/model"
+)
+
+type stateInspector interface {
+	Inspect(ctx context.Context, src *model.Source) (State, error)
+	Verify(ctx context.Context, src *model.Source, objects bool) error
+}
+
+func TestInspect(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	root := t.TempDir()
+	origin := filepath.Join(root, "origin")
+	gitTest(t, root, "init", "-q", origin)
+	for i, content := range []string{"first\n", "second\n"} {
+		if err := ioutil.WriteFile(filepath.Join(origin, "f"), []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+		gitTest(t, origin, "add", "f")
+		gitTest(t, origin, "commit", "-q", "-m", content)
+		if i == 0 {
+			gitTest(t, origin, "tag", "first")
+		}
+	}
+	head := strings.TrimSpace(gitTest(t, origin, "rev-parse", "HEAD"))
+
+	write := func(t *testing.T, filename, content string) {
+		if err := ioutil.WriteFile(filename, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name string
+		// prepare changes the clone of the origin checked out at HEAD in the directory.
+		prepare func(t *testing.T, dir string)
+		paths   []string
+		want    State
+	}{
+		{name: "current", prepare: func(t *testing.T, dir string) {}, want: StateCurrent},
+		{
+			name:    "untracked file",
+			prepare: func(t *testing.T, dir string) { write(t, filepath.Join(dir, "untracked"), "x") },
+			want:    StateCurrent,
+		},
+		{
+			name:    "missing",
+			prepare: func(t *testing.T, dir string) { os.RemoveAll(filepath.Join(dir, ".git")) },
+			want:    StateMissing,
+		},
+		{
+			name: "no commit",
+			prepare: func(t *testing.T, dir string) {
+				os.RemoveAll(filepath.Join(dir, ".git"))
+				gitTest(t, dir, "init", "-q")
+			},
+			want: StatePartial,
+		},
+		{
+			name:    "another commit",
+			prepare: func(t *testing.T, dir string) { gitTest(t, dir, "checkout", "-q", "first") },
+			want:    StateOutdated,
+		},
+		{
+			name:    "changed file",
+			prepare: func(t *testing.T, dir string) { write(t, filepath.Join(dir, "f"), "changed\n") },
+			want:    StateOutdated,
+		},
+		{
+			name:    "removed file",
+			prepare: func(t *testing.T, dir string) { os.Remove(filepath.Join(dir, "f")) },
+			want:    StateOutdated,
+		},
+		{
+			name:    "sparse paths",
+			prepare: func(t *testing.T, dir string) {},
+			paths:   []string{"/f"},
+			want:    StateOutdated,
+		},
+	}
+	inspectors := []struct {
+		name string
+		new  func(wd string) stateInspector
+	}{
+		{"git-system", func(wd string) stateInspector {
+			return NewSystemGitInspector(wd)
+		}},
+		{"git", func(wd string) stateInspector {
+			return NewGitInspector(wd)
+		}},
+	}
+	for _, inspector := range inspectors {
+		for _, tt := range tests {
+			t.Run(inspector.name+"/"+tt.name, func(t *testing.T) {
+				dir := filepath.Join(t.TempDir(), "src")
+				gitTest(t, root, "clone", "-q", origin, dir)
+				tt.prepare(t, dir)
+				src := &model.Source{Origin: "file://" + origin, Hash: head, Options: model.Options{SparsePaths: tt.paths}}
+				i := inspector.new(dir)
+				state, err := i.Inspect(context.Background(), src)
+				if err != nil {
+					t.Fatalf("Inspect failed: %v", err)
+				}
+				if state != tt.want {
+					t.Errorf("Inspect = %s, want %s", state, tt.want)
+				}
+				for _, objects := range []bool{false, true} {
+					err := i.Verify(context.Background(), src, objects)
+					if (err == nil) != (tt.want == StateCurrent) {
+						t.Errorf("Verify(objects: %v) = %v, want an error: %v", objects, err, tt.want != StateCurrent)
+					}
+				}
+			})
+		}
+	}
+}
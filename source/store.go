@@ -0,0 +1,109 @@
+package source
+
+import (
+	"sync"
+
+	"github.com/arekziobrowski/sourcerer/model"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// storeRefPrefix is the prefix of the references keeping the fetched commits in a store.
+	storeRefPrefix = "refs/sourcerer/"
+	// maxStoreBatch is the maximum number of commits fetched into a store at once.
+	maxStoreBatch = 256
+)
+
+// Store is a bare repository shared by the sources of one origin. The commits wanted by the sources are fetched
+// into the store in batches, so that a single negotiation with the remote covers many sources.
+type Store struct {
+	dir    string
+	origin string
+	mutex  sync.Mutex
+	// wanted are the commits to fetch with the next batch, by the history to fetch along with them.
+	wanted  map[string][]string
+	fetched map[string]bool
+}
+
+// storeFetchFunc fetches the commits along with their history into the store.
+type storeFetchFunc func(s *Store, hashes []string, history model.History) error
+
+func NewStore(dir, origin string) *Store {
+	return &Store{
+		dir:     dir,
+		origin:  origin,
+		wanted:  make(map[string][]string),
+		fetched: make(map[string]bool),
+	}
+}
+
+// Dir returns the directory of the bare repository.
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+// Want adds the commit to the next batch fetched into the store.
+func (s *Store) Want(hash string, history model.History) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	key := history.String()
+	if s.fetched[key+" "+hash] || contains(s.wanted[key], hash) {
+		return
+	}
+	s.wanted[key] = append(s.wanted[key], hash)
+}
+
+// fetch makes sure the commit is in the store, fetching it along with the other wanted commits of the same history.
+// If the batch cannot be fetched, e.g. because one of the commits does not exist, the commit is fetched alone.
+func (s *Store) fetch(hash string, history model.History, fetch storeFetchFunc) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	key := history.String()
+	if s.fetched[key+" "+hash] {
+		return nil
+	}
+
+	batch := []string{hash}
+	var rest []string
+	for _, h := range s.wanted[key] {
+		switch {
+		case h == hash:
+		case len(batch) < maxStoreBatch:
+			batch = append(batch, h)
+		default:
+			rest = append(rest, h)
+		}
+	}
+	s.wanted[key] = rest
+
+	log.Infof("Fetching %d commits of %s into %s", len(batch), model.Redact(s.origin), s.dir)
+	err := fetch(s, batch, history)
+	if err != nil && len(batch) > 1 {
+		log.Warnf("Failed to fetch %d commits of %s at once, fetching %s alone: %v", len(batch), model.Redact(s.origin), hash, err)
+		batch = batch[:1]
+		err = fetch(s, batch, history)
+	}
+	if err != nil {
+		return err
+	}
+	for _, h := range batch {
+		s.fetched[key+" "+h] = true
+	}
+	return nil
+}
+
+// locked runs the function holding the lock of the store, for the changes of the store that cannot run concurrently.
+func (s *Store) locked(fn func() error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return fn()
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+package source
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/arekziobrowski/sourcerer/model"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const gitmodulesFile = ".gitmodules"
+
+// gitlink is a submodule entry in the tree of the superproject.
+type gitlink struct {
+	path string
+	hash string
+}
+
+type downloader interface {
+	Get(ctx context.Context, src *model.Source) error
+}
+
+// updateSubmodules checks out the submodules of the source at the commits recorded in its tree, using the downloaders
+// created by newDownloader for the submodule directories. The submodule commits are recorded in the source.
+func updateSubmodules(ctx context.Context, src *model.Source, wd string, links []gitlink, newDownloader func(wd string) downloader) error {
+	if len(links) == 0 {
+		return nil
+	}
+	content, err := ioutil.ReadFile(filepath.Join(wd, gitmodulesFile))
+	if os.IsNotExist(err) {
+		log.Warnf("There is no %s in %s, skipping %d submodules", gitmodulesFile, wd, len(links))
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %s", gitmodulesFile)
+	}
+	modules := config.NewModules()
+	if err := modules.Unmarshal(content); err != nil {
+		return errors.Wrapf(err, "failed to parse %s", gitmodulesFile)
+	}
+	byPath := make(map[string]*config.Submodule, len(modules.Submodules))
+	for _, m := range modules.Submodules {
+		byPath[strings.Trim(m.Path, "/")] = m
+	}
+
+	included := newSparseMatcher(src.Options.SparsePaths)
+	for _, link := range links {
+		if included != nil && !included.Match(strings.Split(link.path, "/"), true) {
+			continue
+		}
+		m, ok := byPath[link.path]
+		if !ok {
+			log.Warnf("Submodule %s of %s is not defined in %s, skipping", link.path, model.Redact(src.Origin), gitmodulesFile)
+			continue
+		}
+		if err := m.Validate(); err != nil {
+			return errors.Wrapf(err, "invalid submodule %s", m.Name)
+		}
+		origin, err := resolveSubmoduleURL(src.Origin, m.URL)
+		if err != nil {
+			return err
+		}
+		sub, err := model.NewSource(origin, link.hash)
+		if err != nil {
+			return errors.Wrapf(err, "invalid submodule %s", m.Name)
+		}
+		sub.Options.Submodules = src.Options.Submodules
+		sub.Options.LFS = src.Options.LFS
+
+		subWd := filepath.Join(wd, filepath.FromSlash(link.path))
+		if err := os.MkdirAll(subWd, 0777); err != nil {
+			return errors.Wrapf(err, "cannot create submodule directory %s", subWd)
+		}
+		log.Infof("Downloading submodule %s of %s", link.path, model.Redact(src.Origin))
+		if err := newDownloader(subWd).Get(ctx, sub); err != nil {
+			return errors.Wrapf(err, "failed to download submodule %s", link.path)
+		}
+
+		src.Submodules = append(src.Submodules, model.Submodule{Path: link.path, Origin: origin, Hash: link.hash})
+		for _, nested := range sub.Submodules {
+			nested.Path = link.path + "/" + nested.Path
+			src.Submodules = append(src.Submodules, nested)
+		}
+		for _, pointer := range sub.UnresolvedLFSPointers {
+			pointer.Path = link.path + "/" + pointer.Path
+			src.UnresolvedLFSPointers = append(src.UnresolvedLFSPointers, pointer)
+		}
+	}
+	return nil
+}
+
+// resolveSubmoduleURL resolves the URLs relative to the superproject origin ("./" and "../"), the same way git does.
+func resolveSubmoduleURL(parent, url string) (string, error) {
+	if !strings.HasPrefix(url, "./") && !strings.HasPrefix(url, "../") {
+		return url, nil
+	}
+	rel := url
+	base := strings.TrimSuffix(parent, "/")
+	sep := "/"
+	for {
+		switch {
+		case strings.HasPrefix(url, "./"):
+			url = url[2:]
+		case strings.HasPrefix(url, "../"):
+			url = url[3:]
+			i := strings.LastIndexAny(base, "/:")
+			if i < 0 || strings.HasSuffix(base[:i], ":/") {
+				return "", errors.Errorf("cannot resolve submodule URL %s relative to %s", model.Redact(rel), model.Redact(parent))
+			}
+			sep = base[i : i+1]
+			base = base[:i]
+		default:
+			return base + sep + url, nil
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/arekziobrowski/sourcerer/manifest"
+)
+
+const validateCommand = "validate"
+
+// validate checks the manifests given with the --input flag or as arguments and returns the exit code.
+func validate(args []string) int {
+	fs := flag.NewFlagSet(validateCommand, flag.ExitOnError)
+	input := fs.String("input", "", "input file name")
+	hosts := fs.String("hosts", "", "comma-separated list of supported Git hosts, any host is supported if empty")
+	rejectMultipleRevisions := fs.Bool("reject_multiple_revisions", false, "report the same repository pinned to different revisions as an error")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s [flags] [manifest...]\n", os.Args[0], validateCommand)
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	files := fs.Args()
+	if *input != "" {
+		files = append([]string{*input}, files...)
+	}
+	if len(files) == 0 {
+		fmt.Fprintln(os.Stderr, "Input is missing, please use --input flag or arguments to provide the input")
+		fs.Usage()
+		return 2
+	}
+
+	opts := manifest.ValidateOptions{RejectMultipleRevisions: *rejectMultipleRevisions}
+	if *hosts != "" {
+		opts.Hosts = strings.Split(*hosts, ",")
+	}
+
+	code := 0
+	for _, f := range files {
+		diags, err := manifest.Validate(f, opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", f, err)
+			code = 1
+			continue
+		}
+		for _, d := range diags {
+			fmt.Fprintf(os.Stderr, "%s:%s\n", f, d)
+		}
+		if manifest.HasErrors(diags) {
+			code = 1
+		}
+	}
+	return code
+}